@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internal/db"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// apiKeyTouchInterval limits how often last_used is written for a busy key
+const apiKeyTouchInterval = time.Minute
+
+// authenticateAPIKey checks an API key and returns claims limited to its scopes
+func (s *Server) authenticateAPIKey(ctx context.Context, keyStr string) (*JWTClaims, error) {
+	prefix, secret, err := db.ParseAPIKey(strings.TrimSpace(keyStr))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.apiKeys.GetAPIKey(ctx, prefix)
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		return nil, db.ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !key.Verify(secret, now) {
+		return nil, db.ErrAPIKeyInvalid
+	}
+
+	user, err := s.getUser(ctx, key.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	if now.Sub(key.LastUsed) > apiKeyTouchInterval {
+		if err := s.apiKeys.TouchAPIKey(ctx, key.Prefix, now); err != nil {
+			log.Printf("api key %s: %v", key.Prefix, err)
+		}
+	}
+
+	// Keys never carry a role, so they cannot reach role-checked routes
+	return &JWTClaims{
+		Username: key.Username,
+		Purpose:  PurposeAPIKey,
+		Scope:    strings.Join(key.Scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        key.Prefix,
+			ExpiresAt: jwt.NewNumericDate(key.ExpiresAt),
+		},
+	}, nil
+}
+
+// createAPIKey stores a new key and returns it with the key string
+func (s *Server) createAPIKey(ctx context.Context, username, name string, scopes []string, ttl time.Duration) (*db.APIKey, string, error) {
+	if name == "" || len(name) > 64 {
+		return nil, "", errors.New("validation: name must be 1-64 characters")
+	}
+	if ttl <= 0 || ttl > MaxAPIKeyDuration {
+		return nil, "", fmt.Errorf("validation: lifetime must be at most %d days", int(MaxAPIKeyDuration.Hours()/24))
+	}
+
+	key, keyStr, err := db.NewAPIKey(username, name, scopes, ttl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.apiKeys.AddAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+
+	return key, keyStr, nil
+}
+
+// revokeAPIKey deletes a key of username; keys of other users are reported
+// as not found
+func (s *Server) revokeAPIKey(ctx context.Context, username, prefix string) error {
+	key, err := s.apiKeys.GetAPIKey(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if key.Username != username {
+		return db.ErrAPIKeyNotFound
+	}
+
+	return s.apiKeys.DeleteAPIKey(ctx, key)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internal/clientip"
+	"internal/db"
+	"internal/ipfilter"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ipListsReloadInterval is how often the IP lists file is checked for changes
+const ipListsReloadInterval = 10 * time.Second
+
+// BanPolicy decides when clients that keep hitting rate limits are banned.
+// After Threshold rejections within Period the client address is banned
+// for BaseDuration, doubling with each further ban up to MaxDuration.
+// Bans are forgotten Memory after the last one.
+type BanPolicy struct {
+	Threshold    int
+	Period       time.Duration
+	BaseDuration time.Duration
+	MaxDuration  time.Duration
+	Memory       time.Duration
+}
+
+// NewBanPolicy returns the default policy
+func NewBanPolicy() *BanPolicy {
+	return &BanPolicy{
+		Threshold:    50,
+		Period:       10 * time.Minute,
+		BaseDuration: 15 * time.Minute,
+		MaxDuration:  24 * time.Hour,
+		Memory:       7 * 24 * time.Hour,
+	}
+}
+
+// duration is how long the ban of the given level lasts
+func (p *BanPolicy) duration(level int) time.Duration {
+	d := p.BaseDuration
+	for i := 1; i < level && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > p.MaxDuration {
+		d = p.MaxDuration
+	}
+	return d
+}
+
+// ipFilterMiddleware rejects denylisted and banned clients before they
+// reach the rate limiter. Allowlisted clients are never banned.
+func (s *Server) ipFilterMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := clientip.FromContext(r.Context())
+
+		switch s.ipFilter.Check(addr) {
+		case ipfilter.Allowed:
+			next(w, r)
+			return
+		case ipfilter.Denied:
+			s.recordBlocked("denylist")
+			JSONError(w, "Forbidden: address blocked", http.StatusForbidden)
+			return
+		}
+
+		ban, err := s.bans.Get(r.Context(), s.getClientIP(r))
+		if err == nil {
+			s.recordBlocked("ban")
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(ban.Until))))
+			JSONError(w, "Forbidden: address temporarily banned", http.StatusForbidden)
+			return
+		}
+		if !errors.Is(err, db.ErrBanNotFound) {
+			// Like the rate limiter, fail open while Redis is down
+			log.Printf("ban check %s: %v", s.getClientIP(r), err)
+		}
+
+		next(w, r)
+	}
+}
+
+// isAllowlisted reports whether r comes from an allowlisted network
+func (s *Server) isAllowlisted(r *http.Request) bool {
+	addr, _ := clientip.FromContext(r.Context())
+	return s.ipFilter.Check(addr) == ipfilter.Allowed
+}
+
+// recordViolation counts a rate limit rejection of ip and bans it once
+// the policy threshold is reached
+func (s *Server) recordViolation(ctx context.Context, ip, policy string) {
+	if ip == "" || s.banPolicy.Threshold == 0 {
+		return
+	}
+
+	violations, err := s.bans.RecordViolation(ctx, ip, s.banPolicy.Period)
+	if err != nil {
+		log.Printf("record rate limit violation: %v", err)
+		return
+	}
+	// Only the violation reaching the threshold bans, so that a burst
+	// handled by several instances escalates the level just once
+	if violations != s.banPolicy.Threshold {
+		return
+	}
+
+	level, err := s.bans.NextLevel(ctx, ip, s.banPolicy.Memory)
+	if err != nil {
+		log.Printf("ban %s: %v", ip, err)
+		return
+	}
+
+	now := time.Now()
+	ban := &db.Ban{
+		IP:     ip,
+		Reason: fmt.Sprintf("%d requests over rate limit %s in %s", violations, policy, s.banPolicy.Period),
+		Since:  now,
+		Until:  now.Add(s.banPolicy.duration(level)),
+		Level:  level,
+	}
+	if err := s.bans.Ban(ctx, ban); err != nil {
+		log.Printf("ban %s: %v", ip, err)
+		return
+	}
+
+	s.recordBan()
+	log.Printf("client %s banned until %s (level %d): %s", ip, ban.Until.Format(time.RFC3339), level, ban.Reason)
+}
+
+// liftBan ends a ban before it expires
+func (s *Server) liftBan(ctx context.Context, ip string) error {
+	return s.bans.Lift(ctx, ip)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestViolationBurstBansOnce(t *testing.T) {
+	ts := newTestServer(t)
+	ts.banPolicy.Threshold = 5
+	ctx := context.Background()
+
+	// A burst past the threshold, as several instances would see it. It
+	// stays short of a second threshold after the ban resets the count.
+	var wg sync.WaitGroup
+	for i := 0; i < 2*ts.banPolicy.Threshold-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.recordViolation(ctx, "203.0.113.9", "login")
+		}()
+	}
+	wg.Wait()
+
+	ban, err := ts.bans.Get(ctx, "203.0.113.9")
+	if err != nil {
+		t.Fatalf("Expected the client to be banned: %v", err)
+	}
+	if ban.Level != 1 || ban.Until.Sub(ban.Since) != ts.banPolicy.BaseDuration {
+		t.Fatalf("Expected a single level 1 ban, got %+v", ban)
+	}
+
+	// The escalation counted one ban
+	if level, _ := ts.bans.NextLevel(ctx, "203.0.113.9", ts.banPolicy.Memory); level != 2 {
+		t.Fatalf("Expected the next ban to be level 2, got %d", level)
+	}
+}
@@ -0,0 +1,160 @@
+// Package clientip finds the address of the client behind trusted
+// proxies, from X-Forwarded-For, the RFC 7239 Forwarded header, X-Real-IP
+// or the PROXY protocol. Only the one header the proxies write is read,
+// and only when every hop after the client is a trusted proxy, so clients
+// cannot choose their own address.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Forwarding headers a Resolver can read
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// Resolver resolves client addresses given the networks of trusted proxies
+type Resolver struct {
+	header  string
+	trusted []netip.Prefix
+}
+
+// NewResolver trusts proxies in the given CIDRs; bare addresses are
+// accepted as single-host networks. header is the forwarding header those
+// proxies set; any other forwarding header may come from the client and
+// is ignored.
+func NewResolver(header string, cidrs ...string) (*Resolver, error) {
+	r := &Resolver{header: http.CanonicalHeaderKey(header)}
+	switch r.header {
+	case HeaderXForwardedFor, HeaderForwarded, http.CanonicalHeaderKey(HeaderXRealIP):
+	default:
+		return nil, fmt.Errorf("unsupported forwarding header %q", header)
+	}
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+// Trusted reports whether addr belongs to a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent req. The
+// configured header is walked from the nearest hop outwards and the first
+// hop that is not a trusted proxy is the client; X-Real-IP holds a single
+// hop.
+func (r *Resolver) ClientIP(req *http.Request) netip.Addr {
+	remote := parseHost(req.RemoteAddr)
+	if !remote.IsValid() || !r.Trusted(remote) {
+		return remote
+	}
+
+	values := req.Header.Values(r.header)
+	var hops []string
+	switch r.header {
+	case HeaderForwarded:
+		hops = forwardedFor(values)
+	case HeaderXForwardedFor:
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	default:
+		if len(values) > 0 {
+			hops = values[len(values)-1:]
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHost(hops[i])
+		// An unreadable hop hides everything before it, so the last
+		// proxy that could be read is as far as the chain is known
+		if !hop.IsValid() {
+			break
+		}
+		client = hop
+		if !r.Trusted(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor returns the for= parameter of each Forwarded element, in
+// order. Elements without one yield "" so that they stop the walk.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHost reads an address with or without a port, and with or without
+// the brackets around IPv6 addresses
+func parseHost(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the client address
+func NewContext(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, contextKey{}, addr)
+}
+
+// FromContext returns the client address stored by NewContext
+func FromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(contextKey{}).(netip.Addr)
+	return addr, ok
+}
@@ -0,0 +1,184 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyHeaderTimeout bounds how long a trusted proxy may take to send the header
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener accepts connections that start with a PROXY protocol
+// header (v1 or v2) and reports the address in it as their remote
+// address. Only trusted proxies must send the header; other peers connect
+// as usual and their headers, if any, are not read.
+type ProxyListener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+// NewProxyListener wraps l; resolver decides which peers are proxies
+func NewProxyListener(l net.Listener, resolver *Resolver) *ProxyListener {
+	return &ProxyListener{Listener: l, resolver: resolver}
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.resolver.Trusted(parseHost(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the header on first use, so that a slow proxy only
+// holds up its own connection rather than Accept
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.remote, c.err = ReadProxyHeader(c.reader)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+// ReadProxyHeader reads a PROXY protocol header from r and returns the
+// source address it carries. Health checks sent by the proxy itself
+// (LOCAL, UNKNOWN) carry none and return a nil address.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("%w: missing header", ErrInvalidProxyHeader)
+}
+
+// readProxyV1 reads "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidProxyHeader)
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address", ErrInvalidProxyHeader)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port", ErrInvalidProxyHeader)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 reads the binary header: signature, version and command,
+// family, length, then the addresses and TLVs, which are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch versionCommand {
+	case 0x20: // LOCAL
+		return nil, nil
+	case 0x21: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported version or command %#x", ErrInvalidProxyHeader, versionCommand)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidProxyHeader)
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidProxyHeader)
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// Other families, such as UNSPEC or unix sockets, carry no usable address
+	return nil, nil
+}
@@ -0,0 +1,203 @@
+// Package concurrency bounds how much CPU-heavy work, such as password
+// hashing, runs at once. The bound adapts to how long the work takes, and
+// work beyond it waits in a short queue or is shed, so that a burst of
+// logins cannot starve every other request.
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Reasons a task is shed
+const (
+	ReasonQueueFull = "queue_full"
+	ReasonTimeout   = "timeout"
+)
+
+// OverloadError is returned by Acquire when a task is shed
+type OverloadError struct {
+	Reason string
+	// RetryAfter estimates when the queue will have drained
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("overloaded: too much work in progress (%s), retry in %s", e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+// Config tunes a Limiter
+type Config struct {
+	// InitialLimit, MinLimit and MaxLimit bound the number of tasks running at once
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Target is the task latency above which the limit is cut
+	Target time.Duration
+	// Backoff multiplies the limit after a task exceeds Target
+	Backoff float64
+	// MaxQueue is how many tasks may wait for a slot
+	MaxQueue int
+	// MaxWait is how long a task may wait before it is shed
+	MaxWait time.Duration
+}
+
+// NewConfig returns a configuration that runs at most one task per CPU
+func NewConfig() *Config {
+	cpus := runtime.GOMAXPROCS(0)
+	return &Config{
+		InitialLimit: cpus,
+		MinLimit:     1,
+		MaxLimit:     cpus,
+		Target:       250 * time.Millisecond,
+		Backoff:      0.9,
+		MaxQueue:     4 * cpus,
+		MaxWait:      2 * time.Second,
+	}
+}
+
+// Validate checks that the configuration can be used
+func (c *Config) Validate() error {
+	switch {
+	case c.MinLimit < 1 || c.MaxLimit < c.MinLimit:
+		return fmt.Errorf("limits must satisfy 1 <= min (%d) <= max (%d)", c.MinLimit, c.MaxLimit)
+	case c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit:
+		return fmt.Errorf("initial limit %d must be between %d and %d", c.InitialLimit, c.MinLimit, c.MaxLimit)
+	case c.Target <= 0 || c.MaxWait < 0 || c.MaxQueue < 0:
+		return fmt.Errorf("target must be positive, queue size and wait not negative")
+	case c.Backoff <= 0 || c.Backoff >= 1:
+		return fmt.Errorf("backoff must be between 0 and 1, got %g", c.Backoff)
+	}
+	return nil
+}
+
+// Limiter admits tasks up to an AIMD limit: each task that finishes
+// within Target raises the limit by 1/limit, so about one per limit
+// tasks, and each slower one multiplies it by Backoff. Tasks beyond the
+// limit wait in FIFO order.
+type Limiter struct {
+	config Config
+
+	mutex    sync.Mutex
+	limit    float64
+	inFlight int
+	// queue holds *waiter, oldest first
+	queue *list.List
+	// latency is a moving average of task latency
+	latency time.Duration
+}
+
+type waiter struct {
+	ready chan struct{}
+	// admitted is set under the mutex when the waiter is given a slot
+	admitted bool
+}
+
+// Stats is a snapshot of a Limiter
+type Stats struct {
+	Limit    int
+	InFlight int
+	Queued   int
+}
+
+func NewLimiter(config *Config) *Limiter {
+	return &Limiter{
+		config:  *config,
+		limit:   float64(config.InitialLimit),
+		queue:   list.New(),
+		latency: config.Target,
+	}
+}
+
+// Acquire waits for a slot and returns the function that gives it back,
+// which must be called once the task is done. Tasks are shed with an
+// OverloadError when the queue is full or the wait exceeds MaxWait.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	l.mutex.Lock()
+	if l.inFlight < int(l.limit) && l.queue.Len() == 0 {
+		l.inFlight++
+		l.mutex.Unlock()
+		return l.releaser(), nil
+	}
+	if l.queue.Len() >= l.config.MaxQueue {
+		err := l.overload(ReasonQueueFull)
+		l.mutex.Unlock()
+		return nil, err
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.queue.PushBack(w)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.config.MaxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return l.releaser(), nil
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// The slot may have been handed over while giving up
+	if w.admitted {
+		return l.releaser(), nil
+	}
+	l.queue.Remove(elem)
+	if err != nil {
+		return nil, err
+	}
+	return nil, l.overload(ReasonTimeout)
+}
+
+// Stats returns the current limit, running and waiting tasks
+func (l *Limiter) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return Stats{Limit: int(l.limit), InFlight: l.inFlight, Queued: l.queue.Len()}
+}
+
+// releaser returns the release function of a slot taken now
+func (l *Limiter) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(time.Since(start)) })
+	}
+}
+
+func (l *Limiter) release(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight--
+	l.latency += (latency - l.latency) / 8
+
+	if latency > l.config.Target {
+		l.limit = max(float64(l.config.MinLimit), l.limit*l.config.Backoff)
+	} else {
+		l.limit = min(float64(l.config.MaxLimit), l.limit+1/l.limit)
+	}
+
+	for l.inFlight < int(l.limit) && l.queue.Len() > 0 {
+		w := l.queue.Remove(l.queue.Front()).(*waiter)
+		w.admitted = true
+		l.inFlight++
+		close(w.ready)
+	}
+}
+
+// overload builds the error for a shed task; the caller holds the mutex
+func (l *Limiter) overload(reason string) *OverloadError {
+	// Everyone queued has to run before a retry would get a slot
+	rounds := l.queue.Len()/max(int(l.limit), 1) + 1
+	return &OverloadError{Reason: reason, RetryAfter: time.Duration(rounds) * l.latency}
+}
@@ -0,0 +1,392 @@
+// Package config holds the settings of the server. They are read from a
+// YAML file over built-in defaults, then from environment variables,
+// which win, and are validated as a whole so that every problem is
+// reported at once.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environments the server runs in
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// Config is every setting of the server. The env tag names the variable
+// that overrides a field; lists are comma separated and durations are
+// written like "15m".
+type Config struct {
+	// Environment is development or production; production refuses the
+	// development secrets
+	Environment string          `yaml:"environment" env:"APP_ENV"`
+	Server      ServerConfig    `yaml:"server"`
+	Cassandra   CassandraConfig `yaml:"cassandra"`
+	Redis       RedisConfig     `yaml:"redis"`
+	Auth        AuthConfig      `yaml:"auth"`
+	Passwords   PasswordConfig  `yaml:"passwords"`
+	RateLimit   RateLimitConfig `yaml:"rate_limit"`
+	Mail        MailConfig      `yaml:"mail"`
+}
+
+type ServerConfig struct {
+	Addr        string `yaml:"addr" env:"HTTP_ADDR"`
+	MetricsAddr string `yaml:"metrics_addr" env:"METRICS_ADDR"`
+	// TLSCertDir holds server.crt and server.key
+	TLSCertDir string `yaml:"tls_cert_dir" env:"TLS_CERT_DIR"`
+	// CORSOrigin is the origin of the dashboard allowed to call the API
+	CORSOrigin string `yaml:"cors_origin" env:"CORS_ORIGIN"`
+	// AppBaseURL is where the dashboard lives, used in emailed links
+	AppBaseURL string `yaml:"app_base_url" env:"APP_BASE_URL"`
+	// TrustedProxies are the CIDRs whose forwarding headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// TrustedProxyHeader is the one header the proxies overwrite:
+	// X-Forwarded-For, Forwarded or X-Real-IP
+	TrustedProxyHeader string `yaml:"trusted_proxy_header" env:"TRUSTED_PROXY_HEADER"`
+	ProxyProtocol      bool   `yaml:"proxy_protocol" env:"PROXY_PROTOCOL"`
+	IPListsPath        string `yaml:"ip_lists_path" env:"IP_LISTS_PATH"`
+}
+
+type CassandraConfig struct {
+	Hosts          []string      `yaml:"hosts" env:"CASS_HOSTS"`
+	Username       string        `yaml:"username" env:"CASS_USERNAME"`
+	Password       string        `yaml:"password" env:"CASS_PASSWORD"`
+	Keyspace       string        `yaml:"keyspace" env:"CASS_KEYSPACE"`
+	Timeout        time.Duration `yaml:"timeout" env:"CASS_TIMEOUT"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout" env:"CASS_CONNECT_TIMEOUT"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr" env:"REDIS_ADDR"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD"`
+	DB       int    `yaml:"db" env:"REDIS_DB"`
+}
+
+type AuthConfig struct {
+	// JWTSecret signs HS256 tokens when JWTKeyDir is unset
+	JWTSecret           string        `yaml:"jwt_secret" env:"JWT_SECRET"`
+	JWTKeyDir           string        `yaml:"jwt_key_dir" env:"JWT_KEY_DIR"`
+	JWTActiveKID        string        `yaml:"jwt_active_kid" env:"JWT_ACTIVE_KID"`
+	AccessTokenDuration time.Duration `yaml:"access_token_duration" env:"ACCESS_TOKEN_DURATION"`
+	// UnverifiedPolicy is allow, block_ads or block_login
+	UnverifiedPolicy string `yaml:"unverified_policy" env:"UNVERIFIED_POLICY"`
+	OIDCIssuer       string `yaml:"oidc_issuer" env:"OIDC_ISSUER"`
+	OIDCClientsPath  string `yaml:"oidc_clients_path" env:"OIDC_CLIENTS_PATH"`
+	// WebAuthnRPID and WebAuthnOrigins default to the host and origin of AppBaseURL
+	WebAuthnRPID    string   `yaml:"webauthn_rp_id" env:"WEBAUTHN_RP_ID"`
+	WebAuthnOrigins []string `yaml:"webauthn_origins" env:"WEBAUTHN_ORIGINS"`
+}
+
+type PasswordConfig struct {
+	// HashAlgorithm is argon2id or bcrypt
+	HashAlgorithm     string `yaml:"hash_algorithm" env:"PASSWORD_HASH_ALGORITHM"`
+	Argon2MemoryKiB   int    `yaml:"argon2_memory_kib" env:"ARGON2_MEMORY_KIB"`
+	Argon2Iterations  int    `yaml:"argon2_iterations" env:"ARGON2_ITERATIONS"`
+	Argon2Parallelism int    `yaml:"argon2_parallelism" env:"ARGON2_PARALLELISM"`
+	BcryptCost        int    `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+	// MinScore is the weakest strength score accepted, 0 to 4
+	MinScore         int    `yaml:"min_score" env:"MIN_PASSWORD_SCORE"`
+	BreachCorpusPath string `yaml:"breach_corpus_path" env:"BREACH_CORPUS_PATH"`
+	// HashConcurrency is the most passwords hashed at once, 0 for one per CPU
+	HashConcurrency int `yaml:"hash_concurrency" env:"HASH_CONCURRENCY"`
+	// HashQueueSize is how many may wait, 0 for four per allowed hash
+	HashQueueSize     int           `yaml:"hash_queue_size" env:"HASH_QUEUE_SIZE"`
+	HashMaxWait       time.Duration `yaml:"hash_max_wait" env:"HASH_MAX_WAIT"`
+	HashLatencyTarget time.Duration `yaml:"hash_latency_target" env:"HASH_LATENCY_TARGET"`
+}
+
+type RateLimitConfig struct {
+	PoliciesPath string `yaml:"policies_path" env:"RATE_LIMIT_POLICIES_PATH"`
+	// Backend is memory or redis
+	Backend string `yaml:"backend" env:"RATE_LIMIT_BACKEND"`
+	MaxKeys int    `yaml:"max_keys" env:"RATE_LIMIT_MAX_KEYS"`
+	// DefaultLimit per DefaultWindow and IP applies when PoliciesPath does not exist
+	DefaultLimit  int           `yaml:"default_limit" env:"RATE_LIMIT_DEFAULT_LIMIT"`
+	DefaultWindow time.Duration `yaml:"default_window" env:"RATE_LIMIT_DEFAULT_WINDOW"`
+	// BanThreshold is the number of rejections before a ban, 0 to disable bans
+	BanThreshold int `yaml:"ban_threshold" env:"BAN_THRESHOLD"`
+}
+
+// MailConfig keeps mail in memory when SMTPHost is empty
+type MailConfig struct {
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort     string `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD"`
+	From         string `yaml:"from" env:"SMTP_FROM"`
+}
+
+// Default returns the settings used for development with docker-compose
+func Default() *Config {
+	return &Config{
+		Environment: Development,
+		Server: ServerConfig{
+			Addr:        ":8443",
+			MetricsAddr: "0.0.0.0:8080",
+			TLSCertDir:  "../certs",
+			CORSOrigin:  "http://localhost:5173",
+			AppBaseURL:  "http://localhost:5173",
+			IPListsPath: "ip-lists.json",
+
+			TrustedProxyHeader: "X-Forwarded-For",
+		},
+		Cassandra: CassandraConfig{
+			Hosts:          []string{"localhost"},
+			Username:       "backend",
+			Password:       "BPass0319",
+			Keyspace:       "cass_keyspace",
+			Timeout:        5 * time.Second,
+			ConnectTimeout: 10 * time.Second,
+		},
+		Redis: RedisConfig{
+			Addr:     "localhost:6379",
+			Password: "RPass0319",
+		},
+		Auth: AuthConfig{
+			JWTSecret:           "some_secret",
+			AccessTokenDuration: 15 * time.Minute,
+			UnverifiedPolicy:    "allow",
+			OIDCIssuer:          "https://localhost:8443",
+			OIDCClientsPath:     "oauth-clients.json",
+		},
+		Passwords: PasswordConfig{
+			HashAlgorithm:     "argon2id",
+			Argon2MemoryKiB:   64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 2,
+			BcryptCost:        12,
+			MinScore:          2,
+			BreachCorpusPath:  "data/breached-passwords.txt",
+			HashMaxWait:       2 * time.Second,
+			HashLatencyTarget: 250 * time.Millisecond,
+		},
+		RateLimit: RateLimitConfig{
+			PoliciesPath:  "rate-limits.json",
+			Backend:       "memory",
+			MaxKeys:       100000,
+			DefaultLimit:  100,
+			DefaultWindow: time.Minute,
+			BanThreshold:  50,
+		},
+		Mail: MailConfig{
+			SMTPPort: "587",
+			From:     "no-reply@bcr.local",
+		},
+	}
+}
+
+// insecureSecrets are the development defaults, published in this
+// repository, that must never protect a production deployment
+var insecureSecrets = map[string]bool{
+	"some_secret": true,
+	"BPass0319":   true,
+	"RPass0319":   true,
+	"GFPass0319":  true,
+}
+
+// minProductionSecretLength is the shortest JWT secret accepted in production
+const minProductionSecretLength = 32
+
+// Load reads the YAML file at path over the defaults, applies environment
+// overrides and validates the result. An empty path skips the file.
+// Unknown keys in the file are errors, so that typos do not go unnoticed.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.decode(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) decode(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file leaves the defaults
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets every field with an env tag whose variable is set and
+// not empty, walking nested sections
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		raw := os.Getenv(name)
+		if name == "" || raw == "" {
+			continue
+		}
+		if err := setField(value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(value reflect.Value, raw string) error {
+	if value.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once, joined into one error
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Environment == Development || c.Environment == Production,
+		"environment must be %s or %s, got %q", Development, Production, c.Environment)
+
+	check(c.Server.Addr != "", "server.addr must be set")
+	check(c.Server.MetricsAddr != "", "server.metrics_addr must be set")
+	check(validURL(c.Server.CORSOrigin), "server.cors_origin must be an absolute URL, got %q", c.Server.CORSOrigin)
+	check(validURL(c.Server.AppBaseURL), "server.app_base_url must be an absolute URL, got %q", c.Server.AppBaseURL)
+	switch strings.ToLower(c.Server.TrustedProxyHeader) {
+	case "x-forwarded-for", "forwarded", "x-real-ip":
+	default:
+		check(false, "server.trusted_proxy_header must be X-Forwarded-For, Forwarded or X-Real-IP, got %q", c.Server.TrustedProxyHeader)
+	}
+
+	check(len(c.Cassandra.Hosts) > 0, "cassandra.hosts must not be empty")
+	check(c.Cassandra.Keyspace != "", "cassandra.keyspace must be set")
+	check(c.Cassandra.Timeout > 0 && c.Cassandra.ConnectTimeout > 0, "cassandra timeouts must be positive")
+
+	check(c.Redis.Addr != "", "redis.addr must be set")
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+
+	check(c.Auth.JWTSecret != "" || c.Auth.JWTKeyDir != "", "auth.jwt_secret or auth.jwt_key_dir must be set")
+	check(c.Auth.AccessTokenDuration >= time.Minute && c.Auth.AccessTokenDuration <= 24*time.Hour,
+		"auth.access_token_duration must be between 1m and 24h, got %s", c.Auth.AccessTokenDuration)
+	switch c.Auth.UnverifiedPolicy {
+	case "allow", "block_ads", "block_login":
+	default:
+		check(false, "auth.unverified_policy must be allow, block_ads or block_login, got %q", c.Auth.UnverifiedPolicy)
+	}
+	check(validURL(c.Auth.OIDCIssuer), "auth.oidc_issuer must be an absolute URL, got %q", c.Auth.OIDCIssuer)
+
+	p := c.Passwords
+	check(p.HashAlgorithm == "argon2id" || p.HashAlgorithm == "bcrypt",
+		"passwords.hash_algorithm must be argon2id or bcrypt, got %q", p.HashAlgorithm)
+	check(p.Argon2MemoryKiB > 0 && p.Argon2Iterations > 0 && p.Argon2Parallelism > 0 && p.Argon2Parallelism <= 255,
+		"passwords argon2 parameters out of range")
+	check(p.MinScore >= 0 && p.MinScore <= 4, "passwords.min_score must be 0-4, got %d", p.MinScore)
+	check(p.HashConcurrency >= 0 && p.HashQueueSize >= 0, "passwords hash concurrency and queue size must not be negative")
+	check(p.HashMaxWait >= 0 && p.HashLatencyTarget > 0, "passwords hash wait must not be negative and latency target must be positive")
+
+	r := c.RateLimit
+	check(r.Backend == "memory" || r.Backend == "redis", "rate_limit.backend must be memory or redis, got %q", r.Backend)
+	check(r.MaxKeys > 0, "rate_limit.max_keys must be positive")
+	check(r.DefaultLimit > 0 && r.DefaultWindow > 0, "rate_limit default limit and window must be positive")
+	check(r.BanThreshold >= 0, "rate_limit.ban_threshold must not be negative")
+
+	if c.Environment == Production {
+		errs = append(errs, c.checkProductionSecrets()...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkProductionSecrets rejects the published development secrets and
+// HS256 secrets too short to resist guessing
+func (c *Config) checkProductionSecrets() []error {
+	var errs []error
+	secrets := []struct{ name, value string }{
+		{"cassandra.password", c.Cassandra.Password},
+		{"redis.password", c.Redis.Password},
+		{"mail.smtp_password", c.Mail.SMTPPassword},
+	}
+	if c.Auth.JWTKeyDir == "" {
+		secrets = append(secrets, struct{ name, value string }{"auth.jwt_secret", c.Auth.JWTSecret})
+		if len(c.Auth.JWTSecret) < minProductionSecretLength {
+			errs = append(errs, fmt.Errorf("auth.jwt_secret must be at least %d characters in production", minProductionSecretLength))
+		}
+	}
+
+	for _, secret := range secrets {
+		if insecureSecrets[secret.value] {
+			errs = append(errs, fmt.Errorf("%s is a development default and cannot be used in production", secret.name))
+		}
+	}
+	return errs
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("not found: api key not found")
+	ErrAPIKeyInvalid  = errors.New("unauthorized: invalid api key")
+)
+
+// Scopes that can be granted to API keys
+const (
+	ScopeAdsRead      = "ads:read"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+)
+
+// ScopeAccount covers account management such as 2FA, logout, deletion and
+// API keys themselves. Only login sessions have it; it cannot be granted.
+const ScopeAccount = "account"
+
+var apiKeyScopes = map[string]bool{
+	ScopeAdsRead:      true,
+	ScopeProfileRead:  true,
+	ScopeProfileWrite: true,
+}
+
+// ValidAPIKeyScope reports whether scope can be granted to an API key
+func ValidAPIKeyScope(scope string) bool {
+	return apiKeyScopes[scope]
+}
+
+// API keys look like bcr_<prefix>_<secret>. The prefix is stored in clear
+// to find the key; only a hash of the secret is stored.
+const (
+	apiKeyMarker       = "bcr_"
+	apiKeyPrefixLength = 12
+)
+
+// APIKey is a long-lived credential of a user or service account
+type APIKey struct {
+	Prefix     string
+	Username   string
+	Name       string
+	SecretHash string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsed   time.Time
+}
+
+// NewAPIKey creates a key for username and returns it with the full key
+// string, which is shown to the user once and never stored
+func NewAPIKey(username, name string, scopes []string, ttl time.Duration) (*APIKey, string, error) {
+	for _, scope := range scopes {
+		if !ValidAPIKeyScope(scope) {
+			return nil, "", errors.New("validation: unknown scope " + scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("validation: at least one scope required")
+	}
+
+	prefixBytes := make([]byte, apiKeyPrefixLength/2)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return nil, "", err
+	}
+	secret, err := GenerateToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	key := &APIKey{
+		Prefix:     hex.EncodeToString(prefixBytes),
+		Username:   username,
+		Name:       name,
+		SecretHash: HashToken(secret),
+		Scopes:     scopes,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	return key, apiKeyMarker + key.Prefix + "_" + secret, nil
+}
+
+// ParseAPIKey splits a key string into its prefix and secret
+func ParseAPIKey(key string) (prefix, secret string, err error) {
+	rest, ok := strings.CutPrefix(key, apiKeyMarker)
+	if !ok || len(rest) < apiKeyPrefixLength+2 || rest[apiKeyPrefixLength] != '_' {
+		return "", "", ErrAPIKeyInvalid
+	}
+	return rest[:apiKeyPrefixLength], rest[apiKeyPrefixLength+1:], nil
+}
+
+// Verify checks the secret and the expiry of the key
+func (k *APIKey) Verify(secret string, now time.Time) bool {
+	if !now.Before(k.ExpiresAt) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(secret)), []byte(k.SecretHash)) == 1
+}
+
+// APIKeyRepository stores API keys
+type APIKeyRepository interface {
+	AddAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKey(ctx context.Context, prefix string) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, username string) ([]*APIKey, error)
+	TouchAPIKey(ctx context.Context, prefix string, lastUsed time.Time) error
+	DeleteAPIKey(ctx context.Context, key *APIKey) error
+	DeleteUserAPIKeys(ctx context.Context, username string) error
+}
+
+var _ APIKeyRepository = (*CassandraRepo)(nil)
+
+// AddAPIKey stores a new key and indexes it by username
+func (c *CassandraRepo) AddAPIKey(ctx context.Context, key *APIKey) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(
+		"INSERT INTO api_keys (prefix, username, name, secret_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		key.Prefix, key.Username, key.Name, key.SecretHash, key.Scopes, key.CreatedAt, key.ExpiresAt)
+	batch.Query(
+		"INSERT INTO api_keys_by_user (username, prefix) VALUES (?, ?)",
+		key.Username, key.Prefix)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// GetAPIKey retrieves a key by its prefix
+func (c *CassandraRepo) GetAPIKey(ctx context.Context, prefix string) (*APIKey, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{}
+	err := c.session.Query(
+		"SELECT prefix, username, name, secret_hash, scopes, created_at, expires_at, last_used FROM api_keys WHERE prefix = ? LIMIT 1",
+		prefix).WithContext(ctx).Scan(
+		&key.Prefix, &key.Username, &key.Name, &key.SecretHash, &key.Scopes,
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsed)
+
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, ErrDatabaseError
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns every key of a user
+func (c *CassandraRepo) ListAPIKeys(ctx context.Context, username string) ([]*APIKey, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	iter := c.session.Query(
+		"SELECT prefix FROM api_keys_by_user WHERE username = ?", username).
+		WithContext(ctx).Iter()
+
+	var prefixes []string
+	var prefix string
+	for iter.Scan(&prefix) {
+		prefixes = append(prefixes, prefix)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, ErrDatabaseError
+	}
+
+	keys := make([]*APIKey, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		key, err := c.GetAPIKey(ctx, prefix)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// TouchAPIKey records when the key was last used. IF EXISTS keeps an
+// update racing DeleteAPIKey from writing a row for a revoked key.
+func (c *CassandraRepo) TouchAPIKey(ctx context.Context, prefix string, lastUsed time.Time) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	applied, err := c.session.Query(
+		"UPDATE api_keys SET last_used = ? WHERE prefix = ? IF EXISTS", lastUsed, prefix).
+		WithContext(ctx).ScanCAS()
+	if err != nil {
+		return ErrUpdateFailed
+	}
+	if !applied {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// DeleteAPIKey revokes a key
+func (c *CassandraRepo) DeleteAPIKey(ctx context.Context, key *APIKey) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM api_keys WHERE prefix = ?", key.Prefix)
+	batch.Query("DELETE FROM api_keys_by_user WHERE username = ? AND prefix = ?", key.Username, key.Prefix)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
+
+// DeleteUserAPIKeys revokes every key of a user
+func (c *CassandraRepo) DeleteUserAPIKeys(ctx context.Context, username string) error {
+	keys, err := c.ListAPIKeys(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := c.DeleteAPIKey(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	if err := c.session.Query(
+		"DELETE FROM api_keys_by_user WHERE username = ?", username).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
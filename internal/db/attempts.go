@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const loginAttemptsPrefix = "auth:attempts:"
+
+// LoginAttempts is the failed-login state of one account
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// LockoutPolicy decides how failed logins of one account are throttled.
+// After BackoffAfter failures every further attempt has to wait an
+// exponentially growing delay; after LockAfter failures the account is
+// locked for LockDuration.
+type LockoutPolicy struct {
+	BackoffAfter int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockAfter    int
+	LockDuration time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// NewLockoutPolicy returns the default policy
+func NewLockoutPolicy() *LockoutPolicy {
+	return &LockoutPolicy{
+		BackoffAfter: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockAfter:    10,
+		LockDuration: 15 * time.Minute,
+		Window:       time.Hour,
+	}
+}
+
+// LoginReservation is the outcome of reserving a login attempt
+type LoginReservation struct {
+	// Allowed is false while the account is locked or backing off
+	Allowed bool
+	// Locked is the current lock when the attempt is not allowed, and
+	// otherwise whether the attempt locks the account if it fails
+	Locked bool
+	// RetryAfter is how long to wait when the attempt is not allowed
+	RetryAfter time.Duration
+	// Failures counts the reserved attempt as a failure
+	Failures int
+
+	// reservedAt and lastFailure let Release restore the previous state
+	reservedAt  int64
+	lastFailure int64
+}
+
+// LoginAttemptStore counts failed logins per username, shared by every
+// server instance so that a distributed attacker hits the same counter
+type LoginAttemptStore interface {
+	Get(ctx context.Context, username string) (*LoginAttempts, error)
+	// Reserve checks the policy and counts the attempt as a failure in one
+	// step, so that concurrent guesses cannot slip past the lockout
+	Reserve(ctx context.Context, username string) (*LoginReservation, error)
+	// Release takes back a reservation that turned out not to be a wrong
+	// password or code
+	Release(ctx context.Context, username string, reservation *LoginReservation) error
+	// Reset clears the counter and any lock, after a successful login or an admin unlock
+	Reset(ctx context.Context, username string) error
+}
+
+// reserveScript checks the lock and the backoff delay of KEYS[1] and, if
+// the attempt is allowed, counts it as a failure. ARGV holds the policy:
+// backoff after, base delay, max delay, lock after, lock duration and
+// window, durations in milliseconds. Returns whether the attempt is
+// allowed, whether the account is or gets locked, the milliseconds to wait,
+// the failures, the time of the attempt and the previous last failure.
+var reserveScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local backoffAfter = tonumber(ARGV[1])
+local baseDelay = tonumber(ARGV[2])
+local maxDelay = tonumber(ARGV[3])
+local lockAfter = tonumber(ARGV[4])
+local lockDuration = tonumber(ARGV[5])
+local window = tonumber(ARGV[6])
+
+local state = redis.call('HMGET', KEYS[1], 'failures', 'last_failure', 'locked_until')
+local failures = tonumber(state[1]) or 0
+local lastFailure = tonumber(state[2]) or 0
+local lockedUntil = tonumber(state[3]) or 0
+
+if now < lockedUntil then
+	return {0, 1, lockedUntil - now, failures, now, lastFailure}
+end
+
+if failures >= backoffAfter then
+	local delay = baseDelay
+	for i = backoffAfter + 1, failures do
+		if delay >= maxDelay then
+			break
+		end
+		delay = delay * 2
+	end
+	if delay > maxDelay then
+		delay = maxDelay
+	end
+	if now < lastFailure + delay then
+		return {0, 0, lastFailure + delay - now, failures, now, lastFailure}
+	end
+end
+
+failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+redis.call('HSET', KEYS[1], 'last_failure', now)
+local locks = 0
+local ttl = window
+if lockAfter > 0 and failures % lockAfter == 0 then
+	redis.call('HSET', KEYS[1], 'locked_until', now + lockDuration)
+	locks = 1
+	if lockDuration > ttl then
+		ttl = lockDuration
+	end
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {1, locks, 0, failures, now, lastFailure}
+`)
+
+// releaseScript takes one failure back from KEYS[1]. ARGV[1] is the time
+// of the reserved attempt, ARGV[2] the last failure before it and ARGV[3]
+// whether the attempt locked the account.
+var releaseScript = redis.NewScript(`
+local failures = tonumber(redis.call('HGET', KEYS[1], 'failures'))
+if not failures or failures <= 0 then
+	return 0
+end
+
+redis.call('HINCRBY', KEYS[1], 'failures', -1)
+if redis.call('HGET', KEYS[1], 'last_failure') == ARGV[1] then
+	if ARGV[2] == '0' then
+		redis.call('HDEL', KEYS[1], 'last_failure')
+	else
+		redis.call('HSET', KEYS[1], 'last_failure', ARGV[2])
+	end
+end
+if ARGV[3] == '1' then
+	redis.call('HDEL', KEYS[1], 'locked_until')
+end
+return 1
+`)
+
+// RedisLoginAttemptStore implements LoginAttemptStore using Redis
+type RedisLoginAttemptStore struct {
+	client *redis.Client
+	policy *LockoutPolicy
+}
+
+var _ LoginAttemptStore = (*RedisLoginAttemptStore)(nil)
+
+// NewRedisLoginAttemptStore creates a store that throttles logins by policy
+func NewRedisLoginAttemptStore(client *redis.Client, policy *LockoutPolicy) *RedisLoginAttemptStore {
+	return &RedisLoginAttemptStore{client: client, policy: policy}
+}
+
+// Get returns the current state; unknown users have no failures
+func (r *RedisLoginAttemptStore) Get(ctx context.Context, username string) (*LoginAttempts, error) {
+	fields, err := r.client.HGetAll(ctx, loginAttemptsPrefix+username).Result()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	attempts := &LoginAttempts{}
+	if v, ok := fields["failures"]; ok {
+		attempts.Failures, _ = strconv.Atoi(v)
+	}
+	if v, ok := fields["last_failure"]; ok {
+		ms, _ := strconv.ParseInt(v, 10, 64)
+		attempts.LastFailure = time.UnixMilli(ms)
+	}
+	if v, ok := fields["locked_until"]; ok {
+		ms, _ := strconv.ParseInt(v, 10, 64)
+		attempts.LockedUntil = time.UnixMilli(ms)
+	}
+
+	return attempts, nil
+}
+
+// Reserve admits a login attempt and counts it as a failure until it is
+// released or the counter is reset
+func (r *RedisLoginAttemptStore) Reserve(ctx context.Context, username string) (*LoginReservation, error) {
+	p := r.policy
+	result, err := reserveScript.Run(ctx, r.client, []string{loginAttemptsPrefix + username},
+		p.BackoffAfter, p.BaseDelay.Milliseconds(), p.MaxDelay.Milliseconds(),
+		p.LockAfter, p.LockDuration.Milliseconds(), p.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	return &LoginReservation{
+		Allowed:     result[0] == 1,
+		Locked:      result[1] == 1,
+		RetryAfter:  time.Duration(result[2]) * time.Millisecond,
+		Failures:    int(result[3]),
+		reservedAt:  result[4],
+		lastFailure: result[5],
+	}, nil
+}
+
+// Release undoes an allowed reservation, including a lock it started
+func (r *RedisLoginAttemptStore) Release(ctx context.Context, username string, reservation *LoginReservation) error {
+	if !reservation.Allowed {
+		return nil
+	}
+
+	locked := 0
+	if reservation.Locked {
+		locked = 1
+	}
+	err := releaseScript.Run(ctx, r.client, []string{loginAttemptsPrefix + username},
+		reservation.reservedAt, reservation.lastFailure, locked).Err()
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+// Reset forgets every failure of username
+func (r *RedisLoginAttemptStore) Reset(ctx context.Context, username string) error {
+	if err := r.client.Del(ctx, loginAttemptsPrefix+username).Err(); err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
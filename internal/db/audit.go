@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Audited actions
+const (
+	AuditImpersonate = "impersonate"
+)
+
+// AuditEvent records something staff did to a user's account
+type AuditEvent struct {
+	// Username is the account acted on
+	Username string    `json:"username"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Detail   string    `json:"detail,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+}
+
+// AuditRepository is an append-only log of staff actions per account
+type AuditRepository interface {
+	AddAuditEvent(ctx context.Context, event *AuditEvent) error
+	// ListAuditEvents returns the latest events of username, newest first
+	ListAuditEvents(ctx context.Context, username string, limit int) ([]*AuditEvent, error)
+}
+
+var _ AuditRepository = (*CassandraRepo)(nil)
+
+// AddAuditEvent appends an event to the log of its account
+func (c *CassandraRepo) AddAuditEvent(ctx context.Context, event *AuditEvent) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	if err := c.session.Query(
+		"INSERT INTO audit_events (username, id, actor, action, detail, ip) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Username, gocql.UUIDFromTime(event.Time), event.Actor, event.Action, event.Detail, event.IP).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// ListAuditEvents returns the latest events of username, newest first
+func (c *CassandraRepo) ListAuditEvents(ctx context.Context, username string, limit int) ([]*AuditEvent, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	iter := c.session.Query(
+		"SELECT id, actor, action, detail, ip FROM audit_events WHERE username = ? LIMIT ?", username, limit).
+		WithContext(ctx).Iter()
+
+	var events []*AuditEvent
+	var id gocql.UUID
+	var actor, action, detail, ip string
+	for iter.Scan(&id, &actor, &action, &detail, &ip) {
+		events = append(events, &AuditEvent{
+			Username: username,
+			Time:     id.Time(),
+			Actor:    actor,
+			Action:   action,
+			Detail:   detail,
+			IP:       ip,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, ErrDatabaseError
+	}
+
+	return events, nil
+}
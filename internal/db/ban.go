@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	banPrefix        = "auth:bans:"
+	banStrikesPrefix = "auth:banstrikes:"
+	banLevelPrefix   = "auth:banlevel:"
+)
+
+var ErrBanNotFound = errors.New("not found: ban not found")
+
+// Ban blocks every request from one client address until it expires
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// Level counts the bans of this address within the escalation memory,
+	// starting at 1; each level lasts longer than the one before
+	Level int `json:"level"`
+}
+
+// BanStore keeps rate limit violations and bans per client address,
+// shared by every server instance
+type BanStore interface {
+	// RecordViolation counts a rejected request of ip and returns the
+	// number of rejections in the current period
+	RecordViolation(ctx context.Context, ip string, period time.Duration) (int, error)
+	// NextLevel counts a new ban of ip and returns its level. Levels are
+	// forgotten memory after the last ban.
+	NextLevel(ctx context.Context, ip string, memory time.Duration) (int, error)
+	// Ban stores the ban until it expires and clears the violations that led to it
+	Ban(ctx context.Context, ban *Ban) error
+	// Get returns the active ban of ip, or ErrBanNotFound
+	Get(ctx context.Context, ip string) (*Ban, error)
+	// List returns every active ban, the longest-lasting first
+	List(ctx context.Context) ([]*Ban, error)
+	// Lift ends the ban of ip and forgets its violations and levels
+	Lift(ctx context.Context, ip string) error
+}
+
+// RedisBanStore implements BanStore using Redis
+type RedisBanStore struct {
+	client *redis.Client
+}
+
+var _ BanStore = (*RedisBanStore)(nil)
+
+func NewRedisBanStore(client *redis.Client) *RedisBanStore {
+	return &RedisBanStore{client: client}
+}
+
+// recordViolationScript counts a violation in KEYS[1] and starts the
+// period of ARGV[1] milliseconds with the first one. A counter without a
+// TTL, left by a failed call, gets one too.
+var recordViolationScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 or redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (r *RedisBanStore) RecordViolation(ctx context.Context, ip string, period time.Duration) (int, error) {
+	count, err := recordViolationScript.Run(ctx, r.client, []string{banStrikesPrefix + ip}, period.Milliseconds()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("internal: %w", err)
+	}
+	return count, nil
+}
+
+func (r *RedisBanStore) NextLevel(ctx context.Context, ip string, memory time.Duration) (int, error) {
+	key := banLevelPrefix + ip
+
+	var level *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		level = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, memory)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("internal: %w", err)
+	}
+	return int(level.Val()), nil
+}
+
+func (r *RedisBanStore) Ban(ctx context.Context, ban *Ban) error {
+	ttl := time.Until(ban.Until)
+	if ttl <= 0 {
+		return nil
+	}
+
+	key := banPrefix + ban.IP
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"reason", ban.Reason,
+			"since", ban.Since.UnixMilli(),
+			"until", ban.Until.UnixMilli(),
+			"level", ban.Level)
+		pipe.PExpire(ctx, key, ttl)
+		pipe.Del(ctx, banStrikesPrefix+ban.IP)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisBanStore) Get(ctx context.Context, ip string) (*Ban, error) {
+	fields, err := r.client.HGetAll(ctx, banPrefix+ip).Result()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrBanNotFound
+	}
+
+	return banFromFields(ip, fields), nil
+}
+
+func (r *RedisBanStore) List(ctx context.Context) ([]*Ban, error) {
+	var bans []*Ban
+	iter := r.client.Scan(ctx, 0, banPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		ip := strings.TrimPrefix(iter.Val(), banPrefix)
+		ban, err := r.Get(ctx, ip)
+		// The ban may have expired since the scan
+		if errors.Is(err, ErrBanNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.After(bans[j].Until)
+	})
+	return bans, nil
+}
+
+func (r *RedisBanStore) Lift(ctx context.Context, ip string) error {
+	deleted, err := r.client.Del(ctx, banPrefix+ip, banStrikesPrefix+ip, banLevelPrefix+ip).Result()
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	if deleted == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+func banFromFields(ip string, fields map[string]string) *Ban {
+	ban := &Ban{IP: ip, Reason: fields["reason"]}
+	if ms, err := strconv.ParseInt(fields["since"], 10, 64); err == nil {
+		ban.Since = time.UnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(fields["until"], 10, 64); err == nil {
+		ban.Until = time.UnixMilli(ms)
+	}
+	ban.Level, _ = strconv.Atoi(fields["level"])
+	return ban
+}
@@ -53,6 +53,9 @@ type UserRepository interface {
 	UpdateUser(ctx context.Context, user *User) error
 	DeleteUser(ctx context.Context, username string) error
 	UsernameExists(ctx context.Context, username string) (bool, error)
+	// ListUsers returns one page of users and the state to fetch the next
+	// page with; the state is nil after the last page
+	ListUsers(ctx context.Context, pageSize int, pageState []byte) ([]*User, []byte, error)
 	Stats(ctx context.Context) (map[string]interface{}, error)
 	Close()
 }
@@ -66,7 +69,7 @@ type CassandraRepo struct {
 var _ UserRepository = (*CassandraRepo)(nil)
 
 // NewCassandraRepo creates a new Cassandra UserRepository
-func NewCassandraRepo(config *CassandraConfig) (UserRepository, error) {
+func NewCassandraRepo(config *CassandraConfig) (*CassandraRepo, error) {
 	cluster := gocql.NewCluster(config.Hosts...)
 	cluster.Keyspace = config.Keyspace
 	cluster.Consistency = gocql.Quorum
@@ -88,6 +91,48 @@ func NewCassandraRepo(config *CassandraConfig) (UserRepository, error) {
 	}, nil
 }
 
+// userColumns were added to the users table after its first release, with
+// their CQL types
+var userColumns = []struct{ name, cqlType string }{
+	{"verified", "boolean"},
+	{"role", "text"},
+	{"disabled", "boolean"},
+}
+
+// Migrate adds columns missing from tables created by an older schema.cql.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so without it
+// every query naming the new columns would fail.
+func (c *CassandraRepo) Migrate(ctx context.Context) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	iter := c.session.Query(
+		"SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = 'users'",
+		c.config.Keyspace).WithContext(ctx).Iter()
+	existing := make(map[string]bool)
+	var column string
+	for iter.Scan(&column) {
+		existing[column] = true
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	for _, col := range userColumns {
+		if existing[col.name] {
+			continue
+		}
+		if err := c.session.Query(
+			fmt.Sprintf("ALTER TABLE users ADD %s %s", col.name, col.cqlType)).
+			WithContext(ctx).Exec(); err != nil {
+			return fmt.Errorf("migrate: add users.%s: %w", col.name, err)
+		}
+	}
+
+	return nil
+}
+
 // ensureSession checks if the session is initialized
 func (c *CassandraRepo) ensureSession() error {
 	if c.session == nil {
@@ -118,11 +163,12 @@ func (c *CassandraRepo) GetUser(ctx context.Context, username string) (*User, er
 	}
 
 	user := &User{Credentials: &Credentials{}}
+	var verified *bool
 
 	err := c.session.Query(
-		"SELECT username, password, email, category FROM users WHERE username = ? LIMIT 1",
+		"SELECT username, password, email, category, verified, role, disabled FROM users WHERE username = ? LIMIT 1",
 		username).WithContext(ctx).Scan(
-		&user.Username, &user.Password, &user.Email, &user.Category)
+		&user.Username, &user.Password, &user.Email, &user.Category, &verified, &user.Role, &user.Disabled)
 
 	if err != nil {
 		if err == gocql.ErrNotFound {
@@ -131,9 +177,20 @@ func (c *CassandraRepo) GetUser(ctx context.Context, username string) (*User, er
 		return nil, ErrDatabaseError
 	}
 
+	fillLegacyUser(user, verified)
 	return user, nil
 }
 
+// fillLegacyUser gives rows written before email verification and roles
+// existed their defaults. Such accounts were never asked to verify, so they
+// count as verified; every later row stores the flag explicitly.
+func fillLegacyUser(user *User, verified *bool) {
+	user.Verified = verified == nil || *verified
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+}
+
 // AddUser adds a new user to the database
 func (c *CassandraRepo) AddUser(ctx context.Context, user *User) error {
 	if err := c.ensureSession(); err != nil {
@@ -141,8 +198,8 @@ func (c *CassandraRepo) AddUser(ctx context.Context, user *User) error {
 	}
 
 	if err := c.session.Query(
-		"INSERT INTO users (username, password, email, category) VALUES (?, ?, ?, ?)",
-		user.Username, user.Password, user.Email, user.Category).
+		"INSERT INTO users (username, password, email, category, verified, role, disabled) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		user.Username, user.Password, user.Email, user.Category, user.Verified, user.Role, user.Disabled).
 		WithContext(ctx).Exec(); err != nil {
 		return ErrUserCreationFailed
 	}
@@ -165,8 +222,8 @@ func (c *CassandraRepo) UpdateUser(ctx context.Context, user *User) error {
 	}
 
 	if err := c.session.Query(
-		"UPDATE users SET password = ?, email = ?, category = ? WHERE username = ?",
-		user.Password, user.Email, user.Category, user.Username).
+		"UPDATE users SET password = ?, email = ?, category = ?, verified = ?, role = ?, disabled = ? WHERE username = ?",
+		user.Password, user.Email, user.Category, user.Verified, user.Role, user.Disabled, user.Username).
 		WithContext(ctx).Exec(); err != nil {
 		return ErrUpdateFailed
 	}
@@ -225,6 +282,41 @@ func (c *CassandraRepo) UsernameExists(ctx context.Context, username string) (bo
 	return true, nil
 }
 
+// ListUsers pages through all users in token order
+func (c *CassandraRepo) ListUsers(ctx context.Context, pageSize int, pageState []byte) ([]*User, []byte, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, nil, err
+	}
+
+	iter := c.session.Query(
+		"SELECT username, password, email, category, verified, role, disabled FROM users").
+		WithContext(ctx).PageSize(pageSize).PageState(pageState).Iter()
+	// Setting a page state, even nil, turns off automatic paging
+	nextPage := iter.PageState()
+	scanner := iter.Scanner()
+
+	var users []*User
+	for scanner.Next() {
+		user := &User{Credentials: &Credentials{}}
+		var verified *bool
+		if err := scanner.Scan(&user.Username, &user.Password, &user.Email, &user.Category,
+			&verified, &user.Role, &user.Disabled); err != nil {
+			return nil, nil, ErrDatabaseError
+		}
+		fillLegacyUser(user, verified)
+		users = append(users, user)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, ErrDatabaseError
+	}
+	if len(nextPage) == 0 {
+		nextPage = nil
+	}
+
+	return users, nextPage, nil
+}
+
 // Stats retrieves statistics from the system.stats table
 func (c *CassandraRepo) Stats(ctx context.Context) (map[string]interface{}, error) {
 	if err := c.ensureSession(); err != nil {
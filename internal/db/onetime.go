@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrOneTimeTokenInvalid = errors.New("unauthorized: invalid or expired token")
+
+// OneTimeTokenStore issues short-lived tokens that can be redeemed once,
+// such as password reset links. Each token carries a subject, usually the
+// username. Only the token hash is stored.
+type OneTimeTokenStore interface {
+	Create(ctx context.Context, subject string) (string, error)
+	// Peek returns the subject of a valid token without redeeming it
+	Peek(ctx context.Context, token string) (string, error)
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// RedisOneTimeStore implements OneTimeTokenStore using Redis
+type RedisOneTimeStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+var _ OneTimeTokenStore = (*RedisOneTimeStore)(nil)
+
+// NewRedisOneTimeStore creates a store whose keys are namespaced by prefix
+func NewRedisOneTimeStore(client *redis.Client, prefix string, ttl time.Duration) *RedisOneTimeStore {
+	return &RedisOneTimeStore{client: client, prefix: prefix, ttl: ttl}
+}
+
+// Create issues a new token for subject
+func (r *RedisOneTimeStore) Create(ctx context.Context, subject string) (string, error) {
+	token, err := GenerateToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.client.Set(ctx, r.prefix+HashToken(token), subject, r.ttl).Err(); err != nil {
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	return token, nil
+}
+
+// Peek returns the subject of token, which stays valid
+func (r *RedisOneTimeStore) Peek(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrOneTimeTokenInvalid
+	}
+
+	subject, err := r.client.Get(ctx, r.prefix+HashToken(token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrOneTimeTokenInvalid
+		}
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	return subject, nil
+}
+
+// Consume redeems the token and returns its subject; GETDEL makes sure
+// that concurrent requests cannot both succeed
+func (r *RedisOneTimeStore) Consume(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrOneTimeTokenInvalid
+	}
+
+	subject, err := r.client.GetDel(ctx, r.prefix+HashToken(token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrOneTimeTokenInvalid
+		}
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	return subject, nil
+}
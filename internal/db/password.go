@@ -0,0 +1,188 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hashing algorithms
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("internal: unknown password hash format")
+
+// Argon2Params are the argon2id cost parameters
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHasherConfig selects the algorithm used for new hashes.
+// Hashes made with any supported algorithm can still be verified.
+type PasswordHasherConfig struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// NewPasswordHasherConfig returns argon2id with the RFC 9106 second
+// recommended option (64 MiB, 3 passes)
+func NewPasswordHasherConfig() *PasswordHasherConfig {
+	return &PasswordHasherConfig{
+		Algorithm: AlgorithmArgon2id,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		BcryptCost: BcryptCost,
+	}
+}
+
+// PasswordHasher hashes passwords into self-describing encoded strings:
+// PHC format for argon2id and modular crypt format for bcrypt
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was made with another
+	// algorithm or weaker parameters than the current configuration
+	NeedsRehash(encoded string) bool
+}
+
+type passwordHasher struct {
+	config *PasswordHasherConfig
+}
+
+// NewPasswordHasher validates the configuration and returns a PasswordHasher
+func NewPasswordHasher(config *PasswordHasherConfig) (PasswordHasher, error) {
+	switch config.Algorithm {
+	case AlgorithmArgon2id:
+		p := config.Argon2
+		if p.Memory < 8*uint32(p.Parallelism) || p.Iterations < 1 || p.Parallelism < 1 ||
+			p.SaltLength < 8 || p.KeyLength < 16 {
+			return nil, errors.New("validation: invalid argon2id parameters")
+		}
+	case AlgorithmBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("validation: bcrypt cost must be %d-%d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("validation: unknown password hash algorithm %q", config.Algorithm)
+	}
+
+	return &passwordHasher{config: config}, nil
+}
+
+// DefaultPasswordHasher is used by HashPassword and CheckPasswordHash
+var DefaultPasswordHasher PasswordHasher = &passwordHasher{config: NewPasswordHasherConfig()}
+
+// Hash encodes the password with the configured algorithm
+func (h *passwordHasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == AlgorithmBcrypt {
+		bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+		return string(bytes), err
+	}
+
+	p := h.config.Argon2
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks the password against a hash of any supported algorithm
+func (h *passwordHasher) Verify(password, encoded string) (bool, error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether encoded should be replaced on next login
+func (h *passwordHasher) NeedsRehash(encoded string) bool {
+	if isBcryptHash(encoded) {
+		if h.config.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < h.config.BcryptCost
+	}
+
+	if h.config.Algorithm != AlgorithmArgon2id {
+		return true
+	}
+
+	p, _, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	want := h.config.Argon2
+	return p.Memory < want.Memory || p.Iterations < want.Iterations ||
+		p.Parallelism != want.Parallelism || uint32(len(key)) < want.KeyLength
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=...,t=...,p=...$salt$hash
+func decodeArgon2id(encoded string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	p := &Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
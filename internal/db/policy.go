@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PolicyViolation is one reason a password was rejected
+type PolicyViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every reason a password was rejected
+type PasswordPolicyError struct {
+	Score      int               `json:"score"`
+	Violations []PolicyViolation `json:"reasons"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	codes := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		codes[i] = v.Code
+	}
+	return "validation: password rejected: " + strings.Join(codes, ", ")
+}
+
+// BreachCorpus looks up leaked password hashes by k-anonymity range:
+// callers only reveal the first 5 hex characters of the SHA-1 and
+// compare the returned suffixes themselves, like the HIBP range API
+type BreachCorpus interface {
+	Range(prefix string) (map[string]int, error)
+}
+
+// FileBreachCorpus is a BreachCorpus loaded from a local file in the
+// HIBP downloader format: one uppercase SHA1:COUNT per line. Lines
+// starting with '#' are comments. The corpus is kept in memory, so it is
+// meant for curated subsets rather than the full HIBP dump.
+type FileBreachCorpus struct {
+	ranges map[string]map[string]int
+}
+
+var _ BreachCorpus = (*FileBreachCorpus)(nil)
+
+// LoadBreachCorpus reads a breach corpus file
+func LoadBreachCorpus(path string) (*FileBreachCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	corpus := &FileBreachCorpus{ranges: make(map[string]map[string]int)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, countStr, ok := strings.Cut(text, ":")
+		if !ok || len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: expected SHA1:COUNT", path, line)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid count: %w", path, line, err)
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:5], hash[5:]
+		if corpus.ranges[prefix] == nil {
+			corpus.ranges[prefix] = make(map[string]int)
+		}
+		corpus.ranges[prefix][suffix] = count
+	}
+
+	return corpus, scanner.Err()
+}
+
+// Range returns the hash suffixes and breach counts for a 5 character prefix
+func (c *FileBreachCorpus) Range(prefix string) (map[string]int, error) {
+	return c.ranges[strings.ToUpper(prefix)], nil
+}
+
+// BreachCount returns how often the password appeared in known breaches
+func BreachCount(corpus BreachCorpus, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := corpus.Range(hash[:5])
+	if err != nil {
+		return 0, err
+	}
+	return suffixes[hash[5:]], nil
+}
+
+// PasswordPolicy decides which passwords are acceptable beyond the
+// length checks of ValidCredentials
+type PasswordPolicy struct {
+	// MinScore is the lowest accepted PasswordScore
+	MinScore int
+	// Breached is optional; without it leaked passwords are not screened
+	Breached BreachCorpus
+}
+
+// Check returns a *PasswordPolicyError listing every violation, or nil
+func (p *PasswordPolicy) Check(password, username, email string) error {
+	var violations []PolicyViolation
+	lower := strings.ToLower(password)
+
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		violations = append(violations, PolicyViolation{
+			Code: "contains_username", Message: "password must not contain the username",
+		})
+	}
+
+	if local, _, _ := strings.Cut(strings.ToLower(email), "@"); len(local) >= MinUsernameLength &&
+		strings.Contains(lower, local) {
+		violations = append(violations, PolicyViolation{
+			Code: "contains_email", Message: "password must not contain the email address",
+		})
+	}
+
+	if p.Breached != nil {
+		count, err := BreachCount(p.Breached, password)
+		if err != nil {
+			return fmt.Errorf("internal: %w", err)
+		}
+		if count > 0 {
+			violations = append(violations, PolicyViolation{
+				Code: "breached", Message: "password appears in a known data breach",
+			})
+		}
+	}
+
+	score := PasswordScore(password, username, email)
+	if score < p.MinScore {
+		violations = append(violations, PolicyViolation{
+			Code:    "too_weak",
+			Message: fmt.Sprintf("password strength %d is below the required %d", score, p.MinScore),
+		})
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Score: score, Violations: violations}
+	}
+	return nil
+}
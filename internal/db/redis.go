@@ -67,6 +67,22 @@ func NewRedisConfig(password string) *RedisConfig {
 
 // NewRedisRepo creates a new Redis client with improved configuration
 func NewRedisRepo(config *RedisConfig) (UserCache, error) {
+	client, err := NewRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRedisRepoWithClient(client, config), nil
+}
+
+// NewRedisRepoWithClient creates a UserCache on top of an existing client,
+// so that the cache and the token stores can share one connection pool
+func NewRedisRepoWithClient(client *redis.Client, config *RedisConfig) UserCache {
+	return &RedisRepo{client: client, config: config}
+}
+
+// NewRedisClient connects to Redis and verifies the connection
+func NewRedisClient(config *RedisConfig) (*redis.Client, error) {
 	if config == nil {
 		return nil, errors.New("redis config cannot be nil")
 	}
@@ -90,7 +106,7 @@ func NewRedisRepo(config *RedisConfig) (UserCache, error) {
 		return nil, fmt.Errorf("connect to redis: %w", err)
 	}
 
-	return &RedisRepo{client: client, config: config}, nil
+	return client, nil
 }
 
 // createKey creates a secure, namespaced key from username
@@ -142,6 +158,9 @@ func (r *RedisRepo) Get(ctx context.Context, username string) (*User, error) {
 		_ = r.client.Del(ctx, key)
 		return nil, fmt.Errorf("internal: %w", err)
 	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
 
 	return &user, nil
 }
@@ -188,6 +207,9 @@ func (r *RedisRepo) Add(ctx context.Context, user *User) error {
 		},
 		Email:    user.Email,
 		Category: user.Category,
+		Verified: user.Verified,
+		Role:     user.Role,
+		Disabled: user.Disabled,
 	}
 
 	val, err := json.Marshal(rUser)
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("unauthorized: invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("unauthorized: refresh token reuse detected")
+)
+
+const (
+	refreshTokenPrefix  = "auth:refresh:token:"
+	refreshFamilyPrefix = "auth:refresh:family:"
+	refreshUserPrefix   = "auth:refresh:user:"
+	refreshTokenBytes   = 32
+)
+
+// RefreshTokenStore keeps track of issued refresh tokens.
+// Tokens belong to a family that is created at login; every rotation
+// issues a new token in the same family and marks the old one as used.
+// Presenting a used token again revokes the whole family, and Rotate
+// still reports the family with ErrRefreshTokenReused.
+type RefreshTokenStore interface {
+	Issue(ctx context.Context, username, family string) (string, error)
+	Rotate(ctx context.Context, token string) (username, family, newToken string, err error)
+	Revoke(ctx context.Context, token string) error
+	RevokeFamily(ctx context.Context, family string) error
+	RevokeUser(ctx context.Context, username string) error
+}
+
+// RedisRefreshStore implements RefreshTokenStore using Redis
+type RedisRefreshStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+var _ RefreshTokenStore = (*RedisRefreshStore)(nil)
+
+// NewRedisRefreshStore creates a refresh token store whose tokens live for ttl
+func NewRedisRefreshStore(client *redis.Client, ttl time.Duration) *RedisRefreshStore {
+	return &RedisRefreshStore{client: client, ttl: ttl}
+}
+
+// GenerateToken returns a random URL-safe token of n bytes
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("internal: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken hashes an opaque token so that it is never stored in plain text
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Issue starts a new token family for username and returns its first token
+func (r *RedisRefreshStore) Issue(ctx context.Context, username, family string) (string, error) {
+	if family == "" {
+		return "", errors.New("validation: token family cannot be empty")
+	}
+
+	userKey := refreshUserPrefix + username
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, refreshFamilyPrefix+family, username, r.ttl)
+		pipe.SAdd(ctx, userKey, family)
+		pipe.Expire(ctx, userKey, r.ttl)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	return r.add(ctx, family, username)
+}
+
+// add stores a fresh, unused token in the given family
+func (r *RedisRefreshStore) add(ctx context.Context, family, username string) (string, error) {
+	token, err := GenerateToken(refreshTokenBytes)
+	if err != nil {
+		return "", err
+	}
+
+	key := refreshTokenPrefix + HashToken(token)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "family", family, "username", username, "used", 0)
+		pipe.Expire(ctx, key, r.ttl)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	return token, nil
+}
+
+// Rotate exchanges a valid refresh token for a new one in the same family
+func (r *RedisRefreshStore) Rotate(ctx context.Context, token string) (string, string, string, error) {
+	if token == "" {
+		return "", "", "", ErrRefreshTokenInvalid
+	}
+
+	key := refreshTokenPrefix + HashToken(token)
+	fields, err := r.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return "", "", "", fmt.Errorf("internal: %w", err)
+	}
+
+	family, username := fields["family"], fields["username"]
+	if family == "" || username == "" {
+		return "", "", "", ErrRefreshTokenInvalid
+	}
+
+	active, err := r.client.Exists(ctx, refreshFamilyPrefix+family).Result()
+	if err != nil {
+		return "", "", "", fmt.Errorf("internal: %w", err)
+	}
+	if active == 0 {
+		return "", "", "", ErrRefreshTokenInvalid
+	}
+
+	// HINCRBY is atomic, so only the first caller ever observes 1
+	used, err := r.client.HIncrBy(ctx, key, "used", 1).Result()
+	if err != nil {
+		return "", "", "", fmt.Errorf("internal: %w", err)
+	}
+	if used > 1 {
+		if err := r.RevokeFamily(ctx, family); err != nil {
+			return "", "", "", err
+		}
+		return username, family, "", ErrRefreshTokenReused
+	}
+
+	newToken, err := r.add(ctx, family, username)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return username, family, newToken, nil
+}
+
+// Revoke invalidates the family the given token belongs to
+func (r *RedisRefreshStore) Revoke(ctx context.Context, token string) error {
+	family, err := r.client.HGet(ctx, refreshTokenPrefix+HashToken(token), "family").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrRefreshTokenInvalid
+		}
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	return r.RevokeFamily(ctx, family)
+}
+
+// RevokeFamily invalidates every token issued in the given family
+func (r *RedisRefreshStore) RevokeFamily(ctx context.Context, family string) error {
+	if err := r.client.Del(ctx, refreshFamilyPrefix+family).Err(); err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+// RevokeUser invalidates every token family of the given user
+func (r *RedisRefreshStore) RevokeUser(ctx context.Context, username string) error {
+	userKey := refreshUserPrefix + username
+	families, err := r.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	keys := make([]string, 0, len(families)+1)
+	for _, family := range families {
+		keys = append(keys, refreshFamilyPrefix+family)
+	}
+	keys = append(keys, userKey)
+
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
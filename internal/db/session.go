@@ -0,0 +1,375 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gocql/gocql"
+)
+
+var ErrSessionNotFound = errors.New("not found: session not found")
+
+const (
+	sessionPrefix        = "auth:session:id:"
+	sessionUserPrefix    = "auth:session:user:"
+	sessionDeletedPrefix = "auth:session:deleted:"
+
+	// sessionTombstoneTTL is how long a deleted session cannot be cached
+	// again. It only has to cover a cache refill that read the session
+	// just before it was deleted.
+	sessionTombstoneTTL = time.Minute
+)
+
+// Session is a login on one device. Its ID is also the ID of the refresh
+// token family started by the login and the sid claim of its access tokens.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionStore keeps the sessions of every user. Sessions are forgotten
+// once they expire.
+type SessionStore interface {
+	AddSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	ListSessions(ctx context.Context, username string) ([]*Session, error)
+	TouchSession(ctx context.Context, session *Session, lastSeen time.Time) error
+	DeleteSession(ctx context.Context, session *Session) error
+	DeleteUserSessions(ctx context.Context, username string) error
+}
+
+// addSessionScript caches a session unless KEYS[3] marks it as recently
+// deleted. KEYS[1] is the session, KEYS[2] the index of its user; ARGV
+// holds the session data, its TTL in milliseconds and its ID. Returns
+// whether the session was stored.
+var addSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return 0
+end
+if not redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then
+	return 0
+end
+redis.call('SADD', KEYS[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// RedisSessionStore implements SessionStore using Redis. Deleted sessions
+// leave a short-lived tombstone, so that a cache refill racing the delete
+// cannot bring them back.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+var _ SessionStore = (*RedisSessionStore)(nil)
+
+// NewRedisSessionStore creates a session store on top of client
+func NewRedisSessionStore(client *redis.Client) *RedisSessionStore {
+	return &RedisSessionStore{client: client}
+}
+
+// AddSession stores the session until it expires and indexes it by
+// username. Sessions that are already cached or were just deleted are
+// left alone.
+func (r *RedisSessionStore) AddSession(ctx context.Context, session *Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return errors.New("validation: session already expired")
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	// Every session lives as long as the newest one, so the index always
+	// outlives its members
+	keys := []string{
+		sessionPrefix + session.ID,
+		sessionUserPrefix + session.Username,
+		sessionDeletedPrefix + session.ID,
+	}
+	if err := addSessionScript.Run(ctx, r.client, keys, data, ttl.Milliseconds(), session.ID).Err(); err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	return nil
+}
+
+// GetSession returns the session with the given ID
+func (r *RedisSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	data, err := r.client.Get(ctx, sessionPrefix+id).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+	return session, nil
+}
+
+// ListSessions returns the sessions of a user that have not expired
+func (r *RedisSessionStore) ListSessions(ctx context.Context, username string) ([]*Session, error) {
+	userKey := sessionUserPrefix + username
+	ids, err := r.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionPrefix + id
+	}
+
+	vals, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	sessions := make([]*Session, 0, len(vals))
+	var expired []interface{}
+	for i, val := range vals {
+		data, ok := val.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+
+		session := &Session{}
+		if err := json.Unmarshal([]byte(data), session); err != nil {
+			return nil, fmt.Errorf("internal: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if len(expired) > 0 {
+		r.client.SRem(ctx, userKey, expired...)
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records when the session was last used
+func (r *RedisSessionStore) TouchSession(ctx context.Context, session *Session, lastSeen time.Time) error {
+	touched := *session
+	touched.LastSeen = lastSeen
+
+	data, err := json.Marshal(&touched)
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	// XX keeps a session deleted in the meantime from coming back
+	if err := r.client.SetXX(ctx, sessionPrefix+session.ID, data, redis.KeepTTL).Err(); err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+// DeleteSession forgets a session
+func (r *RedisSessionStore) DeleteSession(ctx context.Context, session *Session) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionDeletedPrefix+session.ID, 1, sessionTombstoneTTL)
+		pipe.Del(ctx, sessionPrefix+session.ID)
+		pipe.SRem(ctx, sessionUserPrefix+session.Username, session.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserSessions forgets every session of a user
+func (r *RedisSessionStore) DeleteUserSessions(ctx context.Context, username string) error {
+	userKey := sessionUserPrefix + username
+	ids, err := r.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, sessionPrefix+id)
+	}
+	keys = append(keys, userKey)
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Set(ctx, sessionDeletedPrefix+id, 1, sessionTombstoneTTL)
+		}
+		pipe.Del(ctx, keys...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	return nil
+}
+
+var _ SessionStore = (*CassandraRepo)(nil)
+
+// AddSession stores the session with a TTL matching its expiry
+func (c *CassandraRepo) AddSession(ctx context.Context, session *Session) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	ttl := int(time.Until(session.ExpiresAt).Seconds())
+	if ttl <= 0 {
+		return errors.New("validation: session already expired")
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(
+		"INSERT INTO sessions (id, username, user_agent, ip, created_at, last_seen, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?",
+		session.ID, session.Username, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeen, session.ExpiresAt, ttl)
+	batch.Query(
+		"INSERT INTO sessions_by_user (username, id) VALUES (?, ?) USING TTL ?",
+		session.Username, session.ID, ttl)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// GetSession retrieves a session by ID
+func (c *CassandraRepo) GetSession(ctx context.Context, id string) (*Session, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	err := c.session.Query(
+		"SELECT id, username, user_agent, ip, created_at, last_seen, expires_at FROM sessions WHERE id = ? LIMIT 1",
+		id).WithContext(ctx).Scan(
+		&session.ID, &session.Username, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeen, &session.ExpiresAt)
+
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrSessionNotFound
+		}
+		return nil, ErrDatabaseError
+	}
+	if session.Username == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	return session, nil
+}
+
+// ListSessions returns every session of a user
+func (c *CassandraRepo) ListSessions(ctx context.Context, username string) ([]*Session, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	iter := c.session.Query(
+		"SELECT id FROM sessions_by_user WHERE username = ?", username).
+		WithContext(ctx).Iter()
+
+	var ids []string
+	var id string
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, ErrDatabaseError
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := c.GetSession(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records when the session was last used. The cell gets the
+// remaining TTL of the row so that it expires with it; touching a deleted
+// session leaves a row without username, which GetSession ignores.
+func (c *CassandraRepo) TouchSession(ctx context.Context, session *Session, lastSeen time.Time) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	ttl := int(session.ExpiresAt.Sub(lastSeen).Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := c.session.Query(
+		"UPDATE sessions USING TTL ? SET last_seen = ? WHERE id = ?", ttl, lastSeen, session.ID).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// DeleteSession forgets a session
+func (c *CassandraRepo) DeleteSession(ctx context.Context, session *Session) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM sessions WHERE id = ?", session.ID)
+	batch.Query("DELETE FROM sessions_by_user WHERE username = ? AND id = ?", session.Username, session.ID)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
+
+// DeleteUserSessions forgets every session of a user
+func (c *CassandraRepo) DeleteUserSessions(ctx context.Context, username string) error {
+	sessions, err := c.ListSessions(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := c.DeleteSession(ctx, session); err != nil {
+			return err
+		}
+	}
+
+	if err := c.session.Query(
+		"DELETE FROM sessions_by_user WHERE username = ?", username).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
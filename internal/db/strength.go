@@ -0,0 +1,234 @@
+package db
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Password strength is estimated the way zxcvbn does it: the password is
+// split into the cheapest sequence of patterns an attacker would try
+// (dictionary words, keyboard walks, sequences, repeats, years) and the
+// guesses needed for each part are multiplied. The score buckets the
+// resulting guess count from 0 (too guessable) to 4 (very unguessable).
+
+// commonWords are tried first by every cracking tool; the rank is the index
+var commonWords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "login",
+	"monkey", "dragon", "master", "football", "baseball", "shadow", "sunshine",
+	"princess", "iloveyou", "trustno1", "superman", "batman", "starwars",
+	"hello", "freedom", "whatever", "secret", "summer", "winter", "spring",
+	"autumn", "love", "test", "user", "pass", "bank", "money", "account",
+	"computer", "internet", "michael", "jordan", "charlie", "thomas", "hunter",
+	"ranger", "buster", "soccer", "hockey", "killer", "george", "andrew",
+	"daniel", "jessica", "pepper", "ginger", "cookie", "cheese", "orange",
+	"banana", "apple", "flower", "purple", "silver", "golden", "diamond",
+	"angel", "tiger", "lion", "eagle", "family", "friend", "happy", "lucky",
+	"magic", "music", "matrix", "ninja", "mustang", "access", "change",
+	"new", "old", "my", "the", "abc", "bcr", "romania", "bucuresti",
+}
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "5", "s", "$", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// PasswordScore returns a strength score from 0 to 4. userInputs such as
+// the username and email are treated as the most likely dictionary words.
+func PasswordScore(password string, userInputs ...string) int {
+	guesses := EstimateGuesses(password, userInputs...)
+
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// EstimateGuesses approximates how many guesses an attacker needs. Only
+// the first MaxPasswordLength runes are looked at: the search is quadratic
+// in the length, and the guesses for a prefix are a lower bound anyway.
+func EstimateGuesses(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 1
+	}
+	if len(runes) > MaxPasswordLength {
+		runes = runes[:MaxPasswordLength]
+	}
+
+	words := make([]string, 0, len(userInputs)+len(commonWords))
+	for _, input := range userInputs {
+		// Email local parts are more likely than the full address
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			words = append(words, strings.ToLower(local))
+		}
+		if len(input) >= 3 {
+			words = append(words, strings.ToLower(input))
+		}
+	}
+	words = append(words, commonWords...)
+
+	// best[i] is the cheapest guess count for the first i runes
+	best := make([]float64, len(runes)+1)
+	best[0] = 1
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(1)
+		for j := 0; j < i; j++ {
+			g := best[j] * segmentGuesses(runes[j:i], words)
+			if g < best[i] {
+				best[i] = g
+			}
+		}
+	}
+
+	return best[len(runes)]
+}
+
+// segmentGuesses is the cheapest way to guess one part of the password
+func segmentGuesses(seg []rune, words []string) float64 {
+	guesses := bruteForceGuesses(seg)
+
+	if len(seg) >= 3 {
+		if g, ok := dictionaryGuesses(seg, words); ok && g < guesses {
+			guesses = g
+		}
+		if isRepeat(seg) {
+			guesses = math.Min(guesses, float64(charsetSize(seg[0:1])*len(seg)))
+		}
+		if isSequence(seg) {
+			guesses = math.Min(guesses, float64(4*len(seg)))
+		}
+		if isYear(seg) {
+			guesses = math.Min(guesses, 120)
+		}
+	}
+	if len(seg) >= 4 && isKeyboardWalk(seg) {
+		guesses = math.Min(guesses, float64(40*len(seg)))
+	}
+
+	return guesses
+}
+
+func bruteForceGuesses(seg []rune) float64 {
+	return math.Pow(float64(charsetSize(seg)), float64(len(seg)))
+}
+
+// charsetSize is the size of the alphabet the runes are drawn from
+func charsetSize(seg []rune) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range seg {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	return size
+}
+
+func dictionaryGuesses(seg []rune, words []string) (float64, bool) {
+	// No dictionary entry, not even an email address, is longer
+	if len(seg) > MaxEmailLength {
+		return 0, false
+	}
+
+	lower := strings.ToLower(string(seg))
+	candidates := []string{lower, reverse(lower), leetSubstitutions.Replace(lower)}
+
+	for rank, word := range words {
+		for variant, candidate := range candidates {
+			if candidate != word {
+				continue
+			}
+			guesses := float64(rank + 1)
+			if lower != string(seg) {
+				guesses *= 2 // capitalization
+			}
+			if variant > 0 {
+				guesses *= 2 // reversed or l33t
+			}
+			return guesses, true
+		}
+	}
+	return 0, false
+}
+
+func isRepeat(seg []rune) bool {
+	for _, r := range seg[1:] {
+		if r != seg[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func isSequence(seg []rune) bool {
+	delta := seg[1] - seg[0]
+	if delta != 1 && delta != -1 {
+		return false
+	}
+	for i := 2; i < len(seg); i++ {
+		if seg[i]-seg[i-1] != delta {
+			return false
+		}
+	}
+	return true
+}
+
+func isYear(seg []rune) bool {
+	if len(seg) != 4 {
+		return false
+	}
+	s := string(seg)
+	return (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) &&
+		strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
+
+func isKeyboardWalk(seg []rune) bool {
+	s := strings.ToLower(string(seg))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(row, reverse(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
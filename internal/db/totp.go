@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gocql/gocql"
+)
+
+const totpStepPrefix = "auth:totp:step:"
+
+var ErrTOTPNotFound = errors.New("not found: two-factor authentication not enrolled")
+
+// TOTPSecret is a user's two-factor enrollment.
+// The secret is kept in base32 since it is needed to compute codes;
+// recovery codes are only stored as hashes.
+type TOTPSecret struct {
+	Username      string
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string
+}
+
+// TOTPRepository stores two-factor enrollments
+type TOTPRepository interface {
+	GetTOTP(ctx context.Context, username string) (*TOTPSecret, error)
+	SaveTOTP(ctx context.Context, secret *TOTPSecret) error
+	// UseRecoveryCode removes the hashed code and reports whether it existed
+	UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error)
+	DeleteTOTP(ctx context.Context, username string) error
+}
+
+var _ TOTPRepository = (*CassandraRepo)(nil)
+
+// TOTPStepStore remembers the last time step a user logged in with, so that
+// a code cannot be replayed while it is still inside the accepted window
+type TOTPStepStore interface {
+	// Accept records step and reports false if it is not newer than the
+	// last accepted one
+	Accept(ctx context.Context, username string, step uint64) (bool, error)
+}
+
+// acceptStepScript stores ARGV[1] in KEYS[1] for ARGV[2] milliseconds
+// unless the stored step is at or above it. Returns whether it was stored.
+var acceptStepScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[1]))
+if last and last >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// RedisTOTPStepStore implements TOTPStepStore using Redis
+type RedisTOTPStepStore struct {
+	client *redis.Client
+	// ttl only has to outlast the window in which a step is accepted
+	ttl time.Duration
+}
+
+var _ TOTPStepStore = (*RedisTOTPStepStore)(nil)
+
+// NewRedisTOTPStepStore creates a store that forgets steps after ttl
+func NewRedisTOTPStepStore(client *redis.Client, ttl time.Duration) *RedisTOTPStepStore {
+	return &RedisTOTPStepStore{client: client, ttl: ttl}
+}
+
+// Accept atomically compares and records the step
+func (r *RedisTOTPStepStore) Accept(ctx context.Context, username string, step uint64) (bool, error) {
+	accepted, err := acceptStepScript.Run(ctx, r.client, []string{totpStepPrefix + username}, step, r.ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("internal: %w", err)
+	}
+	return accepted == 1, nil
+}
+
+// GetTOTP retrieves the two-factor enrollment of a user
+func (c *CassandraRepo) GetTOTP(ctx context.Context, username string) (*TOTPSecret, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	secret := &TOTPSecret{}
+	err := c.session.Query(
+		"SELECT username, secret, enabled, recovery_codes FROM user_totp WHERE username = ? LIMIT 1",
+		username).WithContext(ctx).Scan(
+		&secret.Username, &secret.Secret, &secret.Enabled, &secret.RecoveryCodes)
+
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrTOTPNotFound
+		}
+		return nil, ErrDatabaseError
+	}
+
+	return secret, nil
+}
+
+// SaveTOTP creates or replaces the two-factor enrollment of a user
+func (c *CassandraRepo) SaveTOTP(ctx context.Context, secret *TOTPSecret) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	if err := c.session.Query(
+		"INSERT INTO user_totp (username, secret, enabled, recovery_codes) VALUES (?, ?, ?, ?)",
+		secret.Username, secret.Secret, secret.Enabled, secret.RecoveryCodes).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// UseRecoveryCode consumes a recovery code. The removal is a lightweight
+// transaction conditioned on the code still being in the set, so when
+// several requests race with the same code only one of them is applied.
+func (c *CassandraRepo) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	if err := c.ensureSession(); err != nil {
+		return false, err
+	}
+
+	// A rejected condition also returns the current recovery_codes
+	applied, err := c.session.Query(
+		"UPDATE user_totp SET recovery_codes = recovery_codes - ? WHERE username = ? IF recovery_codes CONTAINS ?",
+		[]string{codeHash}, username, codeHash).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, ErrUpdateFailed
+	}
+
+	return applied, nil
+}
+
+// DeleteTOTP removes the two-factor enrollment of a user
+func (c *CassandraRepo) DeleteTOTP(ctx context.Context, username string) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	if err := c.session.Query(
+		"DELETE FROM user_totp WHERE username = ?", username).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
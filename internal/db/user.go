@@ -6,8 +6,6 @@ import (
 	"net/mail"
 	"regexp"
 	"unicode/utf8"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Credentials struct {
@@ -20,6 +18,9 @@ type User struct {
 	*Credentials
 	Email    string `json:"email"`
 	Category int    `json:"category"`
+	Verified bool   `json:"verified"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
 }
 
 const (
@@ -29,6 +30,38 @@ const (
 	YoungCategory
 )
 
+// Roles, from least to most privileged. Every role can do everything the
+// roles before it can.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleUser:    1,
+	RoleSupport: 2,
+	RoleAdmin:   3,
+}
+
+// ValidRole reports whether role is one of the Role constants
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// HasRole reports whether role grants at least the required role.
+// Unknown roles grant nothing.
+func HasRole(role, required string) bool {
+	level, ok := roleLevels[role]
+	return ok && level >= roleLevels[required]
+}
+
+// ValidCategory reports whether category is one of the category constants
+func ValidCategory(category int) bool {
+	return category >= SaverCategory && category <= YoungCategory
+}
+
 func NewCredentials(username, password string) *Credentials {
 	return &Credentials{
 		Username: username,
@@ -41,6 +74,7 @@ func NewUser(username, password, email string) *User {
 		Credentials: NewCredentials(username, password),
 		Email:       email,
 		Category:    AntiUserCategory,
+		Role:        RoleUser,
 	}
 }
 
@@ -51,19 +85,22 @@ const (
 	MaxUsernameLength = 20
 	MinEmailLength    = 3
 	MaxEmailLength    = 254 // RFC 5321 limit
-	BcryptCost        = 12  // increase for better security
+	BcryptCost        = 12  // default cost when bcrypt is the configured algorithm
 )
 
-// Password hashing functions
+// Password hashing functions, using DefaultPasswordHasher
 func HashPassword(password string) (string, error) {
-	// Use cost 12 for better security (adjust based on your performance requirements)
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
-	return string(bytes), err
+	return DefaultPasswordHasher.Hash(password)
 }
 
 func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	ok, err := DefaultPasswordHasher.Verify(password, hash)
+	return err == nil && ok
+}
+
+// PasswordNeedsRehash reports whether hash uses an outdated algorithm or cost
+func PasswordNeedsRehash(hash string) bool {
+	return DefaultPasswordHasher.NeedsRehash(hash)
 }
 
 func ValidCredentials(username, password string) error {
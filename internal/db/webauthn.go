@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+var ErrWebAuthnCredentialNotFound = errors.New("not found: passkey not found")
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	// ID is the credential ID chosen by the authenticator, base64url encoded
+	ID       string
+	Username string
+	Name     string
+	// PublicKey is the COSE_Key of the credential
+	PublicKey  []byte
+	SignCount  int64
+	AAGUID     []byte
+	Transports []string
+	CreatedAt  time.Time
+	LastUsed   time.Time
+}
+
+// WebAuthnRepository stores passkeys
+type WebAuthnRepository interface {
+	AddWebAuthnCredential(ctx context.Context, cred *WebAuthnCredential) error
+	GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error)
+	ListWebAuthnCredentials(ctx context.Context, username string) ([]*WebAuthnCredential, error)
+	// UpdateWebAuthnSignCount records a successful login with the credential
+	UpdateWebAuthnSignCount(ctx context.Context, id string, signCount int64, lastUsed time.Time) error
+	DeleteWebAuthnCredential(ctx context.Context, cred *WebAuthnCredential) error
+	DeleteUserWebAuthnCredentials(ctx context.Context, username string) error
+}
+
+var _ WebAuthnRepository = (*CassandraRepo)(nil)
+
+// AddWebAuthnCredential stores a new passkey and indexes it by username
+func (c *CassandraRepo) AddWebAuthnCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(
+		"INSERT INTO webauthn_credentials (id, username, name, public_key, sign_count, aaguid, transports, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		cred.ID, cred.Username, cred.Name, cred.PublicKey, cred.SignCount, cred.AAGUID, cred.Transports, cred.CreatedAt)
+	batch.Query(
+		"INSERT INTO webauthn_credentials_by_user (username, id) VALUES (?, ?)",
+		cred.Username, cred.ID)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// GetWebAuthnCredential retrieves a passkey by its credential ID
+func (c *CassandraRepo) GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	cred := &WebAuthnCredential{}
+	err := c.session.Query(
+		"SELECT id, username, name, public_key, sign_count, aaguid, transports, created_at, last_used FROM webauthn_credentials WHERE id = ? LIMIT 1",
+		id).WithContext(ctx).Scan(
+		&cred.ID, &cred.Username, &cred.Name, &cred.PublicKey, &cred.SignCount,
+		&cred.AAGUID, &cred.Transports, &cred.CreatedAt, &cred.LastUsed)
+
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrWebAuthnCredentialNotFound
+		}
+		return nil, ErrDatabaseError
+	}
+
+	return cred, nil
+}
+
+// ListWebAuthnCredentials returns every passkey of a user
+func (c *CassandraRepo) ListWebAuthnCredentials(ctx context.Context, username string) ([]*WebAuthnCredential, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	iter := c.session.Query(
+		"SELECT id FROM webauthn_credentials_by_user WHERE username = ?", username).
+		WithContext(ctx).Iter()
+
+	var ids []string
+	var id string
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, ErrDatabaseError
+	}
+
+	creds := make([]*WebAuthnCredential, 0, len(ids))
+	for _, id := range ids {
+		cred, err := c.GetWebAuthnCredential(ctx, id)
+		if errors.Is(err, ErrWebAuthnCredentialNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+
+	return creds, nil
+}
+
+// UpdateWebAuthnSignCount stores the counter of the last assertion
+func (c *CassandraRepo) UpdateWebAuthnSignCount(ctx context.Context, id string, signCount int64, lastUsed time.Time) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	if err := c.session.Query(
+		"UPDATE webauthn_credentials SET sign_count = ?, last_used = ? WHERE id = ?", signCount, lastUsed, id).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a passkey
+func (c *CassandraRepo) DeleteWebAuthnCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	if err := c.ensureSession(); err != nil {
+		return err
+	}
+
+	batch := c.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM webauthn_credentials WHERE id = ?", cred.ID)
+	batch.Query("DELETE FROM webauthn_credentials_by_user WHERE username = ? AND id = ?", cred.Username, cred.ID)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
+
+// DeleteUserWebAuthnCredentials removes every passkey of a user
+func (c *CassandraRepo) DeleteUserWebAuthnCredentials(ctx context.Context, username string) error {
+	creds, err := c.ListWebAuthnCredentials(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, cred := range creds {
+		if err := c.DeleteWebAuthnCredential(ctx, cred); err != nil {
+			return err
+		}
+	}
+
+	if err := c.session.Query(
+		"DELETE FROM webauthn_credentials_by_user WHERE username = ?", username).
+		WithContext(ctx).Exec(); err != nil {
+		return ErrDeletionFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"log"
+	"time"
+)
+
+var ErrImpersonationForbidden = errors.New("forbidden: not allowed while impersonating")
+
+// impersonationScopes let staff see the account as its owner does without
+// changing it: account management and profile writes are left out, which
+// blocks deletion, password changes, logout and 2FA
+var impersonationScopes = []string{db.ScopeAdsRead, db.ScopeProfileRead}
+
+// impersonate mints a short-lived read-only token for username on behalf
+// of actor. The audit record is written first, so no token exists without it.
+func (s *Server) impersonate(ctx context.Context, actor *JWTClaims, username, reason, ip string) (string, error) {
+	if actor.Username == username {
+		return "", errors.New("validation: cannot impersonate yourself")
+	}
+	if len(reason) > 256 {
+		return "", errors.New("validation: reason must be at most 256 characters")
+	}
+
+	user, err := s.userRepo.GetUser(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if user.Role != db.RoleUser {
+		return "", errors.New("forbidden: staff accounts cannot be impersonated")
+	}
+
+	if err := s.audit.AddAuditEvent(ctx, &db.AuditEvent{
+		Username: username,
+		Time:     time.Now(),
+		Actor:    actor.Username,
+		Action:   db.AuditImpersonate,
+		Detail:   reason,
+		IP:       ip,
+	}); err != nil {
+		return "", err
+	}
+
+	token, err := s.jwtmanager.CreateImpersonationToken(username, user.Role, actor.Username, impersonationScopes)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("impersonation: %s started acting as %s from %s: %q", actor.Username, username, ip, reason)
+	return token, nil
+}
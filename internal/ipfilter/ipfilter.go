@@ -0,0 +1,188 @@
+// Package ipfilter decides which client networks are always let through
+// and which are blocked outright, from CIDR lists in a JSON file. The file
+// is watched and reloaded when it changes, so lists can be edited without
+// a restart.
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Verdict is what the lists say about one address
+type Verdict int
+
+const (
+	// Unlisted addresses are in neither list
+	Unlisted Verdict = iota
+	// Allowed addresses skip bans and rate limits
+	Allowed
+	// Denied addresses are rejected
+	Denied
+)
+
+// Lists is the content of the lists file, e.g.
+// {"allow": ["10.0.0.0/8"], "deny": ["198.51.100.0/24", "203.0.113.9"]}
+type Lists struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Check returns the verdict for addr. The allowlist wins, so a trusted
+// network can be carved out of a denied range.
+func (l *Lists) Check(addr netip.Addr) Verdict {
+	addr = addr.Unmap()
+	if contains(l.Allow, addr) {
+		return Allowed
+	}
+	if contains(l.Deny, addr) {
+		return Denied
+	}
+	return Unlisted
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLists reads the JSON lists; bare addresses are accepted as
+// single-host networks
+func ParseLists(data []byte) (*Lists, error) {
+	var file struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	lists := &Lists{}
+	var err error
+	if lists.Allow, err = parsePrefixes(file.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if lists.Deny, err = parsePrefixes(file.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return lists, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Filter holds the lists loaded from a file
+type Filter struct {
+	path  string
+	lists atomic.Pointer[Lists]
+
+	// mutex serialises reloads; checks only read lists
+	mutex   sync.Mutex
+	modTime time.Time
+}
+
+// NewFilter loads the lists at path. A missing file leaves both lists
+// empty and returns an error wrapping os.ErrNotExist; the filter is usable
+// either way and picks the file up once it is created.
+func NewFilter(path string) (*Filter, error) {
+	f := &Filter{path: path}
+	f.lists.Store(&Lists{})
+	return f, f.Reload()
+}
+
+// Check returns the verdict of the current lists for addr
+func (f *Filter) Check(addr netip.Addr) Verdict {
+	return f.lists.Load().Check(addr)
+}
+
+// Reload reads the file again. Invalid content keeps the previous lists;
+// a deleted file empties them.
+func (f *Filter) Reload() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.reload()
+}
+
+func (f *Filter) reload() error {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.lists.Store(&Lists{})
+		f.modTime = time.Time{}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	// The time is recorded even for invalid content, so that a broken
+	// file is reported once rather than on every poll
+	f.modTime = info.ModTime()
+
+	lists, err := ParseLists(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.lists.Store(lists)
+	return nil
+}
+
+// Watch polls the file every interval and reloads it when its
+// modification time changes, until ctx is done. Reload errors other than
+// a missing file are passed to onError.
+func (f *Filter) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.mutex.Lock()
+		var modTime time.Time
+		if info, err := os.Stat(f.path); err == nil {
+			modTime = info.ModTime()
+		}
+		var err error
+		if !modTime.Equal(f.modTime) {
+			err = f.reload()
+		}
+		f.mutex.Unlock()
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			onError(err)
+		}
+	}
+}
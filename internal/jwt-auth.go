@@ -1,61 +1,294 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"internal/db"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	// RefreshTokenDuration is the absolute lifetime of a refresh token family
+	RefreshTokenDuration = 30 * 24 * time.Hour
+	// MFAChallengeDuration is how long a user has to enter the second factor
+	MFAChallengeDuration = 5 * time.Minute
+	// PasswordResetDuration is how long a password reset link stays valid
+	PasswordResetDuration = 30 * time.Minute
+	// EmailVerificationDuration is how long an email verification link stays valid
+	EmailVerificationDuration = 48 * time.Hour
+	// MagicLinkDuration is how long a login link stays valid
+	MagicLinkDuration = 15 * time.Minute
+	// ImpersonationDuration is the lifetime of a token minted by an admin
+	// for another user; it cannot be refreshed
+	ImpersonationDuration = 15 * time.Minute
+	// APIKeyDuration is the default lifetime of an API key
+	APIKeyDuration = 90 * 24 * time.Hour
+	// MaxAPIKeyDuration is the longest lifetime an API key can be created with
+	MaxAPIKeyDuration = 365 * 24 * time.Hour
+)
+
 type JWTManager struct {
 	secretKey []byte
 	issuer    string
 	duration  time.Duration
+
+	// Asymmetric keys by kid; when activeKey is set it replaces the secret
+	keys      map[string]*SigningKey
+	activeKey *SigningKey
 }
 
 type JWTClaims struct {
 	Username string `json:"username"`
+	// Purpose is empty for access tokens; restricted tokens such as login
+	// challenges set it so they are never accepted as access tokens
+	Purpose string `json:"purpose,omitempty"`
+	// Role is only set on access tokens
+	Role string `json:"role,omitempty"`
+	// Scope lists the granted scopes, space separated, of credentials
+	// limited to some scopes such as API keys
+	Scope string `json:"scope,omitempty"`
+	// SessionID is the login session of an access token; the token dies
+	// with its session
+	SessionID string `json:"sid,omitempty"`
+	// Actor is set when staff act as the user (RFC 8693)
+	Actor *Actor `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Actor identifies who is really behind an impersonation token
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Purposes of restricted tokens
+const (
+	PurposeMFAChallenge = "mfa_challenge"
+	PurposeMagicLink    = "magic_link"
+	// PurposeAPIKey marks claims built from an API key rather than a JWT
+	PurposeAPIKey = "api_key"
+	// PurposeIDToken marks OpenID Connect ID tokens, which are signed with
+	// the same keys but only describe the user to a client
+	PurposeIDToken = "id_token"
+)
+
+// HasScope reports whether the credentials grant scope. Access tokens from
+// a login grant every scope; API keys and tokens issued to OAuth clients
+// only the ones they were created with.
+func (c *JWTClaims) HasScope(scope string) bool {
+	if c.Scope == "" && c.Purpose != PurposeAPIKey {
+		return true
+	}
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// TokenResponse is returned by every endpoint that issues tokens.
+// When a second factor is required only the challenge fields are set.
+type TokenResponse struct {
+	Token          string `json:"token,omitempty"`
+	RefreshToken   string `json:"refresh_token,omitempty"`
+	ExpiresIn      int    `json:"expires_in,omitempty"`
+	MFARequired    bool   `json:"mfa_required,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+}
+
 // NewJWTManager initializes and returns a new JWTManager
 func NewJWTManager(secret string) *JWTManager {
 	return &JWTManager{
 		secretKey: []byte(secret),
 		issuer:    "bcr-auth",
 		duration:  15 * time.Minute,
+		keys:      make(map[string]*SigningKey),
+	}
+}
+
+// NewJWTManagerWithKeys returns a JWTManager that signs with the key
+// named activeKID and accepts tokens signed by any of keys. An empty
+// activeKID selects the last key able to sign.
+func NewJWTManagerWithKeys(keys []*SigningKey, activeKID string) (*JWTManager, error) {
+	j := NewJWTManager("")
+	j.secretKey = nil
+
+	for _, key := range keys {
+		j.keys[key.ID] = key
+		if key.CanSign() && (activeKID == "" || key.ID == activeKID) {
+			j.activeKey = key
+		}
+	}
+
+	if j.activeKey == nil {
+		return nil, fmt.Errorf("no signing key available (active kid %q)", activeKID)
+	}
+
+	return j, nil
+}
+
+// JWKS returns the public verification keys as a JSON Web Key Set
+func (j *JWTManager) JWKS() map[string][]map[string]string {
+	keys := make([]map[string]string, 0, len(j.keys))
+	for _, key := range j.keys {
+		keys = append(keys, key.JWK())
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a]["kid"] < keys[b]["kid"] })
+
+	return map[string][]map[string]string{"keys": keys}
+}
+
+// Algorithm is the JWS algorithm new tokens are signed with
+func (j *JWTManager) Algorithm() string {
+	if j.activeKey == nil {
+		return jwt.SigningMethodHS256.Alg()
+	}
+	return j.activeKey.Method.Alg()
+}
+
+// sign serializes the claims with the active key, or the HMAC secret
+func (j *JWTManager) sign(claims jwt.Claims) (string, error) {
+	if j.activeKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(j.secretKey)
+	}
+
+	token := jwt.NewWithClaims(j.activeKey.Method, claims)
+	token.Header["kid"] = j.activeKey.ID
+	return token.SignedString(j.activeKey.Private)
+}
+
+// verificationKey picks the key matching the token header. The algorithm
+// must match the key type, so a public key can never be used as an HMAC secret.
+func (j *JWTManager) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if j.secretKey == nil {
+			return nil, errors.New("missing kid header")
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return j.secretKey, nil
+	}
+
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
+	return key.Public, nil
 }
 
-// CreateToken generates a signed JWT for the given username
-func (j *JWTManager) CreateToken(username string) (string, error) {
-	claims := JWTClaims{
+// CreateToken generates a signed access token for the given username and
+// role, bound to a login session
+func (j *JWTManager) CreateToken(username, role, sessionID string) (string, error) {
+	claims, err := j.newClaims(username, j.duration)
+	if err != nil {
+		return "", err
+	}
+	claims.Role = role
+	claims.SessionID = sessionID
+
+	return j.sign(claims)
+}
+
+// CreateClientToken generates an access token issued to an OAuth client.
+// It is limited to scopes and carries no role.
+func (j *JWTManager) CreateClientToken(username, clientID string, scopes []string) (string, error) {
+	claims, err := j.newClaims(username, j.duration)
+	if err != nil {
+		return "", err
+	}
+	claims.Scope = strings.Join(scopes, " ")
+	claims.Audience = jwt.ClaimStrings{clientID}
+
+	return j.sign(claims)
+}
+
+// CreateImpersonationToken generates an access token for username on
+// behalf of actor, limited to scopes and without a session
+func (j *JWTManager) CreateImpersonationToken(username, role, actor string, scopes []string) (string, error) {
+	claims, err := j.newClaims(username, ImpersonationDuration)
+	if err != nil {
+		return "", err
+	}
+	claims.Role = role
+	claims.Scope = strings.Join(scopes, " ")
+	claims.Actor = &Actor{Subject: actor}
+
+	return j.sign(claims)
+}
+
+// CreatePurposeToken generates a restricted JWT that is only accepted by
+// ValidatePurposeToken with the same purpose
+func (j *JWTManager) CreatePurposeToken(username, purpose string, duration time.Duration) (string, error) {
+	claims, err := j.newClaims(username, duration)
+	if err != nil {
+		return "", err
+	}
+	claims.Purpose = purpose
+
+	return j.sign(claims)
+}
+
+// CreateNonceToken is CreatePurposeToken with a caller-chosen jti, so that
+// the token can be tied to a nonce stored elsewhere
+func (j *JWTManager) CreateNonceToken(username, purpose, nonce string, duration time.Duration) (string, error) {
+	claims, err := j.newClaims(username, duration)
+	if err != nil {
+		return "", err
+	}
+	claims.Purpose = purpose
+	claims.ID = nonce
+
+	return j.sign(claims)
+}
+
+// maxAccessTokenDuration is the longest lifetime of a token accepted as an
+// access token, so per-user revocations must be kept at least as long
+func (j *JWTManager) maxAccessTokenDuration() time.Duration {
+	return max(j.duration, ImpersonationDuration)
+}
+
+func (j *JWTManager) newClaims(username string, duration time.Duration) (*JWTClaims, error) {
+	jti, err := db.GenerateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTClaims{
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(j.duration)),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    j.issuer,
 		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(j.secretKey)
+	}, nil
 }
 
 // ValidateToken verifies the JWT string and returns the claims
 func (j *JWTManager) ValidateToken(tokenStr string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &JWTClaims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return j.secretKey, nil
-	})
+	return j.ValidatePurposeToken(tokenStr, "")
+}
+
+// ValidatePurposeToken verifies the JWT string and checks its purpose
+func (j *JWTManager) ValidatePurposeToken(tokenStr, purpose string) (*JWTClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &JWTClaims{}, j.verificationKey, jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
+		if claims.Purpose != purpose {
+			return nil, fmt.Errorf("invalid token purpose %q", claims.Purpose)
+		}
+		if claims.Username == "" {
+			return nil, errors.New("invalid token: missing username")
+		}
 		return claims, nil
 	}
 
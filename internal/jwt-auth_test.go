@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"internal/db"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRevokeUserCoversImpersonationTokens(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	ctx := context.Background()
+
+	// Access tokens expire before impersonation tokens do
+	ts.jwtmanager.duration = 5 * time.Minute
+	client := redis.NewClient(&redis.Options{Addr: ts.redis.Addr()})
+	t.Cleanup(func() { client.Close() })
+	ts.revocations = db.NewRedisRevocationStore(client, ts.jwtmanager.maxAccessTokenDuration())
+
+	claims, _ := ts.jwtmanager.newClaims(testUsername, ImpersonationDuration)
+	claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+	claims.Actor = &Actor{Subject: "support"}
+	token, err := ts.jwtmanager.sign(claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	if err := ts.revokeAllTokens(ctx, testUsername); err != nil {
+		t.Fatalf("revokeAllTokens failed: %v", err)
+	}
+
+	// The cutoff must still be known after every access token expired
+	ts.redis.FastForward(10 * time.Minute)
+	if _, err := ts.authenticateBearer(ctx, token); err == nil {
+		t.Fatal("Expected the impersonation token to stay revoked")
+	}
+
+	if ttl := ts.redis.TTL("auth:revoked:user:" + testUsername); ttl != ImpersonationDuration-10*time.Minute {
+		t.Fatalf("Expected the cutoff to expire with the last impersonation token, TTL %s", ttl)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is an asymmetric key identified by its kid header.
+// Keys loaded from a public key file can only verify tokens.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// CanSign reports whether the private half of the key is available
+func (k *SigningKey) CanSign() bool {
+	return k.Private != nil
+}
+
+// LoadSigningKeys reads every *.pem file in dir. The file name without
+// the extension becomes the kid, so keys can be rotated by dropping a new
+// file next to the old ones.
+func LoadSigningKeys(dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key %s: %w", path, err)
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParseSigningKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ParseSigningKey parses a PEM encoded RSA or Ed25519 key
+func ParseSigningKey(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	return key, nil
+}
+
+// JWK returns the public half of the key in RFC 7517 format
+func (k *SigningKey) JWK() map[string]string {
+	jwk := map[string]string{
+		"kid": k.ID,
+		"alg": k.Method.Alg(),
+		"use": "sig",
+	}
+
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeTestKeys creates a key directory as it looks during a rotation: an
+// old RSA key, the new Ed25519 key and a public key from another service
+func writeTestKeys(t *testing.T) (string, *rsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(newKey)
+	pkix, _ := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	files := map[string]*pem.Block{
+		"2025-01.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(oldKey)},
+		"2025-06.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"partner.pem": {Type: "PUBLIC KEY", Bytes: pkix},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+	}
+	// Other files are ignored
+	os.WriteFile(filepath.Join(dir, "README"), []byte("keys"), 0o600)
+
+	return dir, oldKey, newKey, otherKey
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key any) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, &JWTClaims{
+		Username: testUsername,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	dir, _, _, _ := writeTestKeys(t)
+
+	keys, err := LoadSigningKeys(dir)
+	if err != nil {
+		t.Fatalf("LoadSigningKeys failed: %v", err)
+	}
+
+	expected := []struct {
+		kid     string
+		alg     string
+		canSign bool
+	}{
+		{"2025-01", "RS256", true},
+		{"2025-06", "EdDSA", true},
+		{"partner", "RS256", false},
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(keys))
+	}
+	for i, e := range expected {
+		if keys[i].ID != e.kid || keys[i].Method.Alg() != e.alg || keys[i].CanSign() != e.canSign {
+			t.Errorf("Expected %s %s (can sign %v), got %s %s (%v)",
+				e.kid, e.alg, e.canSign, keys[i].ID, keys[i].Method.Alg(), keys[i].CanSign())
+		}
+	}
+
+	if _, err := ParseSigningKey("bad", []byte("not a key")); err == nil {
+		t.Error("Expected data without a PEM block to be rejected")
+	}
+	ec := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte{0}})
+	if _, err := ParseSigningKey("ec", ec); err == nil {
+		t.Error("Expected an unsupported key type to be rejected")
+	}
+}
+
+func TestJWTManagerKeys(t *testing.T) {
+	dir, oldKey, newKey, otherKey := writeTestKeys(t)
+	keys, _ := LoadSigningKeys(dir)
+
+	manager, err := NewJWTManagerWithKeys(keys, "")
+	if err != nil {
+		t.Fatalf("NewJWTManagerWithKeys failed: %v", err)
+	}
+	if _, err := NewJWTManagerWithKeys(keys, "partner"); err == nil {
+		t.Fatal("Expected a public key to be refused as the active key")
+	}
+
+	// New tokens use the last key able to sign
+	token, err := manager.CreateToken(testUsername, "", "")
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(token, &JWTClaims{})
+	if parsed.Header["kid"] != "2025-06" || parsed.Method.Alg() != "EdDSA" {
+		t.Fatalf("Expected an EdDSA token from 2025-06, got %v", parsed.Header)
+	}
+	if _, err := manager.ValidateToken(token); err != nil {
+		t.Fatalf("Expected own token to validate: %v", err)
+	}
+
+	// An attacker knowing the public key must not be able to use it as an
+	// HMAC secret
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&oldKey.PublicKey)})
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rotated out key", signTestToken(t, jwt.SigningMethodRS256, "2025-01", oldKey), true},
+		{"active key", signTestToken(t, jwt.SigningMethodEdDSA, "2025-06", newKey), true},
+		{"verify-only key", signTestToken(t, jwt.SigningMethodRS256, "partner", otherKey), true},
+		{"unknown kid", signTestToken(t, jwt.SigningMethodRS256, "2024-12", oldKey), false},
+		{"missing kid", signTestToken(t, jwt.SigningMethodRS256, "", oldKey), false},
+		{"kid of another key", signTestToken(t, jwt.SigningMethodRS256, "partner", oldKey), false},
+		{"alg of another key", signTestToken(t, jwt.SigningMethodRS256, "2025-06", oldKey), false},
+		{"HS256 with the public key", signTestToken(t, jwt.SigningMethodHS256, "2025-01", publicPEM), false},
+	}
+
+	for _, tt := range tests {
+		_, err := manager.ValidateToken(tt.token)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected token to validate: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected token to be rejected", tt.name)
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir, oldKey, newKey, _ := writeTestKeys(t)
+	keys, _ := LoadSigningKeys(dir)
+	manager, _ := NewJWTManagerWithKeys(keys, "2025-06")
+
+	set := manager.JWKS()["keys"]
+	if len(set) != 3 {
+		t.Fatalf("Expected the rotated out and verify-only keys to be published, got %d keys", len(set))
+	}
+
+	var kids []string
+	for _, jwk := range set {
+		kids = append(kids, jwk["kid"])
+		if jwk["use"] != "sig" || jwk["d"] != "" {
+			t.Errorf("Unexpected JWK %v", jwk)
+		}
+	}
+	if strings.Join(kids, ",") != "2025-01,2025-06,partner" {
+		t.Fatalf("Expected keys sorted by kid, got %v", kids)
+	}
+
+	rsaKey := set[0]
+	n, _ := base64.RawURLEncoding.DecodeString(rsaKey["n"])
+	e, _ := base64.RawURLEncoding.DecodeString(rsaKey["e"])
+	if rsaKey["kty"] != "RSA" || rsaKey["alg"] != "RS256" ||
+		new(big.Int).SetBytes(n).Cmp(oldKey.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(oldKey.E) {
+		t.Errorf("Unexpected RSA JWK %v", rsaKey)
+	}
+
+	edKey := set[1]
+	x, _ := base64.RawURLEncoding.DecodeString(edKey["x"])
+	if edKey["kty"] != "OKP" || edKey["crv"] != "Ed25519" || edKey["alg"] != "EdDSA" ||
+		!ed25519.PublicKey(x).Equal(newKey.Public()) {
+		t.Errorf("Unexpected Ed25519 JWK %v", edKey)
+	}
+}
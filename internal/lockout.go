@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LockoutError is returned by login while the account is throttled by
+// the db.LockoutPolicy
+type LockoutError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("locked: account temporarily locked, retry in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("throttled: too many failed logins, retry in %s", e.RetryAfter.Round(time.Second))
+}
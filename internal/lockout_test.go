@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"internal/db"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	ts.addUser(t, "support", "support@example.com", true)
+	staff := ts.repo.users["support"]
+	staff.Role = db.RoleSupport
+	ts.repo.users["support"] = staff
+
+	now := time.Now().Truncate(time.Millisecond)
+	ts.redis.SetTime(now)
+	policy := db.NewLockoutPolicy()
+
+	guess := func() int {
+		w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": "wrong-password"}, "")
+		return w.Code
+	}
+
+	for i := 0; i < policy.BackoffAfter; i++ {
+		if code := guess(); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for guess %d, got %d", i+1, code)
+		}
+	}
+
+	// Backing off answers 429 with Retry-After, even for the right password
+	w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": testPassword}, "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Guess until the account locks, waiting out each delay
+	for i := policy.BackoffAfter; i < policy.LockAfter; i++ {
+		now = now.Add(policy.MaxDelay)
+		ts.redis.SetTime(now)
+		if code := guess(); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for guess %d, got %d", i+1, code)
+		}
+	}
+
+	now = now.Add(policy.MaxDelay)
+	ts.redis.SetTime(now)
+	w = call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": testPassword}, "")
+	if w.Code != http.StatusLocked || w.Header().Get("Retry-After") != "840" {
+		t.Fatalf("Expected 423 with Retry-After 840, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Support staff can lift the lock early
+	unlock := ts.requireRole(db.RoleSupport, ts.handleAdminUnlock)
+	if w := call(unlock, http.MethodPost, "/v1/admin/unlock", map[string]string{"username": testUsername}, ts.login(t, "support")); w.Code != http.StatusOK {
+		t.Fatalf("Unlock failed: %d %s", w.Code, w.Body)
+	}
+	ts.login(t, testUsername)
+}
+
+func TestLoginLockoutIgnoresCorrectPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	ts.redis.SetTime(time.Now())
+
+	// Successful logins do not add up to a backoff
+	for i := 0; i < db.NewLockoutPolicy().BackoffAfter+1; i++ {
+		ts.login(t, testUsername)
+	}
+
+	attempts, err := ts.attempts.Get(context.Background(), testUsername)
+	if err != nil || attempts.Failures != 0 {
+		t.Fatalf("Expected no failures, got %+v %v", attempts, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internal/db"
+	"internal/mailer"
+	"strings"
+)
+
+var ErrMagicLinkInvalid = errors.New("unauthorized: invalid or expired login link")
+
+// requestMagicLink mails a login link to the address of username. Like
+// forgotPassword it is silent about unknown users and users without email.
+func (s *Server) requestMagicLink(ctx context.Context, username string) error {
+	user, err := s.userRepo.GetUser(ctx, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || user.Disabled {
+		return nil
+	}
+
+	// The signed token carries the nonce as jti; the nonce itself lives in
+	// Redis, bound to the address, until the link is used or expires
+	nonce, err := s.magicLinks.Create(ctx, user.Username+":"+user.Email)
+	if err != nil {
+		return err
+	}
+	token, err := s.jwtmanager.CreateNonceToken(user.Username, PurposeMagicLink, nonce, MagicLinkDuration)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hello %s,\n\nUse the link below to log in. "+
+			"It expires in %d minutes and can only be used once.\n\n%s/magic-login?token=%s\n\n"+
+			"If you did not ask to log in, you can ignore this message.\n",
+			user.Username, int(MagicLinkDuration.Minutes()), s.appBaseURL, token),
+	})
+	return nil
+}
+
+// redeemMagicLink exchanges a login link for tokens. The link only proves
+// access to the mailbox, so users with a second factor still have to enter it.
+func (s *Server) redeemMagicLink(ctx context.Context, token string, session *db.Session) (*TokenResponse, error) {
+	claims, err := s.jwtmanager.ValidatePurposeToken(token, PurposeMagicLink)
+	if err != nil {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	subject, err := s.magicLinks.Consume(ctx, claims.ID)
+	if errors.Is(err, db.ErrOneTimeTokenInvalid) {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	username, email, ok := strings.Cut(subject, ":")
+	if !ok || username != claims.Username {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	user, err := s.getUser(ctx, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != email {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	// Opening the link proves the address as well as a verification link would
+	if !user.Verified {
+		user.Verified = true
+		if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+		s.userCache.Add(ctx, user)
+	}
+
+	return s.completeLogin(ctx, user, session)
+}
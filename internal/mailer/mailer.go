@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer defines the interface for sending emails
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// SMTPConfig holds the configuration for an SMTP relay
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPMailer sends messages through an SMTP relay
+type SMTPMailer struct {
+	config *SMTPConfig
+}
+
+var _ Mailer = (*SMTPMailer)(nil)
+
+// NewSMTPMailer creates a Mailer using the given relay
+func NewSMTPMailer(config *SMTPConfig) (*SMTPMailer, error) {
+	if config == nil || config.Host == "" || config.From == "" {
+		return nil, errors.New("smtp: host and sender are required")
+	}
+	return &SMTPMailer{config: config}, nil
+}
+
+// Send delivers the message, authenticating when credentials are set
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errors.New("smtp: invalid header value")
+	}
+
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	}
+
+	data := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.config.From, msg.To, msg.Subject, time.Now().Format(time.RFC1123Z), msg.Body)
+
+	addr := net.JoinHostPort(m.config.Host, m.config.Port)
+	if err := smtp.SendMail(addr, auth, m.config.From, []string{msg.To}, []byte(data)); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return nil
+}
+
+// MemoryMailer keeps sent messages in memory; used in tests and
+// when no SMTP relay is configured
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+var _ Mailer = (*MemoryMailer)(nil)
+
+// NewMemoryMailer creates an empty in-memory Mailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send records the message
+func (m *MemoryMailer) Send(ctx context.Context, msg *Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of every message sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the most recent message sent to the given address
+func (m *MemoryMailer) Last(to string) (*Message, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			msg := m.messages[i]
+			return &msg, true
+		}
+	}
+	return nil, false
+}
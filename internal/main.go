@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"internal/clientip"
+	"internal/concurrency"
+	"internal/config"
 	"internal/db"
+	"internal/webauthn"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +33,63 @@ func JSONError(w http.ResponseWriter, message string, status int) {
 	})
 }
 
+// lockoutError answers 423 for locked accounts and 429 while backing off,
+// with a Retry-After header. It reports whether err was a lockout.
+func lockoutError(w http.ResponseWriter, err error) bool {
+	var lockoutErr *LockoutError
+	if !errors.As(err, &lockoutErr) {
+		return false
+	}
+
+	retryAfter := int(math.Ceil(lockoutErr.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if lockoutErr.Locked {
+		JSONError(w, err.Error(), http.StatusLocked)
+	} else {
+		JSONError(w, err.Error(), http.StatusTooManyRequests)
+	}
+	return true
+}
+
+// overloadError answers 503 with a Retry-After header when password
+// hashing is saturated. It reports whether err was an overload.
+func overloadError(w http.ResponseWriter, err error) bool {
+	var overloadErr *concurrency.OverloadError
+	if !errors.As(err, &overloadErr) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(overloadErr.RetryAfter), 1)))
+	JSONError(w, "Service unavailable: server busy, retry later", http.StatusServiceUnavailable)
+	return true
+}
+
+// authError answers 403 when the credentials lack a scope and 401 otherwise
+func authError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), "forbidden") {
+		JSONError(w, "Forbidden: "+strings.TrimPrefix(err.Error(), "forbidden: "), http.StatusForbidden)
+		return
+	}
+	JSONError(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+}
+
+// passwordPolicyError answers 400 with the score and every reason the
+// password was rejected. It reports whether err was a policy error.
+func passwordPolicyError(w http.ResponseWriter, err error) bool {
+	var policyErr *db.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*db.PasswordPolicyError
+	}{policyErr.Error(), policyErr})
+	return true
+}
+
 // HTTP Handlers
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -41,13 +111,19 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := s.login(r.Context(), cred)
+	tokens, err := s.login(r.Context(), cred, s.newSession(r))
 	if err != nil {
 		s.recordDBOperation("user_login", "error")
 		log.Printf("login: %v", err)
 
+		if lockoutError(w, err) || overloadError(w, err) {
+			return
+		}
+
 		if strings.Contains("login: "+err.Error(), "unauthorized") {
 			JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "forbidden") {
+			JSONError(w, err.Error(), http.StatusForbidden)
 		} else {
 			JSONError(w, "Internal server error", http.StatusInternalServerError)
 		}
@@ -56,7 +132,268 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	s.recordDBOperation("user_login", "success")
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		s.recordDBOperation("user_login_2fa", "error")
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	challenge := payload.getString("challenge_token")
+	code := payload.getString("code")
+	recoveryCode := payload.getString("recovery_code")
+	if challenge == "" || (code == "" && recoveryCode == "") {
+		s.recordDBOperation("user_login_2fa", "error")
+		JSONError(w, "Bad request: challenge token and code required", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.loginTOTP(r.Context(), challenge, code, recoveryCode, s.newSession(r))
+	if err != nil {
+		s.recordDBOperation("user_login_2fa", "error")
+		log.Printf("login 2fa: %v", err)
+
+		if lockoutError(w, err) {
+			return
+		}
+
+		if strings.Contains(err.Error(), "unauthorized") || strings.Contains(err.Error(), "not found") {
+			JSONError(w, "Unauthorized: invalid challenge or code", http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "forbidden") {
+			JSONError(w, err.Error(), http.StatusForbidden)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("user_login_2fa", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) handleMagicLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	username := payload.getString("username")
+	if username == "" {
+		JSONError(w, "Bad request: username not provided", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.requestMagicLink(r.Context(), username); err != nil {
+		s.recordDBOperation("magic_link", "error")
+		log.Printf("magic link: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordDBOperation("magic_link", "success")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account exists, a login link has been sent"))
+}
+
+func (s *Server) handleMagicLinkRedeem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		s.recordDBOperation("user_login_magic", "error")
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	token := payload.getString("token")
+	if token == "" {
+		s.recordDBOperation("user_login_magic", "error")
+		JSONError(w, "Bad request: token not provided", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.redeemMagicLink(r.Context(), token, s.newSession(r))
+	if err != nil {
+		s.recordDBOperation("user_login_magic", "error")
+		log.Printf("login magic link: %v", err)
+
+		if strings.Contains(err.Error(), "unauthorized") {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "forbidden") {
+			JSONError(w, err.Error(), http.StatusForbidden)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("user_login_magic", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	secret, err := s.enrollTOTP(r.Context(), username)
+	if err != nil {
+		s.recordDBOperation("totp_enroll", "error")
+		log.Printf("totp enroll: %v", err)
+
+		if strings.Contains(err.Error(), "validation") {
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("totp_enroll", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(username, secret),
+	})
+}
+
+func (s *Server) handleTOTPActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := s.activateTOTP(r.Context(), username, payload.getString("code"))
+	if err != nil {
+		s.recordDBOperation("totp_activate", "error")
+		log.Printf("totp activate: %v", err)
+
+		if strings.Contains(err.Error(), "validation") || strings.Contains(err.Error(), "not found") {
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("totp_activate", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		s.recordDBOperation("token_refresh", "error")
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken := payload.getString("refresh_token")
+	if refreshToken == "" {
+		s.recordDBOperation("token_refresh", "error")
+		JSONError(w, "Bad request: refresh token not provided", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.refresh(r.Context(), refreshToken)
+	if err != nil {
+		s.recordDBOperation("token_refresh", "error")
+		log.Printf("refresh: %v", err)
+
+		if strings.Contains(err.Error(), "unauthorized") {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "forbidden") {
+			JSONError(w, err.Error(), http.StatusForbidden)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("token_refresh", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := s.authorize(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	if err := s.revocations.Revoke(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		log.Printf("logout: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if claims.SessionID != "" {
+		if err := s.revokeSession(r.Context(), claims.Username, claims.SessionID); err != nil {
+			log.Printf("logout: %v", err)
+		}
+	}
+
+	// The body is optional; it only carries the refresh token to drop
+	// for tokens issued before sessions existed
+	payload, _ := parseJSON(r)
+	if refreshToken := payload.getString("refresh_token"); refreshToken != "" {
+		if err := s.refreshStore.Revoke(r.Context(), refreshToken); err != nil {
+			log.Printf("logout: %v", err)
+		}
+	}
+
+	w.Write([]byte("Logged out successfully"))
 }
 
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -83,6 +420,9 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		s.recordDBOperation("user_register", "error")
 		log.Printf("register: %v", err)
 
+		if passwordPolicyError(w, err) || overloadError(w, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "validation:") {
 			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 		} else {
@@ -102,12 +442,13 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, err := s.validateToken(r)
+	claims, err := s.authorize(r, db.ScopeProfileWrite)
 	if err != nil {
 		s.recordDBOperation("user_update", "error")
-		JSONError(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+		authError(w, err)
 		return
 	}
+	username := claims.Username
 
 	payload, err := parseJSON(r)
 	if err != nil {
@@ -123,11 +464,14 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.loginCheck(r.Context(), db.NewCredentials(username, password))
+	user, err := s.confirmPassword(r.Context(), db.NewCredentials(username, password))
 	if err != nil {
 		s.recordDBOperation("user_update", "error")
 		log.Printf("update: %v", err)
 
+		if lockoutError(w, err) || overloadError(w, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "unauthorized") {
 			JSONError(w, "update: "+err.Error(), http.StatusUnauthorized)
 		} else if strings.Contains(err.Error(), "validation") {
@@ -150,17 +494,49 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		email = user.Email
 	}
 
+	// Only the password and the address can be changed here; the role and
+	// the disabled flag are managed by staff
 	updatedUser := db.NewUser(username, newPassword, email)
 	updatedUser.Category = user.Category
+	updatedUser.Role = user.Role
+	updatedUser.Disabled = user.Disabled
+	// A new address has to be verified again
+	emailChanged := email != user.Email
+	updatedUser.Verified = user.Verified && !emailChanged
 
-	hashedPassword, err := db.HashPassword(updatedUser.Password)
-	if err != nil {
-		s.recordDBOperation("user_update", "error")
-		JSONError(w, "internal: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// Keep the current hash unless a new password was given
+	updatedUser.Password = user.Password
+	if newPassword != "" {
+		if err := db.ValidCredentials(username, newPassword); err != nil {
+			s.recordDBOperation("user_update", "error")
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.passwordPolicy.Check(newPassword, username, email); err != nil {
+			s.recordDBOperation("user_update", "error")
+			if !passwordPolicyError(w, err) {
+				JSONError(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
 
-	updatedUser.Password = hashedPassword
+		release, err := s.acquireHashSlot(r.Context())
+		if err != nil {
+			s.recordDBOperation("user_update", "error")
+			if !overloadError(w, err) {
+				JSONError(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		hashedPassword, err := db.HashPassword(newPassword)
+		release()
+		if err != nil {
+			s.recordDBOperation("user_update", "error")
+			JSONError(w, "internal: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updatedUser.Password = hashedPassword
+	}
 
 	if err := s.userRepo.UpdateUser(r.Context(), updatedUser); err != nil {
 		s.recordDBOperation("user_update", "error")
@@ -176,100 +552,1141 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.revokeUser(r.Context(), claims); err != nil {
+		log.Printf("Revoke tokens error: %v", err)
+	}
+
+	if emailChanged {
+		if err := s.sendVerification(r.Context(), updatedUser); err != nil {
+			log.Printf("update: send verification: %v", err)
+		}
+	}
+
 	s.recordDBOperation("user_update", "success")
 	s.userCache.Add(r.Context(), updatedUser)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte("User updated successfully"))
 }
 
-func (s *Server) handleGetAdsCategory(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	username, err := s.validateToken(r)
+	payload, err := parseJSON(r)
 	if err != nil {
-		JSONError(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
 		return
 	}
 
-	user, err := s.userCache.Get(r.Context(), username)
-	if err != nil {
-		user, err = s.userRepo.GetUser(r.Context(), username)
+	username := payload.getString("username")
+	if username == "" {
+		JSONError(w, "Bad request: username not provided", http.StatusBadRequest)
+		return
 	}
-	if err != nil {
-		log.Printf("Get user error: %v", err)
+
+	if err := s.forgotPassword(r.Context(), username); err != nil {
+		s.recordDBOperation("password_forgot", "error")
+		log.Printf("forgot password: %v", err)
 		JSONError(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	s.userCache.Extend(r.Context(), username)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"category": user.Category})
+	s.recordDBOperation("password_forgot", "success")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account exists, a reset link has been sent"))
 }
 
-func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	username, err := s.validateToken(r)
+	payload, err := parseJSON(r)
 	if err != nil {
-		s.recordDBOperation("user_delete", "error")
-		JSONError(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
 		return
 	}
 
-	if err := s.userRepo.DeleteUser(r.Context(), username); err != nil {
-		s.recordDBOperation("user_delete", "error")
-		log.Printf("Delete user error: %v", err)
-		JSONError(w, "Internal server error", http.StatusInternalServerError)
+	token := payload.getString("token")
+	newPassword := payload.getString("new_password")
+	if token == "" || newPassword == "" {
+		JSONError(w, "Bad request: token and new password required", http.StatusBadRequest)
 		return
 	}
 
-	s.recordDBOperation("user_delete", "success")
-	s.userCache.Delete(r.Context(), username)
-	w.Write([]byte("User deleted successfully"))
+	if err := s.resetPassword(r.Context(), token, newPassword); err != nil {
+		s.recordDBOperation("password_reset", "error")
+		log.Printf("reset password: %v", err)
+
+		if passwordPolicyError(w, err) || overloadError(w, err) {
+			return
+		}
+		if strings.Contains(err.Error(), "unauthorized") {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "validation") {
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("password_reset", "success")
+	w.Write([]byte("Password reset successfully"))
 }
 
-func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case http.MethodGet:
+		token = r.URL.Query().Get("token")
+	case http.MethodPost:
+		payload, err := parseJSON(r)
+		if err != nil {
+			JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+			return
+		}
+		token = payload.getString("token")
+	default:
 		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	rStats, err := s.userCache.Stats(r.Context())
-	if err != nil {
+	if token == "" {
+		JSONError(w, "Bad request: token not provided", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verifyEmail(r.Context(), token); err != nil {
+		s.recordDBOperation("email_verify", "error")
+		log.Printf("verify email: %v", err)
+
+		if strings.Contains(err.Error(), "unauthorized") {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if strings.Contains(err.Error(), "validation") || strings.Contains(err.Error(), "not found") {
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordDBOperation("email_verify", "success")
+	w.Write([]byte("Email verified successfully"))
+}
+
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeProfileWrite)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	user, err := s.userRepo.GetUser(r.Context(), username)
+	if err != nil {
+		log.Printf("Get user error: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if user.Verified {
+		JSONError(w, "Bad request: email already verified", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.sendVerification(r.Context(), user); err != nil {
+		log.Printf("resend verification: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Verification email sent"))
+}
+
+func (s *Server) handleGetAdsCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAdsRead)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	user, err := s.userCache.Get(r.Context(), username)
+	if err != nil {
+		user, err = s.userRepo.GetUser(r.Context(), username)
+	}
+	if err != nil {
+		log.Printf("Get user error: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.canGetAds(user) {
+		JSONError(w, "Forbidden: email not verified", http.StatusForbidden)
+		return
+	}
+
+	s.userCache.Extend(r.Context(), username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"category": user.Category})
+}
+
+// Profile is the caller's own account as returned by /v1/me
+type Profile struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Category int    `json:"category"`
+	Verified bool   `json:"verified"`
+	Role     string `json:"role"`
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeProfileRead)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		JSONError(w, "Not found: user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Get user error: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&Profile{
+		Username: user.Username,
+		Email:    user.Email,
+		Category: user.Category,
+		Verified: user.Verified,
+		Role:     user.Role,
+	})
+}
+
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := s.authorize(r, db.ScopeAccount)
+	if err != nil {
+		s.recordDBOperation("user_delete", "error")
+		authError(w, err)
+		return
+	}
+	username := claims.Username
+
+	if err := s.userRepo.DeleteUser(r.Context(), username); err != nil {
+		s.recordDBOperation("user_delete", "error")
+		log.Printf("Delete user error: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.revokeUser(r.Context(), claims); err != nil {
+		log.Printf("Revoke tokens error: %v", err)
+	}
+	if err := s.totpRepo.DeleteTOTP(r.Context(), username); err != nil {
+		log.Printf("Delete 2fa error: %v", err)
+	}
+	if err := s.apiKeys.DeleteUserAPIKeys(r.Context(), username); err != nil {
+		log.Printf("Delete api keys error: %v", err)
+	}
+	if err := s.passkeys.DeleteUserWebAuthnCredentials(r.Context(), username); err != nil {
+		log.Printf("Delete passkeys error: %v", err)
+	}
+
+	s.recordDBOperation("user_delete", "success")
+	s.userCache.Delete(r.Context(), username)
+	w.Write([]byte("User deleted successfully"))
+}
+
+// APIKeyInfo describes an API key without its secret
+type APIKeyInfo struct {
+	Prefix    string     `json:"prefix"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+func newAPIKeyInfo(key *db.APIKey) *APIKeyInfo {
+	info := &APIKeyInfo{
+		Prefix:    key.Prefix,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+	if !key.LastUsed.IsZero() {
+		info.LastUsed = &key.LastUsed
+	}
+	return info
+}
+
+// handleAPIKeys lists the caller's API keys (GET) or creates one (POST)
+func (s *Server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// API keys cannot manage API keys
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		keys, err := s.apiKeys.ListAPIKeys(r.Context(), username)
+		if err != nil {
+			log.Printf("list api keys: %v", err)
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		infos := make([]*APIKeyInfo, len(keys))
+		for i, key := range keys {
+			infos[i] = newAPIKeyInfo(key)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*APIKeyInfo{"api_keys": infos})
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	ttl := APIKeyDuration
+	if days := payload.getInt("expires_in_days", 0); days != 0 {
+		ttl = time.Duration(days) * 24 * time.Hour
+	}
+
+	key, keyStr, err := s.createAPIKey(r.Context(), username, payload.getString("name"), payload.getStrings("scopes"), ttl)
+	if err != nil {
+		s.recordDBOperation("api_key_create", "error")
+		log.Printf("create api key: %v", err)
+
+		if strings.Contains(err.Error(), "validation") {
+			JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("api key %s created for %s", key.Prefix, username)
+	s.recordDBOperation("api_key_create", "success")
+
+	// The key itself is only ever returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Key string `json:"key"`
+		*APIKeyInfo
+	}{keyStr, newAPIKeyInfo(key)})
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	prefix := r.PathValue("prefix")
+	if err := s.revokeAPIKey(r.Context(), username, prefix); err != nil {
+		s.recordDBOperation("api_key_revoke", "error")
+		log.Printf("revoke api key: %v", err)
+
+		if strings.Contains(err.Error(), "not found") {
+			JSONError(w, "Not found: api key not found", http.StatusNotFound)
+		} else {
+			JSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("api key %s revoked by %s", prefix, username)
+	s.recordDBOperation("api_key_revoke", "success")
+	w.Write([]byte("API key revoked successfully"))
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rStats, err := s.userCache.Stats(r.Context())
+	if err != nil {
 		log.Printf("Stats error: %v", err)
 		JSONError(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(rStats)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rStats)
+}
+
+func (s *Server) handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := claimsFromContext(r.Context()).Username
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	username := payload.getString("username")
+	if username == "" {
+		JSONError(w, "Bad request: username not provided", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.unlockAccount(r.Context(), username); err != nil {
+		s.recordDBOperation("account_unlock", "error")
+		log.Printf("unlock: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("account %s unlocked by %s", username, admin)
+	s.recordDBOperation("account_unlock", "success")
+	w.Write([]byte("Account unlocked successfully"))
+}
+
+// PasskeyInfo describes a passkey to its owner
+type PasskeyInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+}
+
+func newPasskeyInfo(cred *db.WebAuthnCredential) *PasskeyInfo {
+	info := &PasskeyInfo{
+		ID:         cred.ID,
+		Name:       cred.Name,
+		Transports: cred.Transports,
+		CreatedAt:  cred.CreatedAt,
+	}
+	if !cred.LastUsed.IsZero() {
+		info.LastUsed = &cred.LastUsed
+	}
+	return info
+}
+
+// passkeyError maps errors of the passkey ceremonies to a response
+func passkeyError(w http.ResponseWriter, err error) {
+	switch {
+	case strings.Contains(err.Error(), "validation"):
+		JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+	case strings.Contains(err.Error(), "unauthorized"):
+		JSONError(w, "Unauthorized: passkey verification failed", http.StatusUnauthorized)
+	case strings.Contains(err.Error(), "forbidden"):
+		JSONError(w, err.Error(), http.StatusForbidden)
+	case strings.Contains(err.Error(), "not found"):
+		JSONError(w, "Not found: "+err.Error(), http.StatusNotFound)
+	default:
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handlePasskeyRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	options, err := s.passkeyRegistrationOptions(r.Context(), username)
+	if err != nil {
+		log.Printf("passkey register options: %v", err)
+		passkeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*webauthn.CreationOptions{"publicKey": options})
+}
+
+func (s *Server) handlePasskeyRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	var req struct {
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.recordDBOperation("passkey_register", "error")
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	cred, err := s.registerPasskey(r.Context(), username, req.Name, &req.Credential)
+	if err != nil {
+		s.recordDBOperation("passkey_register", "error")
+		log.Printf("passkey register: %v", err)
+		passkeyError(w, err)
+		return
+	}
+
+	log.Printf("passkey %s registered for %s", cred.ID, username)
+	s.recordDBOperation("passkey_register", "success")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newPasskeyInfo(cred))
+}
+
+func (s *Server) handlePasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The body is optional; without a username any discoverable passkey works
+	payload, _ := parseJSON(r)
+	options, err := s.passkeyLoginOptions(r.Context(), payload.getString("username"))
+	if err != nil {
+		log.Printf("passkey login options: %v", err)
+		passkeyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*webauthn.RequestOptions{"publicKey": options})
+}
+
+func (s *Server) handlePasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Credential webauthn.AssertionResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.recordDBOperation("user_login_passkey", "error")
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.loginPasskey(r.Context(), &req.Credential, s.newSession(r))
+	if err != nil {
+		s.recordDBOperation("user_login_passkey", "error")
+		log.Printf("login passkey: %v", err)
+		passkeyError(w, err)
+		return
+	}
+
+	s.recordDBOperation("user_login_passkey", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) handlePasskeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	creds, err := s.passkeys.ListWebAuthnCredentials(r.Context(), username)
+	if err != nil {
+		log.Printf("list passkeys: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]*PasskeyInfo, len(creds))
+	for i, cred := range creds {
+		infos[i] = newPasskeyInfo(cred)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*PasskeyInfo{"passkeys": infos})
+}
+
+func (s *Server) handleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	if err := s.deletePasskey(r.Context(), username, r.PathValue("id")); err != nil {
+		s.recordDBOperation("passkey_delete", "error")
+		log.Printf("delete passkey: %v", err)
+		passkeyError(w, err)
+		return
+	}
+
+	log.Printf("passkey %s of %s deleted", r.PathValue("id"), username)
+	s.recordDBOperation("passkey_delete", "success")
+	w.Write([]byte("Passkey deleted successfully"))
+}
+
+// SessionInfo describes a session to its owner
+type SessionInfo struct {
+	*db.Session
+	// Current marks the session of the request
+	Current bool `json:"current"`
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := s.authorize(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	sessions, err := s.listSessions(r.Context(), claims.Username)
+	if err != nil {
+		s.recordDBOperation("session_list", "error")
+		log.Printf("list sessions: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	infos := make([]*SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = &SessionInfo{Session: session, Current: session.ID == claims.SessionID}
+	}
+
+	s.recordDBOperation("session_list", "success")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*SessionInfo{"sessions": infos})
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := s.validateToken(r, db.ScopeAccount)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+
+	if err := s.revokeSession(r.Context(), username, r.PathValue("id")); err != nil {
+		s.recordDBOperation("session_revoke", "error")
+		if errors.Is(err, db.ErrSessionNotFound) {
+			JSONError(w, "Not found: session not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("revoke session: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordDBOperation("session_revoke", "success")
+	w.Write([]byte("Session revoked successfully"))
+}
+
+// AdminUser is the view of an account returned by the admin endpoints
+type AdminUser struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Category int    `json:"category"`
+	Verified bool   `json:"verified"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+}
+
+func newAdminUser(user *db.User) *AdminUser {
+	return &AdminUser{
+		Username: user.Username,
+		Email:    user.Email,
+		Category: user.Category,
+		Verified: user.Verified,
+		Role:     user.Role,
+		Disabled: user.Disabled,
+	}
+}
+
+// adminError maps errors of the admin operations to a response
+func adminError(w http.ResponseWriter, err error) {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		JSONError(w, "Not found: user not found", http.StatusNotFound)
+	case strings.Contains(err.Error(), "validation"):
+		JSONError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+	case strings.Contains(err.Error(), "forbidden"):
+		authError(w, err)
+	default:
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			JSONError(w, "Bad request: limit must be 1-500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	pageState, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("page"))
+	if err != nil {
+		JSONError(w, "Bad request: invalid page", http.StatusBadRequest)
+		return
+	}
+
+	users, next, err := s.userRepo.ListUsers(r.Context(), limit, pageState)
+	if err != nil {
+		s.recordDBOperation("admin_list_users", "error")
+		log.Printf("admin list users: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.recordDBOperation("admin_list_users", "success")
+
+	response := struct {
+		Users    []*AdminUser `json:"users"`
+		NextPage string       `json:"next_page,omitempty"`
+	}{
+		Users:    make([]*AdminUser, len(users)),
+		NextPage: base64.RawURLEncoding.EncodeToString(next),
+	}
+	for i, user := range users {
+		response.Users[i] = newAdminUser(user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+	user, err := s.userRepo.GetUser(r.Context(), username)
+	if err != nil {
+		log.Printf("admin get user: %v", err)
+		adminError(w, err)
+		return
+	}
+
+	attempts, err := s.attempts.Get(r.Context(), username)
+	if err != nil {
+		log.Printf("admin get user: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	twoFactor, err := s.totpEnabled(r.Context(), username)
+	if err != nil {
+		log.Printf("admin get user: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		*AdminUser
+		TwoFactor    bool       `json:"two_factor"`
+		FailedLogins int        `json:"failed_logins"`
+		LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	}{
+		AdminUser:    newAdminUser(user),
+		TwoFactor:    twoFactor,
+		FailedLogins: attempts.Failures,
+	}
+	if attempts.LockedUntil.After(time.Now()) {
+		response.LockedUntil = &attempts.LockedUntil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAdminSetDisabled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	admin := claimsFromContext(r.Context()).Username
+	username := r.PathValue("username")
+	disabled := payload.getBool("disabled", true)
+
+	if err := s.setDisabled(r.Context(), admin, username, disabled); err != nil {
+		s.recordDBOperation("admin_set_disabled", "error")
+		log.Printf("admin set disabled: %v", err)
+		adminError(w, err)
+		return
+	}
+
+	log.Printf("account %s disabled=%t by %s", username, disabled, admin)
+	s.recordDBOperation("admin_set_disabled", "success")
+	if disabled {
+		w.Write([]byte("Account disabled successfully"))
+	} else {
+		w.Write([]byte("Account enabled successfully"))
+	}
+}
+
+func (s *Server) handleAdminSetCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	category := payload.getInt("category", -1)
+	if category < 0 {
+		JSONError(w, "Bad request: category not provided", http.StatusBadRequest)
+		return
+	}
+
+	admin := claimsFromContext(r.Context()).Username
+	username := r.PathValue("username")
+
+	if err := s.setCategory(r.Context(), username, category); err != nil {
+		s.recordDBOperation("admin_set_category", "error")
+		log.Printf("admin set category: %v", err)
+		adminError(w, err)
+		return
+	}
+
+	log.Printf("account %s moved to category %d by %s", username, category, admin)
+	s.recordDBOperation("admin_set_category", "success")
+	w.Write([]byte("Category updated successfully"))
+}
+
+func (s *Server) handleAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	admin := claimsFromContext(r.Context()).Username
+	username := r.PathValue("username")
+	role := payload.getString("role")
+
+	if err := s.setRole(r.Context(), admin, username, role); err != nil {
+		s.recordDBOperation("admin_set_role", "error")
+		log.Printf("admin set role: %v", err)
+		adminError(w, err)
+		return
+	}
+
+	log.Printf("account %s given role %s by %s", username, role, admin)
+	s.recordDBOperation("admin_set_role", "success")
+	w.Write([]byte("Role updated successfully"))
+}
+
+func (s *Server) handleAdminImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := parseJSON(r)
+	if err != nil {
+		JSONError(w, "Bad request: invalid json", http.StatusBadRequest)
+		return
+	}
+
+	admin := claimsFromContext(r.Context())
+	token, err := s.impersonate(r.Context(), admin, r.PathValue("username"), payload.getString("reason"), s.getClientIP(r))
+	if err != nil {
+		s.recordDBOperation("admin_impersonate", "error")
+		log.Printf("admin impersonate: %v", err)
+		adminError(w, err)
+		return
+	}
+
+	s.recordDBOperation("admin_impersonate", "success")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&TokenResponse{
+		Token:     token,
+		ExpiresIn: int(ImpersonationDuration.Seconds()),
+	})
+}
+
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events, err := s.audit.ListAuditEvents(r.Context(), r.PathValue("username"), 100)
+	if err != nil {
+		s.recordDBOperation("admin_audit", "error")
+		log.Printf("admin audit: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.recordDBOperation("admin_audit", "success")
+
+	if events == nil {
+		events = []*db.AuditEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*db.AuditEvent{"events": events})
+}
+
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bans, err := s.bans.List(r.Context())
+	if err != nil {
+		s.recordDBOperation("admin_list_bans", "error")
+		log.Printf("admin list bans: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.recordDBOperation("admin_list_bans", "success")
+
+	if bans == nil {
+		bans = []*db.Ban{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*db.Ban{"bans": bans})
+}
+
+func (s *Server) handleAdminLiftBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := claimsFromContext(r.Context()).Username
+
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		JSONError(w, "Bad request: invalid IP address", http.StatusBadRequest)
+		return
+	}
+	ip := addr.Unmap().String()
+
+	if err := s.liftBan(r.Context(), ip); err != nil {
+		s.recordDBOperation("admin_lift_ban", "error")
+		if errors.Is(err, db.ErrBanNotFound) {
+			JSONError(w, "Not found: ban not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("lift ban: %v", err)
+		JSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("ban of %s lifted by %s", ip, admin)
+	s.recordDBOperation("admin_lift_ban", "success")
+	w.Write([]byte("Ban lifted successfully"))
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		JSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.jwtmanager.JWKS())
+}
+
+// defaultConfigPath is read when CONFIG_PATH is unset, if it exists
+const defaultConfigPath = "config.yaml"
+
+// loadConfig reads the file at CONFIG_PATH, or config.yaml when present,
+// and the environment overrides on top of it
+func loadConfig() (*config.Config, error) {
+	path := os.Getenv("CONFIG_PATH")
+	if path == "" {
+		if _, err := os.Stat(defaultConfigPath); err == nil {
+			path = defaultConfigPath
+		}
+	}
+	return config.Load(path)
 }
 
 func main() {
-	server, err := NewServer()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	server, err := NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Server initialization failed: %v", err)
 	}
 
+	// Each middleware wraps the ones before it, so CORS runs first and the
+	// dashboard can read rejections by the rate limiter and IP filter too
 	middleware := []func(http.HandlerFunc) http.HandlerFunc{
-		server.corsMiddleware,
 		server.metricsMiddleware,
 		server.rateLimitMiddleware,
+		server.ipFilterMiddleware,
+		server.clientIPMiddleware,
+		server.corsMiddleware,
 	}
 
 	routes := map[string]http.HandlerFunc{
-		"/v1/login":    server.handleLogin,
-		"/v1/register": server.handleRegister,
-		"/v1/update":   server.handleUpdateUser,
-		"/v1/delete":   server.handleDeleteUser,
-		"/v1/stats":    server.handleStats,
-		"/v1/get_ads":  server.handleGetAdsCategory,
+		"/v1/login":         server.handleLogin,
+		"/v1/login/2fa":     server.handleLoginTOTP,
+		"/v1/2fa/enroll":    server.handleTOTPEnroll,
+		"/v1/2fa/activate":  server.handleTOTPActivate,
+		"/v1/token/refresh": server.handleRefreshToken,
+		"/v1/logout":        server.handleLogout,
+		"/v1/register":      server.handleRegister,
+
+		"/v1/login/magic":        server.handleMagicLink,
+		"/v1/login/magic/redeem": server.handleMagicLinkRedeem,
+
+		"/v1/password/forgot": server.handleForgotPassword,
+		"/v1/password/reset":  server.handleResetPassword,
+
+		"/v1/verify_email":        server.handleVerifyEmail,
+		"/v1/verify_email/resend": server.handleResendVerification,
+
+		"/v1/update":  server.handleUpdateUser,
+		"/v1/delete":  server.handleDeleteUser,
+		"/v1/get_ads": server.handleGetAdsCategory,
+		"/v1/me":      server.handleMe,
+
+		"/v1/api_keys":          server.handleAPIKeys,
+		"/v1/api_keys/{prefix}": server.handleRevokeAPIKey,
+
+		"/v1/sessions":      server.handleSessions,
+		"/v1/sessions/{id}": server.handleRevokeSession,
+
+		"/v1/webauthn/register/options": server.handlePasskeyRegisterOptions,
+		"/v1/webauthn/register":         server.handlePasskeyRegister,
+		"/v1/webauthn/login/options":    server.handlePasskeyLoginOptions,
+		"/v1/webauthn/login":            server.handlePasskeyLogin,
+		"/v1/webauthn/credentials":      server.handlePasskeys,
+		"/v1/webauthn/credentials/{id}": server.handleDeletePasskey,
+
+		"/v1/stats":        server.requireRole(db.RoleAdmin, server.handleStats),
+		"/v1/admin/unlock": server.requireRole(db.RoleSupport, server.handleAdminUnlock),
+
+		"/v1/admin/bans":      server.requireRole(db.RoleSupport, server.handleAdminBans),
+		"/v1/admin/bans/{ip}": server.requireRole(db.RoleSupport, server.handleAdminLiftBan),
+
+		"/v1/admin/users":                        server.requireRole(db.RoleSupport, server.handleAdminListUsers),
+		"/v1/admin/users/{username}":             server.requireRole(db.RoleSupport, server.handleAdminGetUser),
+		"/v1/admin/users/{username}/category":    server.requireRole(db.RoleSupport, server.handleAdminSetCategory),
+		"/v1/admin/users/{username}/disable":     server.requireRole(db.RoleAdmin, server.handleAdminSetDisabled),
+		"/v1/admin/users/{username}/role":        server.requireRole(db.RoleAdmin, server.handleAdminSetRole),
+		"/v1/admin/users/{username}/audit":       server.requireRole(db.RoleSupport, server.handleAdminAudit),
+		"/v1/admin/users/{username}/impersonate": server.requireRole(db.RoleAdmin, server.handleAdminImpersonate),
+
+		"/.well-known/jwks.json": server.handleJWKS,
+
+		"/.well-known/openid-configuration": server.oidcProvider.HandleDiscovery,
+		"/oauth/authorize":                  server.oidcProvider.HandleAuthorize,
+		"/oauth/token":                      server.oidcProvider.HandleToken,
+		"/userinfo":                         server.oidcProvider.HandleUserInfo,
+		"/v1/introspect":                    server.oidcProvider.HandleIntrospect,
 	}
 
 	for path, handler := range routes {
@@ -284,14 +1701,14 @@ func main() {
 		mux.HandleFunc(path, handler)
 	}
 
-	certDir := getEnvOrDefault("TLS_CERT_DIR", "../certs")
+	certDir := cfg.Server.TLSCertDir
 
 	go func() {
 		metricsMux := http.NewServeMux()
 		metricsMux.Handle("/metrics", promhttp.Handler())
 
-		fmt.Println("Metrics server starting on port :8080")
-		log.Fatal(http.ListenAndServeTLS("0.0.0.0:8080", certDir+"/server.crt", certDir+"/server.key", metricsMux))
+		fmt.Printf("Metrics server starting on %s\n", cfg.Server.MetricsAddr)
+		log.Fatal(http.ListenAndServeTLS(cfg.Server.MetricsAddr, certDir+"/server.crt", certDir+"/server.key", metricsMux))
 	}()
 
 	go func() {
@@ -301,8 +1718,22 @@ func main() {
 		}
 	}()
 
-	port := ":8443"
+	go server.ipFilter.Watch(context.Background(), ipListsReloadInterval, func(err error) {
+		log.Printf("reload IP lists: %v, keeping the previous lists", err)
+	})
+
+	listener, err := net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		log.Fatalf("Listen on %s failed: %v", cfg.Server.Addr, err)
+	}
+
+	// Load balancers that speak the PROXY protocol send the client address
+	// ahead of the TLS handshake; only trusted proxies are expected to
+	if cfg.Server.ProxyProtocol {
+		listener = clientip.NewProxyListener(listener, server.clientIPs)
+	}
 
-	fmt.Printf("Server starting on port %s with rate limiting (100 req/min per IP)\n", port)
-	log.Fatal(http.ListenAndServeTLS(port, certDir+"/server.crt", certDir+"/server.key", mux))
+	fmt.Printf("Server starting on %s with rate limiting\n", cfg.Server.Addr)
+	httpServer := &http.Server{Handler: mux}
+	log.Fatal(httpServer.ServeTLS(listener, certDir+"/server.crt", certDir+"/server.key"))
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"internal/db"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpdateUserKeepsRole(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "admin", "admin@example.com", true)
+	admin := ts.repo.users["admin"]
+	admin.Role = db.RoleAdmin
+	ts.repo.users["admin"] = admin
+
+	w := call(ts.handleUpdateUser, http.MethodPost, "/v1/update",
+		map[string]string{"password": testPassword, "new_password": "Velvet-Harbor-77"}, ts.login(t, "admin"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", w.Code, w.Body)
+	}
+
+	user, _ := ts.userRepo.GetUser(context.Background(), "admin")
+	if user.Role != db.RoleAdmin || user.Disabled {
+		t.Fatalf("Expected the admin role to survive the update, got %+v", user)
+	}
+	if cached, err := ts.userCache.Get(context.Background(), "admin"); err == nil && cached.Role != db.RoleAdmin {
+		t.Fatalf("Expected the cached user to keep the admin role, got %q", cached.Role)
+	}
+}
+
+func TestUpdateUserRejectsLongPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+
+	w := call(ts.handleUpdateUser, http.MethodPost, "/v1/update",
+		map[string]string{"password": testPassword, "new_password": strings.Repeat("Velvet-Harbor-77", 64)}, ts.login(t, testUsername))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "password too long") {
+		t.Fatalf("Expected 400 for a password over the maximum length, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUpdateUserCountsWrongPasswords(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	token := ts.login(t, testUsername)
+
+	update := func(password string) int {
+		w := call(ts.handleUpdateUser, http.MethodPost, "/v1/update",
+			map[string]string{"password": password, "email": "new@example.com"}, token)
+		return w.Code
+	}
+
+	for i := 0; i < db.NewLockoutPolicy().BackoffAfter; i++ {
+		if code := update("wrong-password"); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for guess %d, got %d", i+1, code)
+		}
+	}
+
+	// Guessing through /v1/update backs off like logins do
+	if code := update("wrong-password"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 while backing off, got %d", code)
+	}
+	w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": testPassword}, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected logins to back off as well, got %d", w.Code)
+	}
+}
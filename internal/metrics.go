@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"internal/concurrency"
 	"net/http"
 	"strconv"
 	"time"
@@ -39,7 +40,53 @@ var (
 			Name: "rate_limit_hits_total",
 			Help: "Number of rate limit hits",
 		},
-		[]string{"client_ip"},
+		[]string{"client_ip", "policy"},
+	)
+
+	ipBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ip_blocked_total",
+			Help: "Requests rejected by the IP denylist or a ban",
+		},
+		[]string{"reason"},
+	)
+
+	ipBans = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ip_bans_total",
+			Help: "Client addresses banned after repeated rate limit violations",
+		},
+	)
+
+	hashRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "password_hash_rejected_total",
+			Help: "Password operations shed because hashing was saturated",
+		},
+		[]string{"reason"},
+	)
+
+	accountLockouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "account_lockouts_total",
+			Help: "Number of accounts locked after repeated failed logins",
+		},
+	)
+
+	loginThrottled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "login_throttled_total",
+			Help: "Login attempts rejected by the per-account lockout policy",
+		},
+		[]string{"reason"},
+	)
+
+	accessDenied = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "access_denied_total",
+			Help: "Requests rejected for lacking the required role",
+		},
+		[]string{"required_role"},
 	)
 
 	dbOperations = promauto.NewCounterVec(
@@ -91,10 +138,60 @@ func (s *Server) updateActiveUsersMetric() {
 	}
 }
 
-func (s *Server) recordRateLimit(clientIP string) {
-	rateLimitHits.WithLabelValues(clientIP).Inc()
+// registerHashLimiterMetrics exposes the state of the password hashing
+// limiter, read at every scrape
+func registerHashLimiterMetrics(limiter *concurrency.Limiter) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "password_hash_queue_depth",
+			Help: "Password operations waiting for a hashing slot",
+		},
+		func() float64 { return float64(limiter.Stats().Queued) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "password_hash_in_flight",
+			Help: "Password operations being hashed or verified",
+		},
+		func() float64 { return float64(limiter.Stats().InFlight) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "password_hash_concurrency_limit",
+			Help: "Current adaptive limit of concurrent password operations",
+		},
+		func() float64 { return float64(limiter.Stats().Limit) },
+	)
+}
+
+func (s *Server) recordRateLimit(clientIP, policy string) {
+	rateLimitHits.WithLabelValues(clientIP, policy).Inc()
+}
+
+func (s *Server) recordBlocked(reason string) {
+	ipBlocked.WithLabelValues(reason).Inc()
+}
+
+func (s *Server) recordBan() {
+	ipBans.Inc()
+}
+
+func (s *Server) recordHashRejected(reason string) {
+	hashRejected.WithLabelValues(reason).Inc()
 }
 
 func (s *Server) recordDBOperation(operation, status string) {
 	dbOperations.WithLabelValues(operation, status).Inc()
 }
+
+func (s *Server) recordLockout() {
+	accountLockouts.Inc()
+}
+
+func (s *Server) recordLoginThrottled(reason string) {
+	loginThrottled.WithLabelValues(reason).Inc()
+}
+
+func (s *Server) recordAccessDenied(requiredRole string) {
+	accessDenied.WithLabelValues(requiredRole).Inc()
+}
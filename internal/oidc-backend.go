@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"internal/oidc"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// oidcBackend lets the OpenID Connect provider sign users in and issue
+// tokens through the server's own authentication and JWTManager
+type oidcBackend struct {
+	s *Server
+}
+
+var _ oidc.Backend = (*oidcBackend)(nil)
+
+// SessionUser only accepts login sessions, so a client token or an API
+// key can never authorize another client
+func (b *oidcBackend) SessionUser(r *http.Request) (string, error) {
+	return b.s.validateToken(r, db.ScopeAccount)
+}
+
+func (b *oidcBackend) TokenUser(r *http.Request) (string, []string, error) {
+	claims, err := b.s.authenticate(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if claims.Scope == "" && claims.Purpose != PurposeAPIKey {
+		return claims.Username, nil, nil
+	}
+	return claims.Username, strings.Fields(claims.Scope), nil
+}
+
+func (b *oidcBackend) Identity(ctx context.Context, username string) (*oidc.Identity, error) {
+	user, err := b.s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	return &oidc.Identity{
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.Verified,
+	}, nil
+}
+
+func (b *oidcBackend) IssueAccessToken(ctx context.Context, username, clientID string, scopes []string) (string, time.Duration, error) {
+	token, err := b.s.jwtmanager.CreateClientToken(username, clientID, scopes)
+	return token, b.s.jwtmanager.duration, err
+}
+
+// SignIDToken marks the token with PurposeIDToken, so that it is never
+// accepted as an access token
+func (b *oidcBackend) SignIDToken(claims *oidc.IDTokenClaims) (string, error) {
+	return b.s.jwtmanager.sign(struct {
+		*oidc.IDTokenClaims
+		Purpose string `json:"purpose"`
+	}{claims, PurposeIDToken})
+}
+
+// sessionScopes are the scopes of a login session, which is unrestricted
+var sessionScopes = []string{db.ScopeAccount, db.ScopeAdsRead, db.ScopeProfileRead, db.ScopeProfileWrite}
+
+func (b *oidcBackend) IntrospectToken(ctx context.Context, token string) (*oidc.TokenInfo, error) {
+	var claims *JWTClaims
+	var err error
+	if _, _, parseErr := db.ParseAPIKey(token); parseErr == nil {
+		claims, err = b.s.authenticateAPIKey(ctx, token)
+	} else {
+		claims, err = b.s.authenticateBearer(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &oidc.TokenInfo{
+		Username:  claims.Username,
+		Scopes:    strings.Fields(claims.Scope),
+		TokenType: "access_token",
+		ExpiresAt: claims.ExpiresAt.Time,
+	}
+	if claims.IssuedAt != nil {
+		info.IssuedAt = claims.IssuedAt.Time
+	}
+	if len(claims.Audience) > 0 {
+		info.ClientID = claims.Audience[0]
+	}
+	if claims.Actor != nil {
+		info.Actor = claims.Actor.Subject
+	}
+	if claims.Purpose == PurposeAPIKey {
+		info.TokenType = "api_key"
+	} else if claims.Scope == "" {
+		info.Scopes = sessionScopes
+	}
+
+	return info, nil
+}
+
+// newOIDCClients loads the client registry from path. Without the file
+// no client can use the provider.
+func newOIDCClients(path string) (oidc.ClientRegistry, error) {
+	clients, err := oidc.LoadClientRegistry(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("oauth client registry %s not found, no OpenID Connect clients registered", path)
+		return oidc.NewStaticClientRegistry(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"internal/oidc"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIDTokenIsNotAnAccessToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	backend := &oidcBackend{s: ts.Server}
+
+	now := time.Now()
+	idToken, err := backend.SignIDToken(&oidc.IDTokenClaims{
+		PreferredUsername: testUsername,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   testUsername,
+			Audience:  jwt.ClaimStrings{"dashboard"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to sign ID token: %v", err)
+	}
+
+	if w := call(ts.handleMe, http.MethodGet, "/v1/me", nil, idToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an ID token to be rejected, got %d %s", w.Code, w.Body)
+	}
+
+	// A token without a username is no access token either
+	claims, _ := ts.jwtmanager.newClaims("", time.Hour)
+	anonymous, _ := ts.jwtmanager.sign(claims)
+	if w := call(ts.handleMe, http.MethodGet, "/v1/me", nil, anonymous); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a token without username to be rejected, got %d %s", w.Code, w.Body)
+	}
+
+	if w := call(ts.handleMe, http.MethodGet, "/v1/me", nil, ts.login(t, testUsername)); w.Code != http.StatusOK {
+		t.Fatalf("Expected the access token to work, got %d %s", w.Code, w.Body)
+	}
+}
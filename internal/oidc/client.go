@@ -0,0 +1,104 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var ErrClientNotFound = errors.New("not found: oauth client not found")
+
+// Client is an application allowed to log users in through the provider
+type Client struct {
+	ID   string `json:"client_id"`
+	Name string `json:"name"`
+	// SecretHash is the sha256 hex of the client secret; public clients
+	// such as SPAs and mobile apps have none and rely on PKCE alone
+	SecretHash   string   `json:"client_secret_sha256,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// FirstParty clients are our own apps; users are not asked for consent
+	FirstParty bool `json:"first_party"`
+}
+
+// Public reports whether the client cannot keep a secret
+func (c *Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+// CheckSecret compares secret against the stored hash
+func (c *Client) CheckSecret(secret string) bool {
+	if c.Public() {
+		return false
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(c.SecretHash)) == 1
+}
+
+// RedirectURI checks a requested redirect URI, which has to match a
+// registered one exactly. An empty request selects the only registered URI.
+func (c *Client) RedirectURI(requested string) (string, bool) {
+	if requested == "" {
+		if len(c.RedirectURIs) == 1 {
+			return c.RedirectURIs[0], true
+		}
+		return "", false
+	}
+	return requested, slices.Contains(c.RedirectURIs, requested)
+}
+
+// ClientRegistry looks up registered clients
+type ClientRegistry interface {
+	GetClient(ctx context.Context, clientID string) (*Client, error)
+}
+
+// StaticClientRegistry is a ClientRegistry fixed at startup
+type StaticClientRegistry struct {
+	clients map[string]*Client
+}
+
+var _ ClientRegistry = (*StaticClientRegistry)(nil)
+
+// NewStaticClientRegistry registers the given clients
+func NewStaticClientRegistry(clients ...*Client) *StaticClientRegistry {
+	registry := &StaticClientRegistry{clients: make(map[string]*Client)}
+	for _, client := range clients {
+		registry.clients[client.ID] = client
+	}
+	return registry
+}
+
+// LoadClientRegistry reads a JSON array of clients
+func LoadClientRegistry(path string) (*StaticClientRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*Client
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, client := range clients {
+		if client.ID == "" || len(client.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("%s: client %q needs a client_id and redirect_uris", path, client.ID)
+		}
+	}
+
+	return NewStaticClientRegistry(clients...), nil
+}
+
+// GetClient returns the client registered as clientID
+func (r *StaticClientRegistry) GetClient(ctx context.Context, clientID string) (*Client, error) {
+	client, ok := r.clients[clientID]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
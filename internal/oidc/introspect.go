@@ -0,0 +1,82 @@
+package oidc
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenInfo describes an active token for introspection
+type TokenInfo struct {
+	Username string
+	// ClientID is the client the token was issued to, empty for login
+	// sessions and API keys
+	ClientID string
+	Scopes   []string
+	// TokenType is "access_token" or "api_key"
+	TokenType string
+	// Actor is the staff member behind an impersonation token
+	Actor     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// HandleIntrospect serves RFC 7662 token introspection. Only confidential
+// clients may call it; tokens that are expired, revoked or unknown are
+// reported as {"active": false} without saying why.
+func (p *Provider) HandleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+
+	client, err := p.authenticateClient(r)
+	if err != nil || client.Public() {
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	// token_type_hint is optional and only an optimisation, so it is ignored
+	info, err := p.backend.IntrospectToken(r.Context(), token)
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+
+	response := map[string]any{
+		"active":     true,
+		"sub":        info.Username,
+		"username":   info.Username,
+		"scope":      strings.Join(info.Scopes, " "),
+		"token_type": info.TokenType,
+		"iss":        p.config.Issuer,
+		"exp":        info.ExpiresAt.Unix(),
+	}
+	if !info.IssuedAt.IsZero() {
+		response["iat"] = info.IssuedAt.Unix()
+	}
+	if info.ClientID != "" {
+		response["client_id"] = info.ClientID
+		response["aud"] = info.ClientID
+	}
+	if info.Actor != "" {
+		response["act"] = map[string]string{"sub": info.Actor}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,542 @@
+// Package oidc implements a minimal OpenID Connect provider: the
+// authorization code flow with PKCE (S256 only), discovery, the token
+// endpoint, userinfo and token introspection. Users, tokens and signing are supplied by a
+// Backend, so the provider can run in-process against test doubles.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"internal/db"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes defined by OpenID Connect
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// Config describes the provider
+type Config struct {
+	// Issuer is the iss of ID tokens and the base of the endpoint URLs
+	Issuer string
+	// LoginURL is the frontend page that signs the user in and asks for
+	// consent, then posts the authorization request back
+	LoginURL string
+	// SigningAlg is the JWS algorithm of ID tokens, for discovery
+	SigningAlg string
+	// Scopes clients may request
+	Scopes []string
+	// CodeDuration is how long an authorization code can be redeemed
+	CodeDuration time.Duration
+}
+
+// NewConfig returns a configuration with the standard scopes
+func NewConfig(issuer, loginURL, signingAlg string) *Config {
+	return &Config{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		LoginURL:     loginURL,
+		SigningAlg:   signingAlg,
+		Scopes:       []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		CodeDuration: time.Minute,
+	}
+}
+
+// Identity is what the provider may tell clients about a user
+type Identity struct {
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+// IDTokenClaims are the claims of an ID token
+type IDTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time,omitempty"`
+	AuthorizedParty   string `json:"azp,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Backend connects the provider to the user store and token signing
+type Backend interface {
+	// SessionUser returns the user of a login session. Tokens issued to
+	// clients and API keys must be rejected.
+	SessionUser(r *http.Request) (string, error)
+	// TokenUser returns the user of any access token and its scopes; nil
+	// scopes mean an unrestricted login session
+	TokenUser(r *http.Request) (string, []string, error)
+	Identity(ctx context.Context, username string) (*Identity, error)
+	// IssueAccessToken returns an access token for clientID limited to scopes
+	IssueAccessToken(ctx context.Context, username, clientID string, scopes []string) (string, time.Duration, error)
+	SignIDToken(claims *IDTokenClaims) (string, error)
+	// IntrospectToken describes an access token or API key; any error
+	// makes the token inactive
+	IntrospectToken(ctx context.Context, token string) (*TokenInfo, error)
+}
+
+// Provider serves the OpenID Connect endpoints
+type Provider struct {
+	config  *Config
+	clients ClientRegistry
+	// codes maps authorization codes to their JSON encoded grant
+	codes   db.OneTimeTokenStore
+	backend Backend
+}
+
+// NewProvider creates a provider; codes should expire after config.CodeDuration
+func NewProvider(config *Config, clients ClientRegistry, codes db.OneTimeTokenStore, backend Backend) *Provider {
+	return &Provider{config: config, clients: clients, codes: codes, backend: backend}
+}
+
+// grant is what an authorization code stands for
+type grant struct {
+	ClientID      string   `json:"client_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Username      string   `json:"username"`
+	Scopes        []string `json:"scopes"`
+	Nonce         string   `json:"nonce,omitempty"`
+	CodeChallenge string   `json:"code_challenge"`
+	AuthTime      int64    `json:"auth_time"`
+	// RedirectURIRequested is set when the authorization request named the
+	// redirect URI, which the token request then has to repeat (RFC 6749 4.1.3)
+	RedirectURIRequested bool `json:"redirect_uri_requested,omitempty"`
+}
+
+// authRequest holds the parameters of an authorization request, from the
+// query string (GET) or a JSON body (POST)
+type authRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	// Consent is the user's answer for third-party clients; nil if not asked yet
+	Consent *bool `json:"consent"`
+}
+
+// oauthError is an error reported to the client as in RFC 6749 section 4.1.2.1
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+// HandleDiscovery serves /.well-known/openid-configuration
+func (p *Provider) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.config.Issuer,
+		"authorization_endpoint":                p.config.Issuer + "/oauth/authorize",
+		"token_endpoint":                        p.config.Issuer + "/oauth/token",
+		"userinfo_endpoint":                     p.config.Issuer + "/userinfo",
+		"introspection_endpoint":                p.config.Issuer + "/v1/introspect",
+		"jwks_uri":                              p.config.Issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{p.config.SigningAlg},
+		"scopes_supported":                      p.config.Scopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "azp",
+			"email", "email_verified", "preferred_username",
+		},
+	})
+}
+
+// HandleAuthorize serves /oauth/authorize. Browsers arrive with GET and
+// are sent to the login page with the same query; the login page posts the
+// request back as JSON with the user's access token and gets the URL to
+// send the browser to.
+func (p *Provider) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	req := &authRequest{}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.ResponseType = q.Get("response_type")
+		req.ClientID = q.Get("client_id")
+		req.RedirectURI = q.Get("redirect_uri")
+		req.Scope = q.Get("scope")
+		req.State = q.Get("state")
+		req.Nonce = q.Get("nonce")
+		req.CodeChallenge = q.Get("code_challenge")
+		req.CodeChallengeMethod = q.Get("code_challenge_method")
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "invalid json")
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	// Without a valid client and redirect URI there is nowhere safe to
+	// send errors, so they are answered directly
+	client, err := p.clients.GetClient(r.Context(), req.ClientID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_client", "unknown client_id")
+		return
+	}
+	redirectURI, ok := client.RedirectURI(req.RedirectURI)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for this client")
+		return
+	}
+
+	scopes, oerr := p.validateAuthRequest(req)
+
+	if r.Method == http.MethodGet {
+		if oerr != nil {
+			http.Redirect(w, r, errorRedirect(redirectURI, req.State, oerr), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, p.config.LoginURL+"?"+r.URL.RawQuery, http.StatusFound)
+		return
+	}
+
+	if oerr != nil {
+		writeJSON(w, http.StatusOK, map[string]string{"redirect_to": errorRedirect(redirectURI, req.State, oerr)})
+		return
+	}
+
+	username, err := p.backend.SessionUser(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "login_required", "a login session is required")
+		return
+	}
+
+	if !client.FirstParty {
+		if req.Consent == nil {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"consent_required": true,
+				"client_name":      client.Name,
+				"scopes":           scopes,
+			})
+			return
+		}
+		if !*req.Consent {
+			oerr := &oauthError{Code: "access_denied", Description: "the user denied the request"}
+			writeJSON(w, http.StatusOK, map[string]string{"redirect_to": errorRedirect(redirectURI, req.State, oerr)})
+			return
+		}
+	}
+
+	encoded, err := json.Marshal(&grant{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Username:      username,
+		Scopes:        scopes,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      time.Now().Unix(),
+
+		RedirectURIRequested: req.RedirectURI != "",
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	code, err := p.codes.Create(r.Context(), string(encoded))
+	if err != nil {
+		log.Printf("oidc authorize: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect_to": appendQuery(redirectURI, params)})
+}
+
+// validateAuthRequest checks everything but the client and redirect URI
+// and returns the requested scopes
+func (p *Provider) validateAuthRequest(req *authRequest) ([]string, *oauthError) {
+	if req.ResponseType != "code" {
+		return nil, &oauthError{Code: "unsupported_response_type", Description: "only the code flow is supported"}
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return nil, &oauthError{Code: "invalid_scope", Description: "the openid scope is required"}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(p.config.Scopes, scope) {
+			return nil, &oauthError{Code: "invalid_scope", Description: "unknown scope " + scope}
+		}
+	}
+
+	// PKCE is required of every client, confidential ones included
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, &oauthError{Code: "invalid_request", Description: "code_challenge with code_challenge_method S256 is required"}
+	}
+
+	return scopes, nil
+}
+
+// HandleToken serves /oauth/token for the authorization_code grant
+func (p *Provider) HandleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+
+	client, err := p.authenticateClient(r)
+	if err != nil {
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Consuming first makes the code unusable even if the checks below fail
+	encoded, err := p.codes.Consume(r.Context(), r.PostForm.Get("code"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+
+	var g grant
+	if err := json.Unmarshal([]byte(encoded), &g); err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	if g.ClientID != client.ID {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client")
+		return
+	}
+	redirectURI, sent := r.PostForm["redirect_uri"]
+	if (g.RedirectURIRequested && !sent) || (sent && redirectURI[0] != g.RedirectURI) {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match")
+		return
+	}
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), g.CodeChallenge) {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	response, err := p.issueTokens(r.Context(), client, &g)
+	if err != nil {
+		log.Printf("oidc token: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post and,
+// for public clients, a bare client_id
+func (p *Provider) authenticateClient(r *http.Request) (*Client, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes both parts
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, err
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, err
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := p.clients.GetClient(r.Context(), clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public() {
+		if secret != "" {
+			return nil, errors.New("public clients have no secret")
+		}
+		return client, nil
+	}
+	if !client.CheckSecret(secret) {
+		return nil, errors.New("invalid client secret")
+	}
+	return client, nil
+}
+
+func (p *Provider) issueTokens(ctx context.Context, client *Client, g *grant) (map[string]any, error) {
+	accessToken, expiresIn, err := p.backend.IssueAccessToken(ctx, g.Username, client.ID, g.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := p.backend.Identity(ctx, g.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Nonce:           g.Nonce,
+		AuthTime:        g.AuthTime,
+		AuthorizedParty: client.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.config.Issuer,
+			Subject:   identity.Username,
+			Audience:  jwt.ClaimStrings{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+		},
+	}
+	if slices.Contains(g.Scopes, ScopeEmail) {
+		claims.Email = identity.Email
+		claims.EmailVerified = &identity.EmailVerified
+	}
+	if slices.Contains(g.Scopes, ScopeProfile) {
+		claims.PreferredUsername = identity.Username
+	}
+
+	idToken, err := p.backend.SignIDToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(expiresIn.Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(g.Scopes, " "),
+	}, nil
+}
+
+// HandleUserInfo serves /userinfo with the claims the token's scopes allow
+func (p *Provider) HandleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	username, scopes, err := p.backend.TokenUser(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", "invalid access token")
+		return
+	}
+
+	granted := func(scope string) bool {
+		return scopes == nil || slices.Contains(scopes, scope)
+	}
+	if !granted(ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		writeError(w, http.StatusForbidden, "insufficient_scope", "the openid scope is required")
+		return
+	}
+
+	identity, err := p.backend.Identity(r.Context(), username)
+	if err != nil {
+		log.Printf("oidc userinfo: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	claims := map[string]any{"sub": identity.Username}
+	if granted(ScopeEmail) {
+		claims["email"] = identity.Email
+		claims["email_verified"] = identity.EmailVerified
+	}
+	if granted(ScopeProfile) {
+		claims["preferred_username"] = identity.Username
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, claims)
+}
+
+// verifyCodeChallenge checks an RFC 7636 S256 code verifier
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~') {
+			return false
+		}
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func errorRedirect(redirectURI, state string, oerr *oauthError) string {
+	params := url.Values{"error": {oerr.Code}}
+	if oerr.Description != "" {
+		params.Set("error_description", oerr.Description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return appendQuery(redirectURI, params)
+}
+
+// appendQuery adds params to a URL that may already have a query
+func appendQuery(rawURL string, params url.Values) string {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + params.Encode()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with an RFC 6749 error body
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	writeJSON(w, status, body)
+}
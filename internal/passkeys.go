@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"internal/config"
+	"internal/db"
+	"internal/webauthn"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Subjects of passkey challenges; the username is appended
+const (
+	passkeyRegisterChallenge = "register:"
+	passkeyLoginChallenge    = "login:"
+)
+
+// newWebAuthnConfig uses the configured relying party ID and origins,
+// which default to the host and origin of the dashboard
+func newWebAuthnConfig(cfg *config.AuthConfig, appBaseURL string) *webauthn.Config {
+	origin := strings.TrimSuffix(appBaseURL, "/")
+	rpID := ""
+	if u, err := url.Parse(appBaseURL); err == nil {
+		origin = u.Scheme + "://" + u.Host
+		rpID = u.Hostname()
+	}
+
+	if cfg.WebAuthnRPID != "" {
+		rpID = cfg.WebAuthnRPID
+	}
+	origins := []string{origin}
+	if len(cfg.WebAuthnOrigins) > 0 {
+		origins = cfg.WebAuthnOrigins
+	}
+
+	return webauthn.NewConfig(rpID, "BCR", origins...)
+}
+
+// passkeyUserHandle is the opaque user ID stored on authenticators, so
+// that they never hold the username in the clear
+func passkeyUserHandle(username string) []byte {
+	sum := sha256.Sum256([]byte("webauthn:" + username))
+	return sum[:]
+}
+
+func credentialDescriptors(creds []*db.WebAuthnCredential) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, 0, len(creds))
+	for _, cred := range creds {
+		id, err := base64.RawURLEncoding.DecodeString(cred.ID)
+		if err != nil {
+			continue
+		}
+		descriptors = append(descriptors, webauthn.CredentialDescriptor{
+			Type:       "public-key",
+			ID:         id,
+			Transports: cred.Transports,
+		})
+	}
+	return descriptors
+}
+
+// consumePasskeyChallenge redeems the challenge echoed in clientDataJSON
+// and checks it was issued for the expected ceremony
+func (s *Server) consumePasskeyChallenge(ctx context.Context, clientDataJSON []byte, ceremony string) (challenge, username string, err error) {
+	clientData, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		return "", "", err
+	}
+
+	subject, err := s.passkeyChallenges.Consume(ctx, clientData.Challenge)
+	if err != nil {
+		return "", "", err
+	}
+
+	username, ok := strings.CutPrefix(subject, ceremony)
+	if !ok {
+		return "", "", webauthn.ErrInvalidResponse
+	}
+	return clientData.Challenge, username, nil
+}
+
+// passkeyRegistrationOptions starts registering a passkey for username
+func (s *Server) passkeyRegistrationOptions(ctx context.Context, username string) (*webauthn.CreationOptions, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := s.passkeys.ListWebAuthnCredentials(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := s.passkeyChallenges.Create(ctx, passkeyRegisterChallenge+username)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.webauthn.NewCreationOptions(challenge, webauthn.User{
+		ID:          passkeyUserHandle(username),
+		Name:        user.Username,
+		DisplayName: user.Email,
+	}, credentialDescriptors(creds)), nil
+}
+
+// registerPasskey verifies the authenticator's response and stores the passkey
+func (s *Server) registerPasskey(ctx context.Context, username, name string, response *webauthn.RegistrationResponse) (*db.WebAuthnCredential, error) {
+	if name == "" || len(name) > 64 {
+		return nil, errors.New("validation: name must be 1-64 characters")
+	}
+
+	challenge, challengeUser, err := s.consumePasskeyChallenge(ctx, response.Response.ClientDataJSON, passkeyRegisterChallenge)
+	if err != nil {
+		return nil, err
+	}
+	if challengeUser != username {
+		return nil, webauthn.ErrInvalidResponse
+	}
+
+	credential, err := s.webauthn.VerifyRegistration(response, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(credential.ID)
+	_, err = s.passkeys.GetWebAuthnCredential(ctx, id)
+	if err == nil {
+		return nil, errors.New("validation: passkey already registered")
+	}
+	if !errors.Is(err, db.ErrWebAuthnCredentialNotFound) {
+		return nil, err
+	}
+
+	cred := &db.WebAuthnCredential{
+		ID:         id,
+		Username:   username,
+		Name:       name,
+		PublicKey:  credential.PublicKey,
+		SignCount:  int64(credential.SignCount),
+		AAGUID:     credential.AAGUID,
+		Transports: credential.Transports,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.passkeys.AddWebAuthnCredential(ctx, cred); err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+// passkeyLoginOptions starts a passkey login. Without a username any
+// discoverable passkey can be used; unknown users get the same answer.
+func (s *Server) passkeyLoginOptions(ctx context.Context, username string) (*webauthn.RequestOptions, error) {
+	var allow []webauthn.CredentialDescriptor
+	if username != "" {
+		creds, err := s.passkeys.ListWebAuthnCredentials(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		allow = credentialDescriptors(creds)
+	}
+
+	challenge, err := s.passkeyChallenges.Create(ctx, passkeyLoginChallenge+username)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.webauthn.NewRequestOptions(challenge, allow), nil
+}
+
+// loginPasskey verifies an assertion and starts session. A passkey is
+// possession and user verification in one, so no second factor is asked.
+func (s *Server) loginPasskey(ctx context.Context, response *webauthn.AssertionResponse, session *db.Session) (*TokenResponse, error) {
+	challenge, challengeUser, err := s.consumePasskeyChallenge(ctx, response.Response.ClientDataJSON, passkeyLoginChallenge)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := s.passkeys.GetWebAuthnCredential(ctx, base64.RawURLEncoding.EncodeToString(response.RawID))
+	if errors.Is(err, db.ErrWebAuthnCredentialNotFound) {
+		return nil, webauthn.ErrInvalidResponse
+	}
+	if err != nil {
+		return nil, err
+	}
+	if challengeUser != "" && challengeUser != cred.Username {
+		return nil, webauthn.ErrInvalidResponse
+	}
+	if handle := response.Response.UserHandle; len(handle) > 0 &&
+		subtle.ConstantTimeCompare(handle, passkeyUserHandle(cred.Username)) != 1 {
+		return nil, webauthn.ErrInvalidResponse
+	}
+
+	signCount, err := s.webauthn.VerifyAssertion(response, challenge, cred.PublicKey, uint32(cred.SignCount))
+	if errors.Is(err, webauthn.ErrCredentialCloned) {
+		log.Printf("passkey %s of %s: sign count went backwards, possible cloned authenticator", cred.ID, cred.Username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.getUser(ctx, cred.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if !user.Verified && s.unverifiedPolicy == UnverifiedBlockLogin {
+		return nil, ErrEmailNotVerified
+	}
+
+	if err := s.passkeys.UpdateWebAuthnSignCount(ctx, cred.ID, int64(signCount), time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(ctx, user, session)
+}
+
+// deletePasskey removes a passkey of username; passkeys of other users
+// are reported as not found
+func (s *Server) deletePasskey(ctx context.Context, username, id string) error {
+	cred, err := s.passkeys.GetWebAuthnCredential(ctx, id)
+	if err != nil {
+		return err
+	}
+	if cred.Username != username {
+		return db.ErrWebAuthnCredentialNotFound
+	}
+
+	return s.passkeys.DeleteWebAuthnCredential(ctx, cred)
+}
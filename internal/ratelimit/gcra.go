@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// gcraShards spreads keys over independent locks
+const gcraShards = 64
+
+// GCRALimiter implements the generic cell rate algorithm: each key holds
+// only its theoretical arrival time (TAT). Requests are spaced by
+// window/limit, and up to limit of them may arrive at once.
+//
+// Keys live in sharded LRU lists holding at most maxKeys in total, so a
+// flood of spoofed keys evicts the least recently seen ones instead of
+// growing memory. An evicted key starts again with a full burst.
+type GCRALimiter struct {
+	// interval is the time one request costs, in nanoseconds
+	interval int64
+	// tolerance is how far the TAT may run ahead of now, in nanoseconds
+	tolerance int64
+	limit     int
+
+	seed   maphash.Seed
+	shards []*gcraShard
+}
+
+var _ Limiter = (*GCRALimiter)(nil)
+
+type gcraShard struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	// lru holds *gcraEntry, most recently seen first
+	lru *list.List
+}
+
+type gcraEntry struct {
+	key string
+	// tat in Unix nanoseconds
+	tat int64
+}
+
+// NewGCRALimiter allows limit requests per window with a burst of limit,
+// tracking at most maxKeys keys
+func NewGCRALimiter(limit int, window time.Duration, maxKeys int) *GCRALimiter {
+	interval := int64(window) / int64(limit)
+	if maxKeys < 1 {
+		maxKeys = 1
+	}
+
+	shards := gcraShards
+	if maxKeys < shards {
+		shards = 1
+	}
+
+	rl := &GCRALimiter{
+		interval:  interval,
+		tolerance: interval * int64(limit),
+		limit:     limit,
+		seed:      maphash.MakeSeed(),
+		shards:    make([]*gcraShard, shards),
+	}
+	for i := range rl.shards {
+		rl.shards[i] = &gcraShard{
+			capacity: maxKeys / shards,
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+		}
+	}
+
+	return rl
+}
+
+func (rl *GCRALimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	shard := rl.shards[maphash.String(rl.seed, key)%uint64(len(rl.shards))]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	entry := shard.get(key)
+
+	next := max(entry.tat, now) + rl.interval
+	if next-now > rl.tolerance {
+		return Decision{
+			Limit:      rl.limit,
+			Reset:      time.Duration(entry.tat - now),
+			RetryAfter: time.Duration(next - now - rl.tolerance),
+		}, nil
+	}
+
+	entry.tat = next
+	return Decision{
+		Allowed: true,
+		Limit:   rl.limit,
+		// Every interval the TAT is ahead of now is one request used up
+		Remaining: int((rl.tolerance - (next - now)) / rl.interval),
+		Reset:     time.Duration(next - now),
+	}, nil
+}
+
+// Len returns the number of keys tracked
+func (rl *GCRALimiter) Len() int {
+	n := 0
+	for _, shard := range rl.shards {
+		shard.mutex.Lock()
+		n += shard.lru.Len()
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+// get returns the entry of key, marking it recently seen, and adds it when
+// missing, evicting the least recently seen entry of a full shard
+func (s *gcraShard) get(key string) *gcraEntry {
+	if elem, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*gcraEntry)
+	}
+
+	if s.lru.Len() >= s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*gcraEntry).key)
+	}
+
+	entry := &gcraEntry{key: key}
+	s.entries[key] = s.lru.PushFront(entry)
+	return entry
+}
@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Identity dimensions a policy counts requests by
+const (
+	ByIP     = "ip"
+	ByUser   = "user"
+	ByAPIKey = "api_key"
+)
+
+// Policy is one budget: requests to matching routes, counted per identity
+type Policy struct {
+	// Name keeps the counters of policies apart
+	Name string `json:"name"`
+	// Route is a route pattern such as "/v1/sessions/{id}", a prefix
+	// ending in "*", or "*" for every route
+	Route string `json:"route"`
+	// Method restricts the policy to one HTTP method; empty matches all
+	Method string `json:"method,omitempty"`
+	// By lists identity dimensions in order of preference; requests are
+	// counted by the first one they have, so ["user", "ip"] gives signed-in
+	// users their own budget and everyone else one per IP
+	By     Dimensions `json:"by"`
+	Limit  int        `json:"limit"`
+	Window Duration   `json:"window"`
+}
+
+// Dimensions reads either one dimension or a list from JSON
+type Dimensions []string
+
+func (d *Dimensions) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*d = Dimensions{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(d))
+}
+
+// Duration reads durations such as "1m" or "24h" from JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Validate checks that the policy can be enforced
+func (p *Policy) Validate() error {
+	switch {
+	case p.Name == "" || strings.Contains(p.Name, ":"):
+		return fmt.Errorf("policy %q: name must be set and cannot contain ':'", p.Name)
+	case p.Route == "":
+		return fmt.Errorf("policy %q: route must be set", p.Name)
+	case len(p.By) == 0:
+		return fmt.Errorf("policy %q: by must be set", p.Name)
+	case p.Limit < 1 || p.Window <= 0:
+		return fmt.Errorf("policy %q: limit and window must be positive", p.Name)
+	}
+
+	for _, by := range p.By {
+		if by != ByIP && by != ByUser && by != ByAPIKey {
+			return fmt.Errorf("policy %q: by must be %s, %s or %s", p.Name, ByIP, ByUser, ByAPIKey)
+		}
+		// API keys are not verified before they are counted, so made-up
+		// keys must never get a budget instead of their IP's
+		if by == ByAPIKey && len(p.By) > 1 {
+			return fmt.Errorf("policy %q: %s cannot be combined with other dimensions", p.Name, ByAPIKey)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the policy applies to a request of method
+// served by the route pattern
+func (p *Policy) Matches(route, method string) bool {
+	if p.Method != "" && !strings.EqualFold(p.Method, method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(p.Route, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return p.Route == route
+}
+
+// LoadPolicies reads a JSON list of policies
+func LoadPolicies(path string) ([]*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []*Policy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for _, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if names[policy.Name] {
+			return nil, fmt.Errorf("%s: duplicate policy %q", path, policy.Name)
+		}
+		names[policy.Name] = true
+	}
+
+	return policies, nil
+}
+
+type rule struct {
+	policy  *Policy
+	limiter Limiter
+}
+
+// PolicySet enforces several policies at once; a request must fit in the
+// budget of every policy that matches it
+type PolicySet struct {
+	rules []rule
+}
+
+// NewPolicySet builds a limiter for each policy with newLimiter
+func NewPolicySet(policies []*Policy, newLimiter func(*Policy) Limiter) *PolicySet {
+	set := &PolicySet{rules: make([]rule, len(policies))}
+	for i, policy := range policies {
+		set.rules[i] = rule{policy: policy, limiter: newLimiter(policy)}
+	}
+	return set
+}
+
+// Result is the decision of one policy about a request
+type Result struct {
+	Policy *Policy
+	Decision
+}
+
+// Allow counts the request against every matching policy in order. It
+// returns the result of the first policy that rejects the request or,
+// when all allow it, of the one with the least budget left; nil means no
+// policy counted it. identify returns the identity of the request in a
+// dimension, or "" when it has none; requests with none of a policy's
+// dimensions are not counted by it.
+func (s *PolicySet) Allow(ctx context.Context, route, method string, identify func(by string) string) (*Result, error) {
+	var closest *Result
+	for _, rule := range s.rules {
+		if !rule.policy.Matches(route, method) {
+			continue
+		}
+
+		var key string
+		for _, by := range rule.policy.By {
+			if identity := identify(by); identity != "" {
+				key = rule.policy.Name + ":" + by + ":" + identity
+				break
+			}
+		}
+		if key == "" {
+			continue
+		}
+
+		decision, err := rule.limiter.Allow(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !decision.Allowed {
+			return &Result{Policy: rule.policy, Decision: decision}, nil
+		}
+		if closest == nil || decision.Remaining < closest.Remaining {
+			closest = &Result{Policy: rule.policy, Decision: decision}
+		}
+	}
+	return closest, nil
+}
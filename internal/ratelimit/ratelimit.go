@@ -0,0 +1,30 @@
+// Package ratelimit counts requests per key, such as a client IP, and
+// decides whether they are within a budget. GCRALimiter keeps the state in
+// the process; RedisLimiter shares it between server instances.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter allows at most a fixed number of requests per key in a window
+type Limiter interface {
+	// Allow records a request of key and decides whether it is within the
+	// limit. Rejected requests are not counted.
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// Decision is the outcome of one request and the state of its key after it
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests allowed per window
+	Limit int
+	// Remaining is how many more requests would be allowed right now
+	Remaining int
+	// Reset is how long until the whole budget is available again
+	Reset time.Duration
+	// RetryAfter is how long until a rejected request would be allowed;
+	// zero for allowed requests
+	RetryAfter time.Duration
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const redisKeyPrefix = "auth:ratelimit:"
+
+// slidingWindowScript is a sliding window log in a sorted set scored by
+// request time in microseconds. Time is read from Redis so that instances
+// with skewed clocks still share one window.
+//
+// KEYS[1] the log; ARGV[1] window in microseconds, ARGV[2] limit,
+// ARGV[3] a unique member for this request. Returns whether the request
+// was allowed, the remaining budget, and the microseconds until the next
+// slot and the whole budget are free.
+var slidingWindowScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+	count = count + 1
+	allowed = 1
+end
+
+-- The oldest request frees the next slot, the newest the whole budget
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+return {allowed, limit - count,
+	tonumber(oldest[2]) + window - now,
+	tonumber(newest[2]) + window - now}
+`)
+
+// RedisLimiter is a sliding window log in Redis, shared by every server
+// instance using the same Redis
+type RedisLimiter struct {
+	client *redis.Client
+	limit  int
+	window time.Duration
+}
+
+var _ Limiter = (*RedisLimiter)(nil)
+
+func NewRedisLimiter(client *redis.Client, limit int, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{client: client, limit: limit, window: window}
+}
+
+func (r *RedisLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	member := strconv.FormatUint(rand.Uint64(), 36)
+	result, err := slidingWindowScript.Run(ctx, r.client, []string{redisKeyPrefix + key},
+		r.window.Microseconds(), r.limit, member).Int64Slice()
+	if err != nil {
+		return Decision{}, fmt.Errorf("internal: %w", err)
+	}
+	if len(result) != 4 {
+		return Decision{}, fmt.Errorf("internal: unexpected rate limit script result %v", result)
+	}
+
+	decision := Decision{
+		Allowed:   result[0] == 1,
+		Limit:     r.limit,
+		Remaining: int(result[1]),
+		Reset:     time.Duration(result[3]) * time.Microsecond,
+	}
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration(result[2]) * time.Microsecond
+	}
+	return decision, nil
+}
@@ -1,25 +1,30 @@
-package main
+package ratelimit
 
 import (
+	"context"
 	"sync"
 	"time"
 )
 
-// Rate limiter
-type RateLimiter struct {
+// SlidingWindowLimiter is a sliding window log kept in process memory. It
+// holds a timestamp per request behind one mutex; GCRALimiter replaces it
+// and it is kept as the baseline of the benchmarks.
+type SlidingWindowLimiter struct {
 	clients map[string]*clientInfo
 	mutex   sync.RWMutex
 	limit   int
 	window  time.Duration
 }
 
+var _ Limiter = (*SlidingWindowLimiter)(nil)
+
 type clientInfo struct {
 	requests []time.Time
 	lastSeen time.Time
 }
 
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	rl := &RateLimiter{
+func NewSlidingWindowLimiter(limit int, window time.Duration) *SlidingWindowLimiter {
+	rl := &SlidingWindowLimiter{
 		clients: make(map[string]*clientInfo),
 		limit:   limit,
 		window:  window,
@@ -37,19 +42,19 @@ func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	return rl
 }
 
-func (rl *RateLimiter) Allow(clientIP string) bool {
+func (rl *SlidingWindowLimiter) Allow(ctx context.Context, key string) (Decision, error) {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
 	now := time.Now()
-	client, exists := rl.clients[clientIP]
+	client, exists := rl.clients[key]
 
 	if !exists {
 		client = &clientInfo{
 			requests: make([]time.Time, 0),
 			lastSeen: now,
 		}
-		rl.clients[clientIP] = client
+		rl.clients[key] = client
 	}
 
 	client.lastSeen = now
@@ -66,22 +71,32 @@ func (rl *RateLimiter) Allow(clientIP string) bool {
 
 	// Check if limit exceeded
 	if len(client.requests) >= rl.limit {
-		return false
+		// The oldest request frees the next slot, the newest the whole budget
+		return Decision{
+			Limit:      rl.limit,
+			Reset:      client.requests[len(client.requests)-1].Add(rl.window).Sub(now),
+			RetryAfter: client.requests[0].Add(rl.window).Sub(now),
+		}, nil
 	}
 
 	// Add current request
 	client.requests = append(client.requests, now)
-	return true
+	return Decision{
+		Allowed:   true,
+		Limit:     rl.limit,
+		Remaining: rl.limit - len(client.requests),
+		Reset:     rl.window,
+	}, nil
 }
 
-func (rl *RateLimiter) cleanup() {
+func (rl *SlidingWindowLimiter) cleanup() {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
 	cutoff := time.Now().Add(-rl.window * 2)
-	for ip, client := range rl.clients {
+	for key, client := range rl.clients {
 		if client.lastSeen.Before(cutoff) {
-			delete(rl.clients, ip)
+			delete(rl.clients, key)
 		}
 	}
 }
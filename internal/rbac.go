@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"log"
+	"net/http"
+)
+
+type claimsContextKey struct{}
+
+// requireRole authenticates the request and rejects tokens whose role does
+// not grant the required one. The handler finds the claims in the context.
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.authenticate(r)
+		if err != nil {
+			JSONError(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		// Impersonation tokens carry the role of the user, never staff powers
+		if claims.Actor != nil {
+			authError(w, ErrImpersonationForbidden)
+			return
+		}
+
+		if !db.HasRole(claims.Role, role) {
+			s.recordAccessDenied(role)
+			log.Printf("access denied: %s (%s) requires %s for %s", claims.Username, claims.Role, role, r.URL.Path)
+			JSONError(w, "Forbidden: requires role "+role, http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+	}
+}
+
+// claimsFromContext returns the claims stored by requireRole
+func claimsFromContext(ctx context.Context) *JWTClaims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*JWTClaims)
+	return claims
+}
+
+// updateUserAccess applies change to the stored user and drops the cached
+// copy, so that the next login or refresh sees the new values
+func (s *Server) updateUserAccess(ctx context.Context, username string, change func(*db.User) error) (*db.User, error) {
+	user, err := s.userRepo.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := change(user); err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	s.userCache.Delete(ctx, username)
+	return user, nil
+}
+
+// setRole changes the role of username. Existing tokens carry the old role,
+// so the user is signed out everywhere.
+func (s *Server) setRole(ctx context.Context, actor, username, role string) error {
+	if !db.ValidRole(role) {
+		return errors.New("validation: unknown role")
+	}
+	if actor == username {
+		return errors.New("validation: cannot change your own role")
+	}
+
+	if _, err := s.updateUserAccess(ctx, username, func(user *db.User) error {
+		user.Role = role
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return s.revokeAllTokens(ctx, username)
+}
+
+// setDisabled blocks or unblocks logins of username. Disabling also ends
+// every session of the user.
+func (s *Server) setDisabled(ctx context.Context, actor, username string, disabled bool) error {
+	if actor == username {
+		return errors.New("validation: cannot disable your own account")
+	}
+
+	if _, err := s.updateUserAccess(ctx, username, func(user *db.User) error {
+		user.Disabled = disabled
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !disabled {
+		return nil
+	}
+	return s.revokeAllTokens(ctx, username)
+}
+
+// setCategory moves username to another ads category
+func (s *Server) setCategory(ctx context.Context, username string, category int) error {
+	if !db.ValidCategory(category) {
+		return errors.New("validation: unknown category")
+	}
+
+	_, err := s.updateUserAccess(ctx, username, func(user *db.User) error {
+		user.Category = category
+		return nil
+	})
+	return err
+}
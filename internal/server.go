@@ -5,82 +5,416 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"internal/clientip"
+	"internal/concurrency"
+	"internal/config"
 	"internal/db"
-	"net"
+	"internal/ipfilter"
+	"internal/mailer"
+	"internal/oidc"
+	"internal/ratelimit"
+	"internal/webauthn"
+	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 type Server struct {
-	userRepo    db.UserRepository
-	userCache   db.UserCache
-	jwtmanager  *JWTManager
-	rateLimiter *RateLimiter
+	userRepo     db.UserRepository
+	totpRepo     db.TOTPRepository
+	totpSteps    db.TOTPStepStore
+	apiKeys      db.APIKeyRepository
+	passkeys     db.WebAuthnRepository
+	audit        db.AuditRepository
+	userCache    db.UserCache
+	attempts     db.LoginAttemptStore
+	refreshStore db.RefreshTokenStore
+	revocations  db.RevocationStore
+	sessionCache db.SessionStore
+	sessionRepo  db.SessionStore
+	resetTokens  db.OneTimeTokenStore
+	verifyTokens db.OneTimeTokenStore
+	magicLinks   db.OneTimeTokenStore
+	mailer       mailer.Mailer
+	jwtmanager   *JWTManager
+	rateLimits   *ratelimit.PolicySet
+	clientIPs    *clientip.Resolver
+	ipFilter     *ipfilter.Filter
+	bans         db.BanStore
+	banPolicy    *BanPolicy
+	// hashLimiter bounds how many passwords are hashed or verified at once
+	hashLimiter  *concurrency.Limiter
+	oidcProvider *oidc.Provider
+	webauthn     *webauthn.Config
+	// passkeyChallenges maps WebAuthn challenges to the ceremony they belong to
+	passkeyChallenges db.OneTimeTokenStore
+	// passwordPolicy screens new passwords for strength and known breaches
+	passwordPolicy *db.PasswordPolicy
+	appBaseURL     string
+	// corsOrigin is the dashboard origin allowed to call the API
+	corsOrigin string
+	// unverifiedPolicy is one of the Unverified* constants
+	unverifiedPolicy string
 }
 
-func NewServer() (*Server, error) {
-	// Default credentials if environment variables not set
-	cassUsername := getEnvOrDefault("CASS_USERNAME", "backend")
-	cassPassword := getEnvOrDefault("CASS_PASSWORD", "BPass0319")
-	cassKeyspace := getEnvOrDefault("CASS_KEYSPACE", "cass_keyspace")
+// What accounts with an unverified email address may do
+const (
+	UnverifiedAllow      = "allow"
+	UnverifiedBlockAds   = "block_ads"
+	UnverifiedBlockLogin = "block_login"
+)
+
+var (
+	ErrEmailNotVerified = errors.New("forbidden: email not verified")
+	ErrAccountDisabled  = errors.New("forbidden: account disabled")
+)
 
-	userRepo, err := db.NewCassandraRepo(db.NewCassandraConfig(cassUsername, cassPassword, cassKeyspace))
+func NewServer(cfg *config.Config) (*Server, error) {
+	cassConfig := db.NewCassandraConfig(cfg.Cassandra.Username, cfg.Cassandra.Password, cfg.Cassandra.Keyspace)
+	cassConfig.Hosts = cfg.Cassandra.Hosts
+	cassConfig.Timeout = cfg.Cassandra.Timeout
+	cassConfig.ConnectTimeout = cfg.Cassandra.ConnectTimeout
+
+	userRepo, err := db.NewCassandraRepo(cassConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Cassandra: %w", err)
 	}
+	migrateCtx, cancel := context.WithTimeout(context.Background(), cfg.Cassandra.ConnectTimeout)
+	err = userRepo.Migrate(migrateCtx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate Cassandra schema: %w", err)
+	}
 
-	redisPassword := getEnvOrDefault("REDIS_PASSWORD", "RPass0319")
-
-	userCache, err := db.NewRedisRepo(db.NewRedisConfig(redisPassword))
+	redisConfig := db.NewRedisConfig(cfg.Redis.Password)
+	redisConfig.Addr = cfg.Redis.Addr
+	redisConfig.DB = cfg.Redis.DB
+	redisClient, err := db.NewRedisClient(redisConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Redis: %w", err)
 	}
 
-	jwtSecret := getEnvOrDefault("JWT_SECRET", "some_secret")
+	hasher, err := newPasswordHasher(&cfg.Passwords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize password hasher: %w", err)
+	}
+	db.DefaultPasswordHasher = hasher
 
-	// Rate limiter: 100 requests per minute per IP
-	rateLimiter := NewRateLimiter(100, time.Minute)
+	hashLimiter, err := newHashLimiter(&cfg.Passwords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize password hashing limiter: %w", err)
+	}
+	registerHashLimiterMetrics(hashLimiter)
 
-	return &Server{
-		userRepo:    userRepo,
-		userCache:   userCache,
-		jwtmanager:  NewJWTManager(jwtSecret),
-		rateLimiter: rateLimiter,
-	}, nil
+	jwtManager, err := newJWTManager(&cfg.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize JWT keys: %w", err)
+	}
+
+	rateLimits, err := newRateLimits(&cfg.RateLimit, redisClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize rate limiter: %w", err)
+	}
+
+	// Forwarding headers are ignored unless they come from these proxies
+	clientIPs, err := clientip.NewResolver(cfg.Server.TrustedProxyHeader, cfg.Server.TrustedProxies...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	ipFilter, err := newIPFilter(cfg.Server.IPListsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load IP lists: %w", err)
+	}
+
+	passwordPolicy, err := newPasswordPolicy(&cfg.Passwords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize password policy: %w", err)
+	}
+
+	oidcClients, err := newOIDCClients(cfg.Auth.OIDCClientsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenID Connect clients: %w", err)
+	}
+
+	banPolicy := NewBanPolicy()
+	banPolicy.Threshold = cfg.RateLimit.BanThreshold
+
+	appBaseURL := cfg.Server.AppBaseURL
+	webauthnConfig := newWebAuthnConfig(&cfg.Auth, appBaseURL)
+
+	server := &Server{
+		userRepo:     userRepo,
+		totpRepo:     userRepo,
+		totpSteps:    db.NewRedisTOTPStepStore(redisClient, totpWindow),
+		apiKeys:      userRepo,
+		passkeys:     userRepo,
+		audit:        userRepo,
+		userCache:    db.NewRedisRepoWithClient(redisClient, redisConfig),
+		attempts:     db.NewRedisLoginAttemptStore(redisClient, db.NewLockoutPolicy()),
+		refreshStore: db.NewRedisRefreshStore(redisClient, RefreshTokenDuration),
+		revocations:  db.NewRedisRevocationStore(redisClient, jwtManager.maxAccessTokenDuration()),
+		sessionCache: db.NewRedisSessionStore(redisClient),
+		sessionRepo:  userRepo,
+		resetTokens:  db.NewRedisOneTimeStore(redisClient, "auth:reset:", PasswordResetDuration),
+		verifyTokens: db.NewRedisOneTimeStore(redisClient, "auth:verify:", EmailVerificationDuration),
+		magicLinks:   db.NewRedisOneTimeStore(redisClient, "auth:magic:", MagicLinkDuration),
+		mailer:       newMailer(&cfg.Mail),
+		jwtmanager:   jwtManager,
+		rateLimits:   rateLimits,
+		clientIPs:    clientIPs,
+		ipFilter:     ipFilter,
+		bans:         db.NewRedisBanStore(redisClient),
+		banPolicy:    banPolicy,
+		hashLimiter:  hashLimiter,
+		appBaseURL:   appBaseURL,
+		corsOrigin:   cfg.Server.CORSOrigin,
+		webauthn:     webauthnConfig,
+
+		passkeyChallenges: db.NewRedisOneTimeStore(redisClient, "auth:webauthn:", webauthnConfig.Timeout),
+
+		passwordPolicy:   passwordPolicy,
+		unverifiedPolicy: cfg.Auth.UnverifiedPolicy,
+	}
+
+	oidcConfig := oidc.NewConfig(
+		cfg.Auth.OIDCIssuer,
+		appBaseURL+"/oauth/authorize",
+		jwtManager.Algorithm())
+	// Clients may also ask for tokens that work on our own API
+	oidcConfig.Scopes = append(oidcConfig.Scopes, db.ScopeAdsRead, db.ScopeProfileRead)
+	server.oidcProvider = oidc.NewProvider(oidcConfig, oidcClients,
+		db.NewRedisOneTimeStore(redisClient, "auth:oauth:code:", oidcConfig.CodeDuration),
+		&oidcBackend{s: server})
+
+	return server, nil
+}
+
+// newPasswordPolicy loads the breach corpus at BreachCorpusPath. A
+// missing corpus only disables breach screening.
+func newPasswordPolicy(cfg *config.PasswordConfig) (*db.PasswordPolicy, error) {
+	policy := &db.PasswordPolicy{MinScore: cfg.MinScore}
+
+	corpus, err := db.LoadBreachCorpus(cfg.BreachCorpusPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("breach corpus %s not found, breached passwords are not screened", cfg.BreachCorpusPath)
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy.Breached = corpus
+
+	return policy, nil
+}
+
+// newRateLimits loads the policies at PoliciesPath, or limits every IP to
+// DefaultLimit per DefaultWindow when the file does not exist. Requests
+// are counted in this process, or in Redis with the redis backend so that
+// every instance shares one budget.
+func newRateLimits(cfg *config.RateLimitConfig, redisClient *redis.Client) (*ratelimit.PolicySet, error) {
+	policies, err := ratelimit.LoadPolicies(cfg.PoliciesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("rate limit policies %s not found, allowing %d requests per %s per IP", cfg.PoliciesPath, cfg.DefaultLimit, cfg.DefaultWindow)
+		policies = []*ratelimit.Policy{{
+			Name:   "default",
+			Route:  "*",
+			By:     ratelimit.Dimensions{ratelimit.ByIP},
+			Limit:  cfg.DefaultLimit,
+			Window: ratelimit.Duration(cfg.DefaultWindow),
+		}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var newLimiter func(*ratelimit.Policy) ratelimit.Limiter
+	switch cfg.Backend {
+	case "memory":
+		newLimiter = func(p *ratelimit.Policy) ratelimit.Limiter {
+			return ratelimit.NewGCRALimiter(p.Limit, time.Duration(p.Window), cfg.MaxKeys)
+		}
+	case "redis":
+		newLimiter = func(p *ratelimit.Policy) ratelimit.Limiter {
+			return ratelimit.NewRedisLimiter(redisClient, p.Limit, time.Duration(p.Window))
+		}
+	default:
+		return nil, fmt.Errorf("invalid rate limit backend %q", cfg.Backend)
+	}
+
+	return ratelimit.NewPolicySet(policies, newLimiter), nil
+}
+
+// newIPFilter loads the allow and deny lists at path. A missing file
+// leaves both empty until it is created.
+func newIPFilter(path string) (*ipfilter.Filter, error) {
+	filter, err := ipfilter.NewFilter(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("IP lists %s not found, no addresses are allowlisted or denied", path)
+		return filter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// newMailer sends mail through the SMTP host when set; otherwise
+// messages are only kept in memory, which is enough for development
+func newMailer(cfg *config.MailConfig) mailer.Mailer {
+	smtpMailer, err := mailer.NewSMTPMailer(&mailer.SMTPConfig{
+		Host:     cfg.SMTPHost,
+		Port:     cfg.SMTPPort,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.From,
+	})
+	if err != nil {
+		log.Printf("mailer: %v, keeping mail in memory", err)
+		return mailer.NewMemoryMailer()
+	}
+	return smtpMailer
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// newJWTManager signs with the PEM keys in JWTKeyDir when set, falling
+// back to the shared JWTSecret otherwise
+func newJWTManager(cfg *config.AuthConfig) (*JWTManager, error) {
+	var manager *JWTManager
+	if cfg.JWTKeyDir == "" {
+		manager = NewJWTManager(cfg.JWTSecret)
+	} else {
+		keys, err := LoadSigningKeys(cfg.JWTKeyDir)
+		if err != nil {
+			return nil, err
+		}
+		if manager, err = NewJWTManagerWithKeys(keys, cfg.JWTActiveKID); err != nil {
+			return nil, err
+		}
+	}
+
+	manager.duration = cfg.AccessTokenDuration
+	return manager, nil
+}
+
+// newPasswordHasher configures the algorithm used for new hashes;
+// existing hashes are upgraded on the next successful login
+func newPasswordHasher(cfg *config.PasswordConfig) (db.PasswordHasher, error) {
+	hasherConfig := db.NewPasswordHasherConfig()
+	hasherConfig.Algorithm = cfg.HashAlgorithm
+	hasherConfig.Argon2.Memory = uint32(cfg.Argon2MemoryKiB)
+	hasherConfig.Argon2.Iterations = uint32(cfg.Argon2Iterations)
+	hasherConfig.Argon2.Parallelism = uint8(cfg.Argon2Parallelism)
+	hasherConfig.BcryptCost = cfg.BcryptCost
+
+	return db.NewPasswordHasher(hasherConfig)
+}
+
+// newHashLimiter bounds how many passwords are hashed at once, one per
+// CPU unless HashConcurrency is set, and the queue in front of it
+func newHashLimiter(cfg *config.PasswordConfig) (*concurrency.Limiter, error) {
+	limiterConfig := concurrency.NewConfig()
+
+	if cfg.HashConcurrency > 0 {
+		limiterConfig.MaxLimit = cfg.HashConcurrency
+		limiterConfig.InitialLimit = cfg.HashConcurrency
+	}
+	limiterConfig.MaxQueue = 4 * limiterConfig.MaxLimit
+	if cfg.HashQueueSize > 0 {
+		limiterConfig.MaxQueue = cfg.HashQueueSize
+	}
+	limiterConfig.MaxWait = cfg.HashMaxWait
+	limiterConfig.Target = cfg.HashLatencyTarget
+
+	if err := limiterConfig.Validate(); err != nil {
+		return nil, err
 	}
-	return defaultValue
+	return concurrency.NewLimiter(limiterConfig), nil
 }
 
+// getClientIP returns the client address resolved by clientIPMiddleware,
+// or "" when RemoteAddr cannot be read
 func (s *Server) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
+	addr, ok := clientip.FromContext(r.Context())
+	if !ok {
+		addr = s.clientIPs.ClientIP(r)
+	}
+	if !addr.IsValid() {
+		return ""
 	}
+	return addr.String()
+}
 
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+// clientIPMiddleware resolves the client address once and stores it in
+// the request context for the rate limiter, logs and metrics
+func (s *Server) clientIPMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := s.clientIPs.ClientIP(r)
+		next(w, r.WithContext(clientip.NewContext(r.Context(), addr)))
 	}
+}
 
-	// Fall back to RemoteAddr
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+// acquireHashSlot waits for the hashing limiter; passwords are only hashed
+// or verified while holding a slot. The returned function gives it back.
+func (s *Server) acquireHashSlot(ctx context.Context) (func(), error) {
+	release, err := s.hashLimiter.Acquire(ctx)
+	var overloadErr *concurrency.OverloadError
+	if errors.As(err, &overloadErr) {
+		s.recordHashRejected(overloadErr.Reason)
+	}
+	return release, err
+}
+
+// rateLimitIdentity returns the identity of r in a policy dimension.
+// Tokens are only checked for their signature here; revoked ones still
+// count against their user, and requests without one only against IPs.
+func (s *Server) rateLimitIdentity(r *http.Request, by string) string {
+	authHeader := r.Header.Get("Authorization")
+
+	switch by {
+	case ratelimit.ByIP:
+		return s.getClientIP(r)
+	case ratelimit.ByUser:
+		if tokenStr, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+			if claims, err := s.jwtmanager.ValidateToken(tokenStr); err == nil {
+				return claims.Username
+			}
+		}
+	case ratelimit.ByAPIKey:
+		if key, ok := strings.CutPrefix(authHeader, "ApiKey "); ok {
+			if prefix, _, err := db.ParseAPIKey(key); err == nil {
+				return prefix
+			}
+		}
+	}
+	return ""
 }
 
 func (s *Server) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		clientIP := s.getClientIP(r)
+		if s.isAllowlisted(r) {
+			next(w, r)
+			return
+		}
 
-		if !s.rateLimiter.Allow(clientIP) {
-			s.recordRateLimit(clientIP)
+		result, err := s.rateLimits.Allow(r.Context(), r.Pattern, r.Method, func(by string) string {
+			return s.rateLimitIdentity(r, by)
+		})
+		if err != nil {
+			// Failing open keeps logins working while Redis is down
+			log.Printf("rate limit %s: %v", s.getClientIP(r), err)
+		}
+		if result != nil {
+			setRateLimitHeaders(w, result)
+		}
+		if result != nil && !result.Allowed {
+			s.recordRateLimit(s.getClientIP(r), result.Policy.Name)
+			s.recordViolation(r.Context(), s.getClientIP(r), result.Policy.Name)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
 			JSONError(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
@@ -89,35 +423,406 @@ func (s *Server) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// setRateLimitHeaders describes the policy closest to rejecting the
+// request with the RateLimit headers of the IETF httpapi draft
+func setRateLimitHeaders(w http.ResponseWriter, result *ratelimit.Result) {
+	window := ceilSeconds(time.Duration(result.Policy.Window))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Limit, window))
+}
+
+// ceilSeconds rounds d up to whole seconds, as delay headers expect
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// getUser reads the user from Redis, falling back to Cassandra
+func (s *Server) getUser(ctx context.Context, username string) (*db.User, error) {
+	user, err := s.userCache.Get(ctx, username)
+	if err != nil {
+		user, err = s.userRepo.GetUser(ctx, username)
+	}
+	return user, err
+}
+
 func (s *Server) loginCheck(ctx context.Context, cred *db.Credentials) (*db.User, error) {
-	// Try Redis first, fallback to Cassandra
-	user, err := s.userCache.Get(ctx, cred.Username)
+	user, err := s.getUser(ctx, cred.Username)
 	if err != nil {
-		user, err = s.userRepo.GetUser(ctx, cred.Username)
+		return nil, err
 	}
+
+	release, err := s.acquireHashSlot(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
 	if !db.CheckPasswordHash(cred.Password, user.Password) {
 		return nil, errors.New("unauthorized: incorrect password")
 	}
 
+	if db.PasswordNeedsRehash(user.Password) {
+		s.rehashPassword(ctx, user, cred.Password)
+	}
+
 	s.userCache.Add(ctx, user)
 	return user, nil
 }
 
-func (s *Server) login(ctx context.Context, cred *db.Credentials) (string, error) {
-	_, err := s.loginCheck(ctx, cred)
+// rehashPassword upgrades the stored hash to the current algorithm and
+// cost. Failures are only logged, the old hash keeps working. The caller
+// holds a hashing slot.
+func (s *Server) rehashPassword(ctx context.Context, user *db.User, password string) {
+	hashedPassword, err := db.HashPassword(password)
+	if err != nil {
+		log.Printf("rehash %s: %v", user.Username, err)
+		return
+	}
+
+	oldPassword := user.Password
+	user.Password = hashedPassword
+	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+		log.Printf("rehash %s: %v", user.Username, err)
+		user.Password = oldPassword
+		return
+	}
+
+	s.recordDBOperation("password_rehash", "success")
+}
+
+// login checks the credentials and, unless a second factor is needed,
+// starts session
+func (s *Server) login(ctx context.Context, cred *db.Credentials, session *db.Session) (*TokenResponse, error) {
+	reservation, err := s.reserveLogin(ctx, cred.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.loginCheck(ctx, cred)
+	if err != nil {
+		if strings.Contains(err.Error(), "unauthorized") {
+			s.recordLoginFailure(cred.Username, reservation)
+		} else {
+			s.releaseLogin(ctx, cred.Username, reservation)
+		}
+		return nil, err
+	}
+
+	// The password was right, only a completed login resets the counter
+	response, err := s.completeLogin(ctx, user, session)
+	if err != nil || response.MFARequired {
+		s.releaseLogin(ctx, cred.Username, reservation)
+	}
+	return response, err
+}
+
+// confirmPassword checks the current password of a signed in user before
+// a sensitive change. Wrong guesses count towards the same lockout as
+// logins, so a stolen token is no way around it.
+func (s *Server) confirmPassword(ctx context.Context, cred *db.Credentials) (*db.User, error) {
+	reservation, err := s.reserveLogin(ctx, cred.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.loginCheck(ctx, cred)
+	if err != nil && strings.Contains(err.Error(), "unauthorized") {
+		s.recordLoginFailure(cred.Username, reservation)
+		return nil, err
+	}
+
+	// Failures of the second factor stay counted, so the password alone
+	// does not reset the counter
+	s.releaseLogin(ctx, cred.Username, reservation)
+	return user, err
+}
+
+// completeLogin ends every first-factor login: it asks for the second
+// factor when the user enrolled one and otherwise starts session
+func (s *Server) completeLogin(ctx context.Context, user *db.User, session *db.Session) (*TokenResponse, error) {
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if !user.Verified && s.unverifiedPolicy == UnverifiedBlockLogin {
+		return nil, ErrEmailNotVerified
+	}
+
+	enrolled, err := s.totpEnabled(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if enrolled {
+		challenge, err := s.jwtmanager.CreatePurposeToken(user.Username, PurposeMFAChallenge, MFAChallengeDuration)
+		if err != nil {
+			return nil, err
+		}
+		return &TokenResponse{MFARequired: true, ChallengeToken: challenge}, nil
+	}
+
+	s.resetLoginFailures(ctx, user.Username)
+	return s.issueTokens(ctx, user, session)
+}
+
+// reserveLogin counts the attempt as a failure up front and rejects it
+// while the account is locked or backing off
+func (s *Server) reserveLogin(ctx context.Context, username string) (*db.LoginReservation, error) {
+	reservation, err := s.attempts.Reserve(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reservation.Allowed {
+		if reservation.Locked {
+			s.recordLoginThrottled("locked")
+		} else {
+			s.recordLoginThrottled("backoff")
+		}
+		return nil, &LockoutError{Locked: reservation.Locked, RetryAfter: reservation.RetryAfter}
+	}
+	return reservation, nil
+}
+
+// recordLoginFailure confirms a reserved attempt as a wrong password or
+// code and reports the lock it started
+func (s *Server) recordLoginFailure(username string, reservation *db.LoginReservation) {
+	if reservation.Locked {
+		s.recordLockout()
+		log.Printf("account %s locked after %d failed logins", username, reservation.Failures)
+	}
+}
+
+// releaseLogin takes back a reserved attempt that failed for another
+// reason than the credentials
+func (s *Server) releaseLogin(ctx context.Context, username string, reservation *db.LoginReservation) {
+	if err := s.attempts.Release(ctx, username, reservation); err != nil {
+		log.Printf("release login attempt: %v", err)
+	}
+}
+
+func (s *Server) resetLoginFailures(ctx context.Context, username string) {
+	if err := s.attempts.Reset(ctx, username); err != nil {
+		log.Printf("reset login failures: %v", err)
+	}
+}
+
+// unlockAccount lifts a lockout before it expires
+func (s *Server) unlockAccount(ctx context.Context, username string) error {
+	return s.attempts.Reset(ctx, username)
+}
+
+// loginTOTP finishes a two-step login with a TOTP or recovery code
+func (s *Server) loginTOTP(ctx context.Context, challenge, code, recoveryCode string, session *db.Session) (*TokenResponse, error) {
+	claims, err := s.jwtmanager.ValidatePurposeToken(challenge, PurposeMFAChallenge)
+	if err != nil {
+		return nil, fmt.Errorf("unauthorized: invalid challenge: %w", err)
+	}
+
+	reservation, err := s.reserveLogin(ctx, claims.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.verifySecondFactor(ctx, claims.Username, code, recoveryCode)
+	if err != nil {
+		if strings.Contains(err.Error(), "unauthorized: invalid") {
+			s.recordLoginFailure(claims.Username, reservation)
+		} else {
+			s.releaseLogin(ctx, claims.Username, reservation)
+		}
+		return nil, err
+	}
+
+	s.resetLoginFailures(ctx, claims.Username)
+	return s.issueTokens(ctx, user, session)
+}
+
+// verifySecondFactor checks a TOTP or recovery code and returns the user
+func (s *Server) verifySecondFactor(ctx context.Context, username, code, recoveryCode string) (*db.User, error) {
+	secret, err := s.totpRepo.GetTOTP(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if !secret.Enabled {
+		return nil, errors.New("unauthorized: two-factor authentication not enabled")
+	}
+
+	if recoveryCode != "" {
+		ok, err := s.totpRepo.UseRecoveryCode(ctx, username, db.HashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("unauthorized: invalid recovery code")
+		}
+	} else {
+		ok, err := s.checkTOTP(ctx, username, secret.Secret, code)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("unauthorized: invalid code")
+		}
+	}
+
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+// checkTOTP verifies code and records its step, so that a code seen by
+// someone else cannot be used again while it is still valid
+func (s *Server) checkTOTP(ctx context.Context, username, secret, code string) (bool, error) {
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return s.totpSteps.Accept(ctx, username, step)
+}
+
+// totpEnabled reports whether the user finished two-factor enrollment
+func (s *Server) totpEnabled(ctx context.Context, username string) (bool, error) {
+	secret, err := s.totpRepo.GetTOTP(ctx, username)
+	if errors.Is(err, db.ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return secret.Enabled, nil
+}
+
+// enrollTOTP stores a new, not yet active secret for the user
+func (s *Server) enrollTOTP(ctx context.Context, username string) (string, error) {
+	enrolled, err := s.totpEnabled(ctx, username)
 	if err != nil {
 		return "", err
 	}
+	if enrolled {
+		return "", errors.New("validation: two-factor authentication already enabled")
+	}
 
-	jwt, err := s.jwtmanager.CreateToken(cred.Username)
+	secret, err := generateTOTPSecret()
 	if err != nil {
+		return "", fmt.Errorf("internal: %w", err)
+	}
+
+	if err := s.totpRepo.SaveTOTP(ctx, &db.TOTPSecret{Username: username, Secret: secret}); err != nil {
 		return "", err
 	}
 
-	return jwt, nil
+	return secret, nil
+}
+
+// activateTOTP confirms the pending secret and returns fresh recovery codes
+func (s *Server) activateTOTP(ctx context.Context, username, code string) ([]string, error) {
+	secret, err := s.totpRepo.GetTOTP(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Enabled {
+		return nil, errors.New("validation: two-factor authentication already enabled")
+	}
+	ok, err := s.checkTOTP(ctx, username, secret.Secret, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("validation: invalid code")
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("internal: %w", err)
+	}
+
+	secret.Enabled = true
+	secret.RecoveryCodes = make([]string, len(codes))
+	for i, c := range codes {
+		secret.RecoveryCodes[i] = db.HashToken(normalizeRecoveryCode(c))
+	}
+
+	if err := s.totpRepo.SaveTOTP(ctx, secret); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// issueTokens starts session and its refresh token family and returns the
+// first tokens of the session
+func (s *Server) issueTokens(ctx context.Context, user *db.User, session *db.Session) (*TokenResponse, error) {
+	if err := s.startSession(ctx, user.Username, session); err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := s.refreshStore.Issue(ctx, user.Username, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.tokenResponse(user, session.ID, refreshToken)
+}
+
+// refresh rotates a refresh token and issues a new access token with it.
+// The role is read again so that role changes apply on the next refresh.
+func (s *Server) refresh(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	username, sessionID, newRefreshToken, err := s.refreshStore.Rotate(ctx, refreshToken)
+	if errors.Is(err, db.ErrRefreshTokenReused) {
+		// The family is revoked; its access tokens must go with it
+		if session, err := s.getSession(ctx, sessionID); err == nil {
+			if err := s.endSession(ctx, session); err != nil {
+				log.Printf("end session %s: %v", sessionID, err)
+			}
+		}
+		return nil, db.ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.getSession(ctx, sessionID)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		s.refreshStore.RevokeFamily(ctx, sessionID)
+		return nil, db.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Username != username {
+		return nil, db.ErrRefreshTokenInvalid
+	}
+	s.touchSession(ctx, session)
+
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		s.refreshStore.Revoke(ctx, newRefreshToken)
+		return nil, ErrAccountDisabled
+	}
+
+	return s.tokenResponse(user, sessionID, newRefreshToken)
+}
+
+func (s *Server) tokenResponse(user *db.User, sessionID, refreshToken string) (*TokenResponse, error) {
+	jwt, err := s.jwtmanager.CreateToken(user.Username, user.Role, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		Token:        jwt,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.jwtmanager.duration.Seconds()),
+	}, nil
 }
 
 func (s *Server) register(ctx context.Context, user *db.User) error {
@@ -132,11 +837,6 @@ func (s *Server) register(ctx context.Context, user *db.User) error {
 		return errors.New("validation: username exists")
 	}
 
-	hashedPassword, err := db.HashPassword(user.Password)
-	if err != nil {
-		return fmt.Errorf("internal: %w", err)
-	}
-
 	if user.Email == "" {
 		return errors.New("validation: invalid email")
 	}
@@ -145,15 +845,103 @@ func (s *Server) register(ctx context.Context, user *db.User) error {
 		return fmt.Errorf("validation: %w", err)
 	}
 
+	if err := s.passwordPolicy.Check(user.Password, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	release, err := s.acquireHashSlot(ctx)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := db.HashPassword(user.Password)
+	release()
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+
 	user.Password = hashedPassword
+	user.Verified = false
+	user.Role = db.RoleUser
+	user.Disabled = false
 	if err := s.userRepo.AddUser(ctx, user); err != nil {
 		return err
 	}
 
 	s.userCache.Add(ctx, user)
+
+	if err := s.sendVerification(ctx, user); err != nil {
+		log.Printf("register: send verification: %v", err)
+	}
+	return nil
+}
+
+// canGetAds applies the unverified account policy to /v1/get_ads
+func (s *Server) canGetAds(user *db.User) bool {
+	return user.Verified || s.unverifiedPolicy == UnverifiedAllow
+}
+
+// sendVerification mails a verification link for the user's current address
+func (s *Server) sendVerification(ctx context.Context, user *db.User) error {
+	// Binding the token to the address makes old links useless after a change
+	token, err := s.verifyTokens.Create(ctx, user.Username+":"+user.Email)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening the link below. "+
+			"It expires in %d hours.\n\n%s/verify-email?token=%s\n",
+			user.Username, int(EmailVerificationDuration.Hours()), s.appBaseURL, token),
+	})
 	return nil
 }
 
+// verifyEmail redeems a verification token and marks the account verified
+func (s *Server) verifyEmail(ctx context.Context, token string) error {
+	subject, err := s.verifyTokens.Consume(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	username, email, ok := strings.Cut(subject, ":")
+	if !ok {
+		return db.ErrOneTimeTokenInvalid
+	}
+
+	user, err := s.userRepo.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user.Email != email {
+		return errors.New("validation: email changed since the link was sent")
+	}
+	if user.Verified {
+		return nil
+	}
+
+	user.Verified = true
+	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	s.userCache.Add(ctx, user)
+	return nil
+}
+
+// sendMail delivers the message in the background; mail is slow and a
+// failure should not fail the request that triggered it
+func (s *Server) sendMail(msg *mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			log.Printf("send mail: %v", err)
+		}
+	}()
+}
+
 // Helper functions for handling requests
 type Payload map[string]interface{}
 
@@ -173,12 +961,31 @@ func (p Payload) getString(key string) string {
 }
 
 func (p Payload) getInt(key string, defaultVal int) int {
-	if val, ok := p[key].(int); ok {
+	// encoding/json decodes every number into a float64
+	if val, ok := p[key].(float64); ok && val == math.Trunc(val) {
+		return int(val)
+	}
+	return defaultVal
+}
+
+func (p Payload) getBool(key string, defaultVal bool) bool {
+	if val, ok := p[key].(bool); ok {
 		return val
 	}
 	return defaultVal
 }
 
+func (p Payload) getStrings(key string) []string {
+	values, _ := p[key].([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
 func (p Payload) credentials() *db.Credentials {
 	username := p.getString("username")
 	password := p.getString("password")
@@ -201,29 +1008,192 @@ func (p Payload) user() *db.User {
 	}
 }
 
-// Token validation helper
-func (s *Server) validateToken(r *http.Request) (string, error) {
+// validateToken authenticates the request, checks that it grants scope
+// and returns the username
+func (s *Server) validateToken(r *http.Request, scope string) (string, error) {
+	claims, err := s.authorize(r, scope)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Username, nil
+}
+
+// authorize authenticates the request and checks that it grants scope
+func (s *Server) authorize(r *http.Request, scope string) (*JWTClaims, error) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.HasScope(scope) {
+		if claims.Actor != nil {
+			return nil, ErrImpersonationForbidden
+		}
+		return nil, fmt.Errorf("forbidden: missing scope %s", scope)
+	}
+
+	if claims.Actor != nil {
+		log.Printf("impersonation: %s as %s: %s %s", claims.Actor.Subject, claims.Username, r.Method, r.URL.Path)
+	}
+	return claims, nil
+}
+
+// authenticate accepts a bearer token, checked against the denylist, or an
+// API key. API keys are returned as claims with the PurposeAPIKey purpose.
+func (s *Server) authenticate(r *http.Request) (*JWTClaims, error) {
 	authHeader := r.Header.Get("Authorization")
+	if key, ok := strings.CutPrefix(authHeader, "ApiKey "); ok {
+		return s.authenticateAPIKey(r.Context(), key)
+	}
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", errors.New("missing or invalid authorization header")
+		return nil, errors.New("missing or invalid authorization header")
 	}
 
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	return s.authenticateBearer(r.Context(), strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+// authenticateBearer validates an access token and checks the denylist
+func (s *Server) authenticateBearer(ctx context.Context, tokenStr string) (*JWTClaims, error) {
 	claims, err := s.jwtmanager.ValidateToken(tokenStr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return claims.Username, nil
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	revoked, err := s.revocations.IsRevoked(ctx, claims.ID, claims.Username, issuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("unauthorized: token revoked")
+	}
+
+	if err := s.checkSession(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// revokeUser signs the user out everywhere: the current access token,
+// every older access token and every refresh token family
+func (s *Server) revokeUser(ctx context.Context, claims *JWTClaims) error {
+	if claims.Purpose != PurposeAPIKey {
+		if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
+	}
+	return s.revokeAllTokens(ctx, claims.Username)
+}
+
+// revokeAllTokens signs the user out of every session
+func (s *Server) revokeAllTokens(ctx context.Context, username string) error {
+	if err := s.revocations.RevokeUser(ctx, username); err != nil {
+		return err
+	}
+	if err := s.refreshStore.RevokeUser(ctx, username); err != nil {
+		return err
+	}
+	return s.endUserSessions(ctx, username)
+}
+
+// forgotPassword mails a reset link to the user's address. Unknown users
+// are not reported to the caller, so accounts cannot be enumerated.
+func (s *Server) forgotPassword(ctx context.Context, username string) error {
+	user, err := s.userRepo.GetUser(ctx, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	token, err := s.resetTokens.Create(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	msg := &mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nUse the link below to choose a new password. "+
+			"It expires in %d minutes and can only be used once.\n\n%s/reset-password?token=%s\n\n"+
+			"If you did not ask for a password reset, you can ignore this message.\n",
+			username, int(PasswordResetDuration.Minutes()), s.appBaseURL, token),
+	}
+
+	// Sending in the background also keeps the response time the same
+	// for known and unknown users
+	s.sendMail(msg)
+	return nil
+}
+
+// resetPassword redeems a reset token, sets the new password and ends
+// every existing session of the user
+func (s *Server) resetPassword(ctx context.Context, token, newPassword string) error {
+	// The slot is taken first, so that shedding the request leaves the
+	// token usable for a retry
+	release, err := s.acquireHashSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The token is only redeemed once the password is accepted, so that a
+	// rejected password can be corrected with the same link
+	username, err := s.resetTokens.Peek(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if err := db.ValidCredentials(username, newPassword); err != nil {
+		return fmt.Errorf("validation: %w", err)
+	}
+
+	user, err := s.userRepo.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	if err := s.passwordPolicy.Check(newPassword, username, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := db.HashPassword(newPassword)
+	if err != nil {
+		return fmt.Errorf("internal: %w", err)
+	}
+	user.Password = hashedPassword
+
+	// GETDEL still lets only one of concurrent resets through
+	if _, err := s.resetTokens.Consume(ctx, token); err != nil {
+		return err
+	}
+
+	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	s.userCache.Delete(ctx, username)
+	return s.revokeAllTokens(ctx, username)
 }
 
 func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // or https://localhost:5173
+		w.Header().Set("Access-Control-Allow-Origin", s.corsOrigin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		// Lets the dashboard read when it may retry
+		w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"internal/clientip"
+	"internal/concurrency"
+	"internal/db"
+	"internal/mailer"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// memoryRepo stands in for Cassandra in handler tests
+type memoryRepo struct {
+	mutex    sync.Mutex
+	users    map[string]db.User
+	totp     map[string]db.TOTPSecret
+	sessions map[string]db.Session
+	audit    []*db.AuditEvent
+}
+
+var (
+	_ db.UserRepository  = (*memoryRepo)(nil)
+	_ db.TOTPRepository  = (*memoryRepo)(nil)
+	_ db.AuditRepository = (*memoryRepo)(nil)
+	_ db.SessionStore    = (*memoryRepo)(nil)
+)
+
+func newMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		users:    make(map[string]db.User),
+		totp:     make(map[string]db.TOTPSecret),
+		sessions: make(map[string]db.Session),
+	}
+}
+
+func (m *memoryRepo) Health(ctx context.Context) error { return nil }
+func (m *memoryRepo) Close()                           {}
+
+func (m *memoryRepo) GetUser(ctx context.Context, username string) (*db.User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return nil, db.ErrUserNotFound
+	}
+	user.Credentials = db.NewCredentials(user.Username, user.Password)
+	return &user, nil
+}
+
+func (m *memoryRepo) AddUser(ctx context.Context, user *db.User) error {
+	return m.UpdateUser(ctx, user)
+}
+
+func (m *memoryRepo) UpdateUser(ctx context.Context, user *db.User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored := *user
+	stored.Credentials = db.NewCredentials(user.Username, user.Password)
+	m.users[user.Username] = stored
+	return nil
+}
+
+func (m *memoryRepo) DeleteUser(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.users, username)
+	return nil
+}
+
+func (m *memoryRepo) UsernameExists(ctx context.Context, username string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.users[username]
+	return ok, nil
+}
+
+func (m *memoryRepo) ListUsers(ctx context.Context, pageSize int, pageState []byte) ([]*db.User, []byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var users []*db.User
+	for _, user := range m.users {
+		user.Credentials = db.NewCredentials(user.Username, user.Password)
+		users = append(users, &user)
+	}
+	return users, nil, nil
+}
+
+func (m *memoryRepo) Stats(ctx context.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+func (m *memoryRepo) GetTOTP(ctx context.Context, username string) (*db.TOTPSecret, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	secret, ok := m.totp[username]
+	if !ok {
+		return nil, db.ErrTOTPNotFound
+	}
+	secret.RecoveryCodes = append([]string(nil), secret.RecoveryCodes...)
+	return &secret, nil
+}
+
+func (m *memoryRepo) SaveTOTP(ctx context.Context, secret *db.TOTPSecret) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.totp[secret.Username] = *secret
+	return nil
+}
+
+func (m *memoryRepo) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	secret := m.totp[username]
+	for i, code := range secret.RecoveryCodes {
+		if code == codeHash {
+			secret.RecoveryCodes = append(secret.RecoveryCodes[:i:i], secret.RecoveryCodes[i+1:]...)
+			m.totp[username] = secret
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryRepo) DeleteTOTP(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.totp, username)
+	return nil
+}
+
+func (m *memoryRepo) AddAuditEvent(ctx context.Context, event *db.AuditEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.audit = append(m.audit, event)
+	return nil
+}
+
+func (m *memoryRepo) ListAuditEvents(ctx context.Context, username string, limit int) ([]*db.AuditEvent, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var events []*db.AuditEvent
+	for i := len(m.audit) - 1; i >= 0 && len(events) < limit; i-- {
+		if m.audit[i].Username == username {
+			events = append(events, m.audit[i])
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryRepo) AddSession(ctx context.Context, session *db.Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sessions[session.ID] = *session
+	return nil
+}
+
+func (m *memoryRepo) GetSession(ctx context.Context, id string) (*db.Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, db.ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (m *memoryRepo) ListSessions(ctx context.Context, username string) ([]*db.Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var sessions []*db.Session
+	for _, session := range m.sessions {
+		if session.Username == username {
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *memoryRepo) TouchSession(ctx context.Context, session *db.Session, lastSeen time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if stored, ok := m.sessions[session.ID]; ok {
+		stored.LastSeen = lastSeen
+		m.sessions[session.ID] = stored
+	}
+	return nil
+}
+
+func (m *memoryRepo) DeleteSession(ctx context.Context, session *db.Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, session.ID)
+	return nil
+}
+
+func (m *memoryRepo) DeleteUserSessions(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, session := range m.sessions {
+		if session.Username == username {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// testServer is a Server on miniredis and an in-memory repository
+type testServer struct {
+	*Server
+	redis *miniredis.Miniredis
+	repo  *memoryRepo
+	mail  *mailer.MemoryMailer
+}
+
+const (
+	testUsername = "testuser"
+	testPassword = "Tangerine-Orbit-42"
+	testEmail    = "test@example.com"
+)
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	redisConfig := &db.RedisConfig{Addr: mr.Addr(), DialTimeout: time.Second, KeyPrefix: "cache:user:", Expiration: time.Hour}
+	client, err := db.NewRedisClient(redisConfig)
+	if err != nil {
+		t.Fatalf("Failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	// The cheapest hashes keep the tests fast
+	hasher, err := db.NewPasswordHasher(&db.PasswordHasherConfig{Algorithm: db.AlgorithmBcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatalf("Failed to create password hasher: %v", err)
+	}
+	db.DefaultPasswordHasher = hasher
+
+	repo := newMemoryRepo()
+	mail := mailer.NewMemoryMailer()
+	jwtManager := NewJWTManager("test-secret")
+
+	server := &Server{
+		userRepo:       repo,
+		totpRepo:       repo,
+		totpSteps:      db.NewRedisTOTPStepStore(client, totpWindow),
+		audit:          repo,
+		userCache:      db.NewRedisRepoWithClient(client, redisConfig),
+		attempts:       db.NewRedisLoginAttemptStore(client, db.NewLockoutPolicy()),
+		refreshStore:   db.NewRedisRefreshStore(client, RefreshTokenDuration),
+		revocations:    db.NewRedisRevocationStore(client, jwtManager.maxAccessTokenDuration()),
+		sessionCache:   db.NewRedisSessionStore(client),
+		sessionRepo:    repo,
+		resetTokens:    db.NewRedisOneTimeStore(client, "auth:reset:", PasswordResetDuration),
+		verifyTokens:   db.NewRedisOneTimeStore(client, "auth:verify:", EmailVerificationDuration),
+		magicLinks:     db.NewRedisOneTimeStore(client, "auth:magic:", MagicLinkDuration),
+		mailer:         mail,
+		jwtmanager:     jwtManager,
+		clientIPs:      &clientip.Resolver{},
+		bans:           db.NewRedisBanStore(client),
+		banPolicy:      NewBanPolicy(),
+		hashLimiter:    concurrency.NewLimiter(concurrency.NewConfig()),
+		passwordPolicy: &db.PasswordPolicy{MinScore: 2},
+		appBaseURL:     "http://localhost:5173",
+
+		unverifiedPolicy: UnverifiedAllow,
+	}
+
+	return &testServer{Server: server, redis: mr, repo: repo, mail: mail}
+}
+
+// addUser stores a user with testPassword
+func (ts *testServer) addUser(t *testing.T, username, email string, verified bool) {
+	t.Helper()
+
+	hash, err := db.HashPassword(testPassword)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	user := db.NewUser(username, hash, email)
+	user.Verified = verified
+	ts.repo.AddUser(context.Background(), user)
+}
+
+// call sends a JSON request straight to handler and returns the recorded response
+func call(handler http.HandlerFunc, method, target string, payload any, token string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+
+	r := httptest.NewRequest(method, target, &body)
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// login logs the user in with testPassword and returns the access token
+func (ts *testServer) login(t *testing.T, username string) string {
+	t.Helper()
+
+	w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": username, "password": testPassword}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", w.Code, w.Body)
+	}
+
+	var tokens TokenResponse
+	json.NewDecoder(w.Body).Decode(&tokens)
+	return tokens.Token
+}
+
+// mailedToken waits for a message to address and returns the token in its link
+func (ts *testServer) mailedToken(t *testing.T, address, path string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if msg, ok := ts.mail.Last(address); ok && strings.Contains(msg.Body, path) {
+			_, link, _ := strings.Cut(msg.Body, path+"?")
+			query, err := url.ParseQuery(strings.Fields(link)[0])
+			if err != nil {
+				t.Fatalf("Invalid link in %q: %v", msg.Body, err)
+			}
+			return query.Get("token")
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No %s mail sent to %s", path, address)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestResetPasswordKeepsTokenForWeakPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+
+	w := call(ts.handleForgotPassword, http.MethodPost, "/v1/password/forgot", map[string]string{"username": testUsername}, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Forgot password failed: %d %s", w.Code, w.Body)
+	}
+	token := ts.mailedToken(t, testEmail, "/reset-password")
+
+	w = call(ts.handleResetPassword, http.MethodPost, "/v1/password/reset", map[string]string{"token": token, "new_password": "password123"}, "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a weak password to be rejected, got %d %s", w.Code, w.Body)
+	}
+
+	w = call(ts.handleResetPassword, http.MethodPost, "/v1/password/reset", map[string]string{"token": token, "new_password": "Velvet-Harbor-77"}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the same token to work after a rejected password, got %d %s", w.Code, w.Body)
+	}
+
+	user, _ := ts.repo.GetUser(context.Background(), testUsername)
+	if !db.CheckPasswordHash("Velvet-Harbor-77", user.Password) {
+		t.Fatal("Expected the new password to be stored")
+	}
+
+	w = call(ts.handleResetPassword, http.MethodPost, "/v1/password/reset", map[string]string{"token": token, "new_password": "Copper-Meadow-19"}, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the token to be spent after a reset, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// sessionTouchInterval limits how often last_seen is written for a busy session
+	sessionTouchInterval = time.Minute
+	// maxUserAgentLength bounds what is stored of a client's User-Agent
+	maxUserAgentLength = 256
+)
+
+var ErrSessionRevoked = errors.New("unauthorized: session revoked")
+
+// newSession describes the device a login request comes from. The session
+// is only stored once the login succeeds.
+func (s *Server) newSession(r *http.Request) *db.Session {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return &db.Session{
+		UserAgent: userAgent,
+		IP:        s.getClientIP(r),
+	}
+}
+
+// startSession stores a new session of username. Cassandra is the record;
+// Redis only caches it.
+func (s *Server) startSession(ctx context.Context, username string, session *db.Session) error {
+	id, err := db.GenerateToken(16)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.ID = id
+	session.Username = username
+	session.CreatedAt = now
+	session.LastSeen = now
+	session.ExpiresAt = now.Add(RefreshTokenDuration)
+
+	if err := s.sessionRepo.AddSession(ctx, session); err != nil {
+		return err
+	}
+	if err := s.sessionCache.AddSession(ctx, session); err != nil {
+		log.Printf("cache session %s: %v", session.ID, err)
+	}
+
+	return nil
+}
+
+// getSession reads the session from Redis, falling back to Cassandra
+func (s *Server) getSession(ctx context.Context, id string) (*db.Session, error) {
+	session, err := s.sessionCache.GetSession(ctx, id)
+	if err == nil {
+		return session, nil
+	}
+
+	session, err = s.sessionRepo.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.sessionCache.AddSession(ctx, session); err != nil {
+		log.Printf("cache session %s: %v", session.ID, err)
+	}
+	return session, nil
+}
+
+// checkSession rejects access tokens whose session has ended and records
+// that the session is still in use
+func (s *Server) checkSession(ctx context.Context, claims *JWTClaims) error {
+	if claims.SessionID == "" {
+		return nil
+	}
+
+	session, err := s.getSession(ctx, claims.SessionID)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if session.Username != claims.Username {
+		return ErrSessionRevoked
+	}
+
+	s.touchSession(ctx, session)
+	return nil
+}
+
+func (s *Server) touchSession(ctx context.Context, session *db.Session) {
+	now := time.Now()
+	if now.Sub(session.LastSeen) <= sessionTouchInterval {
+		return
+	}
+
+	if err := s.sessionCache.TouchSession(ctx, session, now); err != nil {
+		log.Printf("touch session %s: %v", session.ID, err)
+	}
+	if err := s.sessionRepo.TouchSession(ctx, session, now); err != nil {
+		log.Printf("touch session %s: %v", session.ID, err)
+	}
+}
+
+// listSessions returns the sessions of username. The cache is only
+// bypassed when it knows of none, e.g. after Redis lost its data.
+func (s *Server) listSessions(ctx context.Context, username string) ([]*db.Session, error) {
+	sessions, err := s.sessionCache.ListSessions(ctx, username)
+	if err != nil || len(sessions) == 0 {
+		sessions, err = s.sessionRepo.ListSessions(ctx, username)
+	}
+	return sessions, err
+}
+
+// endSession signs a session out: its refresh tokens stop working and its
+// access tokens are rejected from the next request on
+func (s *Server) endSession(ctx context.Context, session *db.Session) error {
+	if err := s.refreshStore.RevokeFamily(ctx, session.ID); err != nil {
+		return err
+	}
+	// Cassandra first, or the cache could be refilled from it
+	if err := s.sessionRepo.DeleteSession(ctx, session); err != nil {
+		return err
+	}
+	return s.sessionCache.DeleteSession(ctx, session)
+}
+
+// endUserSessions forgets every session of username. Callers revoke the
+// tokens themselves.
+func (s *Server) endUserSessions(ctx context.Context, username string) error {
+	if err := s.sessionRepo.DeleteUserSessions(ctx, username); err != nil {
+		return err
+	}
+	return s.sessionCache.DeleteUserSessions(ctx, username)
+}
+
+// revokeSession ends a session of username; sessions of other users are
+// reported as not found
+func (s *Server) revokeSession(ctx context.Context, username, id string) error {
+	session, err := s.getSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if session.Username != username {
+		return db.ErrSessionNotFound
+	}
+
+	return s.endSession(ctx, session)
+}
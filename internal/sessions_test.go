@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"testing"
+)
+
+func TestSessionRefillRacingSignOut(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	ctx := context.Background()
+
+	ts.login(t, testUsername)
+	sessions, err := ts.sessionRepo.ListSessions(ctx, testUsername)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("Expected one session, got %d (%v)", len(sessions), err)
+	}
+	id := sessions[0].ID
+
+	// The cache lost the session, so getSession reads it from the record...
+	ts.redis.Del("auth:session:id:" + id)
+	stale, err := ts.sessionRepo.GetSession(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+
+	// ...while the user signs the session out...
+	if err := ts.endSession(ctx, stale); err != nil {
+		t.Fatalf("endSession failed: %v", err)
+	}
+
+	// ...and only then refills the cache
+	if err := ts.sessionCache.AddSession(ctx, stale); err != nil {
+		t.Fatalf("AddSession failed: %v", err)
+	}
+
+	if _, err := ts.getSession(ctx, id); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Fatalf("Expected the signed out session to stay revoked, got %v", err)
+	}
+	if err := ts.checkSession(ctx, &JWTClaims{Username: testUsername, SessionID: id}); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("Expected access tokens of the session to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"context"
+	"internal/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, keyStr, err := db.NewAPIKey("testuser", "batch job", []string{db.ScopeAdsRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewAPIKey failed: %v", err)
+	}
+	if !strings.HasPrefix(keyStr, "bcr_"+key.Prefix+"_") {
+		t.Fatalf("Key %q does not start with its prefix %q", keyStr, key.Prefix)
+	}
+	if strings.Contains(key.SecretHash, keyStr[len("bcr_")+len(key.Prefix)+1:]) {
+		t.Fatal("Secret must not be stored in clear")
+	}
+
+	prefix, secret, err := db.ParseAPIKey(keyStr)
+	if err != nil || prefix != key.Prefix {
+		t.Fatalf("ParseAPIKey returned %q, %v", prefix, err)
+	}
+
+	now := time.Now()
+	if !key.Verify(secret, now) {
+		t.Error("Expected the secret to verify")
+	}
+	if key.Verify(secret+"x", now) {
+		t.Error("A different secret should not verify")
+	}
+	if key.Verify(secret, now.Add(2*time.Hour)) {
+		t.Error("An expired key should not verify")
+	}
+
+	for _, bad := range []string{"", "bcr_", "bcr_abc_secret", "xyz_" + keyStr[4:]} {
+		if _, _, err := db.ParseAPIKey(bad); err == nil {
+			t.Errorf("ParseAPIKey(%q) should fail", bad)
+		}
+	}
+
+	if _, _, err := db.NewAPIKey("testuser", "admin", []string{db.ScopeAccount}, time.Hour); err == nil {
+		t.Error("The account scope must not be grantable")
+	}
+	if _, _, err := db.NewAPIKey("testuser", "empty", nil, time.Hour); err == nil {
+		t.Error("A key without scopes should be rejected")
+	}
+}
+
+func TestCassandraAPIKeys(t *testing.T) {
+	repo, err := db.NewCassandraRepo(db.NewCassandraConfig("backend", "BPass0319", "cass_keyspace"))
+	if err != nil {
+		t.Skipf("Skipping test: failed to connect to Cassandra: %v", err)
+		return
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	_ = repo.DeleteUserAPIKeys(ctx, "testuser")
+
+	key, _, err := db.NewAPIKey("testuser", "batch job", []string{db.ScopeAdsRead, db.ScopeProfileRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewAPIKey failed: %v", err)
+	}
+	if err := repo.AddAPIKey(ctx, key); err != nil {
+		t.Fatalf("AddAPIKey failed: %v", err)
+	}
+
+	stored, err := repo.GetAPIKey(ctx, key.Prefix)
+	if err != nil {
+		t.Fatalf("GetAPIKey failed: %v", err)
+	}
+	if stored.Username != "testuser" || stored.SecretHash != key.SecretHash || len(stored.Scopes) != 2 {
+		t.Errorf("Stored key doesn't match: %+v", stored)
+	}
+
+	if err := repo.TouchAPIKey(ctx, key.Prefix, time.Now()); err != nil {
+		t.Errorf("TouchAPIKey failed: %v", err)
+	}
+
+	keys, err := repo.ListAPIKeys(ctx, "testuser")
+	if err != nil || len(keys) != 1 || keys[0].LastUsed.IsZero() {
+		t.Errorf("Expected one used key, got %d (%v)", len(keys), err)
+	}
+
+	if err := repo.DeleteAPIKey(ctx, key); err != nil {
+		t.Fatalf("DeleteAPIKey failed: %v", err)
+	}
+	if _, err := repo.GetAPIKey(ctx, key.Prefix); err != db.ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	// A request still holding the key must not bring its row back
+	if err := repo.TouchAPIKey(ctx, key.Prefix, time.Now()); err != db.ErrAPIKeyNotFound {
+		t.Errorf("Expected touching a revoked key to fail with ErrAPIKeyNotFound, got %v", err)
+	}
+	if _, err := repo.GetAPIKey(ctx, key.Prefix); err != db.ErrAPIKeyNotFound {
+		t.Errorf("Expected the revoked key to stay deleted, got %v", err)
+	}
+}
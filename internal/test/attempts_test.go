@@ -0,0 +1,192 @@
+package test
+
+import (
+	"context"
+	"internal/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptStore(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisLoginAttemptStore(client, db.NewLockoutPolicy())
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	mr.SetTime(now)
+
+	attempts, err := store.Get(ctx, "testuser")
+	if err != nil || attempts.Failures != 0 || !attempts.LockedUntil.IsZero() {
+		t.Fatalf("Unknown user should have no failures: %+v %v", attempts, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		reservation, err := store.Reserve(ctx, "testuser")
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if !reservation.Allowed || reservation.Failures != i {
+			t.Fatalf("Expected attempt %d to be allowed, got %+v", i, reservation)
+		}
+	}
+
+	attempts, _ = store.Get(ctx, "testuser")
+	if attempts.Failures != 3 || !attempts.LastFailure.Equal(now) {
+		t.Fatalf("Unexpected state after failures: %+v", attempts)
+	}
+
+	// Unlock clears everything
+	if err := store.Reset(ctx, "testuser"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	attempts, _ = store.Get(ctx, "testuser")
+	if attempts.Failures != 0 || !attempts.LockedUntil.IsZero() {
+		t.Fatalf("Expected clean state after reset: %+v", attempts)
+	}
+
+	// Failures are forgotten after the window
+	store.Reserve(ctx, "testuser")
+	mr.FastForward(2 * time.Hour)
+	attempts, _ = store.Get(ctx, "testuser")
+	if attempts.Failures != 0 {
+		t.Fatalf("Failures should expire, got %d", attempts.Failures)
+	}
+}
+
+func TestLoginAttemptBackoff(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	policy := db.NewLockoutPolicy()
+	store := db.NewRedisLoginAttemptStore(client, policy)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	mr.SetTime(now)
+
+	for i := 0; i < policy.BackoffAfter; i++ {
+		store.Reserve(ctx, "testuser")
+	}
+
+	// Each further failure doubles the delay, up to MaxDelay
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		reservation, err := store.Reserve(ctx, "testuser")
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if reservation.Allowed || reservation.Locked || reservation.RetryAfter != delay {
+			t.Fatalf("Expected a backoff of %s, got %+v", delay, reservation)
+		}
+
+		mr.SetTime(now.Add(delay - time.Millisecond))
+		if reservation, _ := store.Reserve(ctx, "testuser"); reservation.Allowed {
+			t.Fatalf("Attempt allowed before the %s delay passed", delay)
+		}
+
+		now = now.Add(delay)
+		mr.SetTime(now)
+		if reservation, _ := store.Reserve(ctx, "testuser"); !reservation.Allowed {
+			t.Fatalf("Attempt not allowed after the %s delay: %+v", delay, reservation)
+		}
+	}
+
+	// Rejected attempts are not counted
+	attempts, _ := store.Get(ctx, "testuser")
+	if attempts.Failures != policy.BackoffAfter+3 {
+		t.Fatalf("Expected %d failures, got %d", policy.BackoffAfter+3, attempts.Failures)
+	}
+}
+
+func TestLoginAttemptLock(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	policy := &db.LockoutPolicy{LockAfter: 3, LockDuration: 15 * time.Minute, BackoffAfter: 100, Window: time.Hour}
+	store := db.NewRedisLoginAttemptStore(client, policy)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	mr.SetTime(now)
+
+	var reservation *db.LoginReservation
+	for i := 0; i < policy.LockAfter; i++ {
+		reservation, _ = store.Reserve(ctx, "testuser")
+	}
+	if !reservation.Allowed || !reservation.Locked {
+		t.Fatalf("Expected the last allowed attempt to lock, got %+v", reservation)
+	}
+
+	attempts, _ := store.Get(ctx, "testuser")
+	if !attempts.LockedUntil.Equal(now.Add(policy.LockDuration)) {
+		t.Fatalf("Unexpected lock: %+v", attempts)
+	}
+
+	mr.SetTime(now.Add(time.Minute))
+	reservation, _ = store.Reserve(ctx, "testuser")
+	if reservation.Allowed || !reservation.Locked || reservation.RetryAfter != 14*time.Minute {
+		t.Fatalf("Expected the account to be locked, got %+v", reservation)
+	}
+
+	mr.SetTime(now.Add(policy.LockDuration))
+	if reservation, _ = store.Reserve(ctx, "testuser"); !reservation.Allowed {
+		t.Fatalf("Expected the lock to expire, got %+v", reservation)
+	}
+}
+
+func TestLoginAttemptRelease(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	policy := &db.LockoutPolicy{BackoffAfter: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, LockAfter: 2, LockDuration: time.Hour, Window: time.Hour}
+	store := db.NewRedisLoginAttemptStore(client, policy)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	mr.SetTime(now)
+
+	store.Reserve(ctx, "testuser")
+
+	later := now.Add(time.Minute)
+	mr.SetTime(later)
+	reservation, _ := store.Reserve(ctx, "testuser")
+	if !reservation.Allowed || !reservation.Locked {
+		t.Fatalf("Expected the second attempt to lock, got %+v", reservation)
+	}
+
+	// Releasing restores the counter, the last failure and the lock
+	if err := store.Release(ctx, "testuser", reservation); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	attempts, _ := store.Get(ctx, "testuser")
+	if attempts.Failures != 1 || !attempts.LastFailure.Equal(now) || !attempts.LockedUntil.IsZero() {
+		t.Fatalf("Unexpected state after release: %+v", attempts)
+	}
+	if reservation, _ := store.Reserve(ctx, "testuser"); !reservation.Allowed {
+		t.Fatalf("Expected no backoff after release, got %+v", reservation)
+	}
+}
+
+func TestLoginAttemptConcurrentReservations(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	policy := db.NewLockoutPolicy()
+	store := db.NewRedisLoginAttemptStore(client, policy)
+	ctx := context.Background()
+	mr.SetTime(time.Now())
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, err := store.Reserve(ctx, "testuser")
+			if err != nil {
+				t.Errorf("Reserve failed: %v", err)
+				return
+			}
+			if reservation.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Parallel guesses cannot get past the first backoff
+	if allowed != policy.BackoffAfter {
+		t.Fatalf("Expected %d allowed attempts, got %d", policy.BackoffAfter, allowed)
+	}
+}
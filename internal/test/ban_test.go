@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisBanStore(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisBanStore(client)
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "203.0.113.9"); !errors.Is(err, db.ErrBanNotFound) {
+		t.Fatalf("Expected no ban, got %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		violations, err := store.RecordViolation(ctx, "203.0.113.9", time.Minute)
+		if err != nil || violations != i {
+			t.Fatalf("Expected %d violations, got %d %v", i, violations, err)
+		}
+	}
+
+	// Violations are counted per period from the first one
+	mr.FastForward(time.Minute)
+	if violations, _ := store.RecordViolation(ctx, "203.0.113.9", time.Minute); violations != 1 {
+		t.Fatalf("Expected the period to restart, got %d violations", violations)
+	}
+
+	for i := 1; i <= 2; i++ {
+		level, err := store.NextLevel(ctx, "203.0.113.9", time.Hour)
+		if err != nil || level != i {
+			t.Fatalf("Expected level %d, got %d %v", i, level, err)
+		}
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	ban := &db.Ban{IP: "203.0.113.9", Reason: "test", Since: now, Until: now.Add(15 * time.Minute), Level: 2}
+	if err := store.Ban(ctx, ban); err != nil {
+		t.Fatalf("Ban failed: %v", err)
+	}
+	store.Ban(ctx, &db.Ban{IP: "2001:db8::1", Reason: "test", Since: now, Until: now.Add(30 * time.Minute), Level: 1})
+
+	got, err := store.Get(ctx, "203.0.113.9")
+	if err != nil || got.Level != 2 || !got.Until.Equal(ban.Until) || got.Reason != "test" {
+		t.Fatalf("Unexpected ban: %+v %v", got, err)
+	}
+
+	// Banning clears the violations that led to it
+	if violations, _ := store.RecordViolation(ctx, "203.0.113.9", time.Minute); violations != 1 {
+		t.Fatalf("Expected violations to restart after a ban, got %d", violations)
+	}
+
+	bans, err := store.List(ctx)
+	if err != nil || len(bans) != 2 || bans[0].IP != "2001:db8::1" {
+		t.Fatalf("Expected both bans, longest first: %+v %v", bans, err)
+	}
+
+	if err := store.Lift(ctx, "203.0.113.9"); err != nil {
+		t.Fatalf("Lift failed: %v", err)
+	}
+	if _, err := store.Get(ctx, "203.0.113.9"); !errors.Is(err, db.ErrBanNotFound) {
+		t.Fatalf("Expected the ban to be lifted, got %v", err)
+	}
+	// Lifting also forgets the escalation
+	if level, _ := store.NextLevel(ctx, "203.0.113.9", time.Hour); level != 1 {
+		t.Fatalf("Expected level 1 after lift, got %d", level)
+	}
+	if err := store.Lift(ctx, "198.51.100.1"); !errors.Is(err, db.ErrBanNotFound) {
+		t.Fatalf("Expected unknown ban to be reported, got %v", err)
+	}
+
+	// Bans expire on their own
+	mr.FastForward(30 * time.Minute)
+	if bans, _ := store.List(ctx); len(bans) != 0 {
+		t.Fatalf("Expected bans to expire: %+v", bans)
+	}
+}
+
+func TestRedisBanStoreConcurrentViolations(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisBanStore(client)
+	ctx := context.Background()
+
+	const burst = 50
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			violations, err := store.RecordViolation(ctx, "203.0.113.9", time.Minute)
+			if err != nil {
+				t.Errorf("RecordViolation failed: %v", err)
+				return
+			}
+			mu.Lock()
+			seen[violations] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Every count is handed out once, so exactly one call sees the threshold
+	for i := 1; i <= burst; i++ {
+		if !seen[i] {
+			t.Fatalf("Count %d was never returned: %v", i, seen)
+		}
+	}
+	if ttl := mr.TTL("auth:banstrikes:203.0.113.9"); ttl != time.Minute {
+		t.Fatalf("Expected the period to start with the first violation, TTL %s", ttl)
+	}
+}
@@ -3,6 +3,8 @@ package test
 import (
 	"context"
 	"internal/db"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -67,20 +69,46 @@ func TestCassandraRepo(t *testing.T) {
 	if user.Username != "testuser" || user.Email != "test@example.com" || user.Category != 1 {
 		t.Error("Retrieved user doesn't match expected")
 	}
+	if user.Role != db.RoleUser || user.Disabled {
+		t.Errorf("Expected an enabled user role by default, got %q disabled=%t", user.Role, user.Disabled)
+	}
 
 	// Test UpdateUser
 	testUser.Email = "updated@example.com"
 	testUser.Category = 2
+	testUser.Role = db.RoleSupport
+	testUser.Disabled = true
 	if err := repo.UpdateUser(ctx, testUser); err != nil {
 		t.Errorf("UpdateUser failed: %v", err)
 	}
 
 	// Verify update
 	updatedUser, _ := repo.GetUser(ctx, "testuser")
-	if updatedUser.Email != "updated@example.com" || updatedUser.Category != 2 {
+	if updatedUser.Email != "updated@example.com" || updatedUser.Category != 2 ||
+		updatedUser.Role != db.RoleSupport || !updatedUser.Disabled {
 		t.Error("User was not updated correctly")
 	}
 
+	// Test ListUsers pages through every user
+	found := false
+	var page []byte
+	for {
+		users, next, err := repo.ListUsers(ctx, 10, page)
+		if err != nil {
+			t.Fatalf("ListUsers failed: %v", err)
+		}
+		for _, u := range users {
+			found = found || u.Username == "testuser"
+		}
+		if next == nil {
+			break
+		}
+		page = next
+	}
+	if !found {
+		t.Error("ListUsers did not return the test user")
+	}
+
 	// Test UpdateUser for non-existent user
 	nonExistentUser := &db.User{
 		Credentials: &db.Credentials{Username: "nonexistent", Password: "pass"},
@@ -109,3 +137,87 @@ func TestCassandraRepo(t *testing.T) {
 		t.Error("Expected error when deleting non-existent user")
 	}
 }
+
+func TestCassandraMigrate(t *testing.T) {
+	repo, err := db.NewCassandraRepo(db.NewCassandraConfig("backend", "BPass0319", "cass_keyspace"))
+	if err != nil {
+		t.Skipf("Skipping test: failed to connect to Cassandra: %v", err)
+		return
+	}
+	defer repo.Close()
+
+	// Running it against an up to date schema must be a no-op
+	for i := 0; i < 2; i++ {
+		if err := repo.Migrate(context.Background()); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+	}
+}
+
+func TestCassandraTOTP(t *testing.T) {
+	repo, err := db.NewCassandraRepo(db.NewCassandraConfig("backend", "BPass0319", "cass_keyspace"))
+	if err != nil {
+		t.Skipf("Skipping test: failed to connect to Cassandra: %v", err)
+		return
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	_ = repo.DeleteTOTP(ctx, "testuser")
+
+	if _, err := repo.GetTOTP(ctx, "testuser"); err != db.ErrTOTPNotFound {
+		t.Errorf("Expected ErrTOTPNotFound, got %v", err)
+	}
+
+	secret := &db.TOTPSecret{
+		Username:      "testuser",
+		Secret:        "JBSWY3DPEHPK3PXP",
+		Enabled:       true,
+		RecoveryCodes: []string{db.HashToken("code1"), db.HashToken("code2")},
+	}
+	if err := repo.SaveTOTP(ctx, secret); err != nil {
+		t.Fatalf("SaveTOTP failed: %v", err)
+	}
+
+	// A recovery code can only be used once
+	if ok, err := repo.UseRecoveryCode(ctx, "testuser", db.HashToken("code1")); err != nil || !ok {
+		t.Errorf("Expected recovery code to be accepted: %v", err)
+	}
+	if ok, _ := repo.UseRecoveryCode(ctx, "testuser", db.HashToken("code1")); ok {
+		t.Error("Recovery code should not be accepted twice")
+	}
+
+	// Concurrent uses of the same code are accepted exactly once
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := repo.UseRecoveryCode(ctx, "testuser", db.HashToken("code2"))
+			if err != nil {
+				t.Errorf("UseRecoveryCode failed: %v", err)
+			}
+			if ok {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected the recovery code to be accepted once, got %d", n)
+	}
+
+	if ok, err := repo.UseRecoveryCode(ctx, "nobody", db.HashToken("code1")); err != nil || ok {
+		t.Errorf("Expected no recovery code for an unknown user, got %v, %v", ok, err)
+	}
+
+	stored, err := repo.GetTOTP(ctx, "testuser")
+	if err != nil || !stored.Enabled || len(stored.RecoveryCodes) != 0 {
+		t.Errorf("Unexpected stored enrollment: %+v, %v", stored, err)
+	}
+
+	if err := repo.DeleteTOTP(ctx, "testuser"); err != nil {
+		t.Errorf("DeleteTOTP failed: %v", err)
+	}
+}
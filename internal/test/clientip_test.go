@@ -0,0 +1,119 @@
+package test
+
+import (
+	"bufio"
+	"errors"
+	"internal/clientip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", " "}
+
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer", "X-Forwarded-For", "198.51.100.7:4000", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "198.51.100.7"},
+		{"no headers", "X-Forwarded-For", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"single proxy", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"spoofed first hop", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"proxy chain", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "203.0.113.9, 192.0.2.1, 10.1.1.1"}, "203.0.113.9"},
+		{"unreadable hop", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "garbage, 10.1.1.1"}, "10.1.1.1"},
+		{"spoofed forwarded", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"spoofed real ip", "X-Forwarded-For", "10.0.0.1:4000", map[string]string{"X-Real-IP": "1.2.3.4"}, "10.0.0.1"},
+		{"mapped ipv4", "X-Forwarded-For", "[::ffff:10.0.0.1]:4000", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"forwarded", "Forwarded", "10.0.0.1:4000", map[string]string{"Forwarded": `for="[2001:db8::1]:443";proto=https, for=10.1.1.1`}, "2001:db8::1"},
+		{"forwarded obfuscated", "Forwarded", "10.0.0.1:4000", map[string]string{"Forwarded": "for=_hidden, for=10.1.1.1"}, "10.1.1.1"},
+		{"spoofed x-forwarded-for", "Forwarded", "10.0.0.1:4000", map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "1.2.3.4"}, "203.0.113.9"},
+		{"forwarded missing", "Forwarded", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1"},
+		{"real ip", "x-real-ip", "10.0.0.1:4000", map[string]string{"X-Real-IP": "203.0.113.9"}, "203.0.113.9"},
+		{"real ip ignores others", "X-Real-IP", "10.0.0.1:4000", map[string]string{"X-Real-IP": "203.0.113.9", "Forwarded": "for=1.2.3.4"}, "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := clientip.NewResolver(tt.header, trusted...)
+			if err != nil {
+				t.Fatalf("Failed to create resolver: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			if got := resolver.ClientIP(req).String(); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := clientip.NewResolver("X-Forwarded-For", "10.0.0.0/33"); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+	if _, err := clientip.NewResolver("True-Client-IP", trusted...); err == nil {
+		t.Error("Expected an unsupported header to be rejected")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0c" +
+		"\xcb\x00\x71\x09" + "\x0a\x00\x00\x01" + "\x1f\x90" + "\x20\xfb"
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.9 10.0.0.1 8080 8443\r\n", "203.0.113.9:8080"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 8080 8443\r\n", "[2001:db8::1]:8080"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ""},
+		{"v2 tcp4", v2, "203.0.113.9:8080"},
+		{"v2 local", "\r\n\r\n\x00\r\nQUIT\n" + "\x20\x00\x00\x00", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n"))
+			addr, err := clientip.ReadProxyHeader(r)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+
+			// The request after the header is left for the server
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("Expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.9 10.0.0.1 8080\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 8080 8443\r\n",
+		"PROXY TCP4 203.0.113.9 10.0.0.1 8080 8443\n",
+	} {
+		_, err := clientip.ReadProxyHeader(bufio.NewReader(strings.NewReader(header)))
+		if !errors.Is(err, clientip.ErrInvalidProxyHeader) {
+			t.Errorf("Expected %q to be rejected, got %v", header, err)
+		}
+	}
+}
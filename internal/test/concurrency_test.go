@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/concurrency"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLimiterConfig() *concurrency.Config {
+	return &concurrency.Config{
+		InitialLimit: 2,
+		MinLimit:     1,
+		MaxLimit:     4,
+		Target:       50 * time.Millisecond,
+		Backoff:      0.5,
+		MaxQueue:     1,
+		MaxWait:      100 * time.Millisecond,
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	limiter := concurrency.NewLimiter(testLimiterConfig())
+	ctx := context.Background()
+
+	first, err := limiter.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Expected the first task to run: %v", err)
+	}
+	second, err := limiter.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Expected the second task to run: %v", err)
+	}
+
+	// The third waits in the queue and gets the first slot given back
+	admitted := make(chan error, 1)
+	go func() {
+		release, err := limiter.Acquire(ctx)
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.Stats().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the third task to be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue holds one task, so the fourth is shed at once
+	_, err = limiter.Acquire(ctx)
+	var overloadErr *concurrency.OverloadError
+	if !errors.As(err, &overloadErr) || overloadErr.Reason != concurrency.ReasonQueueFull || overloadErr.RetryAfter <= 0 {
+		t.Fatalf("Expected a full queue to shed the task, got %v", err)
+	}
+
+	first()
+	if err := <-admitted; err != nil {
+		t.Fatalf("Expected the queued task to run: %v", err)
+	}
+	second()
+
+	if stats := limiter.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("Expected every slot to be given back: %+v", stats)
+	}
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	config := testLimiterConfig()
+	config.InitialLimit = 1
+	limiter := concurrency.NewLimiter(config)
+	ctx := context.Background()
+
+	release, _ := limiter.Acquire(ctx)
+	defer release()
+
+	start := time.Now()
+	_, err := limiter.Acquire(ctx)
+	var overloadErr *concurrency.OverloadError
+	if !errors.As(err, &overloadErr) || overloadErr.Reason != concurrency.ReasonTimeout {
+		t.Fatalf("Expected the wait to time out, got %v", err)
+	}
+	if waited := time.Since(start); waited < config.MaxWait {
+		t.Errorf("Expected to wait %v before giving up, waited %v", config.MaxWait, waited)
+	}
+
+	// A cancelled request leaves the queue without counting as shed
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limiter.Acquire(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the context error, got %v", err)
+	}
+	if queued := limiter.Stats().Queued; queued != 0 {
+		t.Fatalf("Expected the queue to be empty, got %d", queued)
+	}
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	config := testLimiterConfig()
+	limiter := concurrency.NewLimiter(config)
+	ctx := context.Background()
+
+	// Fast tasks raise the limit up to the maximum
+	for i := 0; i < 20; i++ {
+		release, err := limiter.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("Acquire failed: %v", err)
+		}
+		release()
+	}
+	if limit := limiter.Stats().Limit; limit != config.MaxLimit {
+		t.Fatalf("Expected the limit to grow to %d, got %d", config.MaxLimit, limit)
+	}
+
+	// A slow task cuts it multiplicatively, never below the minimum
+	for i := 0; i < 3; i++ {
+		release, _ := limiter.Acquire(ctx)
+		time.Sleep(config.Target + 10*time.Millisecond)
+		release()
+	}
+	if limit := limiter.Stats().Limit; limit != config.MinLimit {
+		t.Fatalf("Expected the limit to drop to %d, got %d", config.MinLimit, limit)
+	}
+}
+
+func TestConcurrencyLimiterParallel(t *testing.T) {
+	config := testLimiterConfig()
+	config.MaxQueue = 100
+	config.MaxWait = time.Second
+	limiter := concurrency.NewLimiter(config)
+
+	var (
+		mutex   sync.Mutex
+		running int
+		peak    int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			mutex.Lock()
+			running++
+			peak = max(peak, running)
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if peak > config.MaxLimit {
+		t.Fatalf("Expected at most %d tasks at once, saw %d", config.MaxLimit, peak)
+	}
+}
+
+func TestConcurrencyConfigValidate(t *testing.T) {
+	if err := concurrency.NewConfig().Validate(); err != nil {
+		t.Fatalf("Expected the default configuration to be valid: %v", err)
+	}
+
+	for _, change := range []func(*concurrency.Config){
+		func(c *concurrency.Config) { c.MinLimit = 0 },
+		func(c *concurrency.Config) { c.InitialLimit = c.MaxLimit + 1 },
+		func(c *concurrency.Config) { c.Backoff = 1 },
+		func(c *concurrency.Config) { c.Target = 0 },
+	} {
+		config := concurrency.NewConfig()
+		change(config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
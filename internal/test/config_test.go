@@ -0,0 +1,144 @@
+package test
+
+import (
+	"internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Expected the defaults to be valid: %v", err)
+	}
+	if cfg.Server.Addr != ":8443" || cfg.Redis.Addr != "localhost:6379" || cfg.Auth.AccessTokenDuration != 15*time.Minute {
+		t.Fatalf("Unexpected defaults: %+v", cfg)
+	}
+
+	if _, err := config.Load("../config.example.yaml"); err != nil {
+		t.Fatalf("Expected the example configuration to load: %v", err)
+	}
+}
+
+func TestConfigFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  addr: ":9443"
+  cors_origin: https://dashboard.example.com
+cassandra:
+  hosts: [cass-1, cass-2]
+rate_limit:
+  default_limit: 20
+  default_window: 30s
+`)
+	t.Setenv("REDIS_ADDR", "redis.internal:6379")
+	t.Setenv("CASS_HOSTS", "cass-3, cass-4")
+	t.Setenv("ACCESS_TOKEN_DURATION", "5m")
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Server.Addr != ":9443" || cfg.Server.CORSOrigin != "https://dashboard.example.com" {
+		t.Errorf("Expected the file to set the server section, got %+v", cfg.Server)
+	}
+	if cfg.RateLimit.DefaultLimit != 20 || cfg.RateLimit.DefaultWindow != 30*time.Second {
+		t.Errorf("Expected the file to set the default rate limit, got %+v", cfg.RateLimit)
+	}
+	// Keys missing from the file keep their defaults
+	if cfg.Server.MetricsAddr != "0.0.0.0:8080" || cfg.RateLimit.Backend != "memory" {
+		t.Errorf("Expected unset keys to keep their defaults, got %+v", cfg)
+	}
+	// The environment wins over the file
+	if strings.Join(cfg.Cassandra.Hosts, ",") != "cass-3,cass-4" {
+		t.Errorf("Expected CASS_HOSTS to override the file, got %v", cfg.Cassandra.Hosts)
+	}
+	if cfg.Redis.Addr != "redis.internal:6379" || cfg.Auth.AccessTokenDuration != 5*time.Minute {
+		t.Errorf("Expected the environment to override the defaults, got %+v %+v", cfg.Redis, cfg.Auth)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, data := range []string{
+		"server:\n  adress: \":8443\"\n",
+		"rate_limit:\n  default_window: soon\n",
+		"not yaml: [",
+	} {
+		if _, err := config.Load(writeConfig(t, data)); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+
+	t.Setenv("REDIS_DB", "first")
+	if _, err := config.Load(""); err == nil || !strings.Contains(err.Error(), "REDIS_DB") {
+		t.Errorf("Expected an unparsable variable to be named, got %v", err)
+	}
+	t.Setenv("REDIS_DB", "")
+
+	// Every problem is reported at once
+	path := writeConfig(t, `
+server:
+  trusted_proxy_header: True-Client-IP
+auth:
+  unverified_policy: never
+  access_token_duration: 72h
+rate_limit:
+  backend: memcached
+`)
+	_, err := config.Load(path)
+	if err == nil {
+		t.Fatal("Expected the configuration to be rejected")
+	}
+	for _, key := range []string{"server.trusted_proxy_header", "auth.unverified_policy", "auth.access_token_duration", "rate_limit.backend"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected %s in %v", key, err)
+		}
+	}
+
+	if _, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file to be an error, got %v", err)
+	}
+}
+
+func TestConfigProductionSecrets(t *testing.T) {
+	t.Setenv("APP_ENV", config.Production)
+
+	_, err := config.Load("")
+	if err == nil {
+		t.Fatal("Expected the development secrets to be rejected in production")
+	}
+	for _, key := range []string{"cassandra.password", "redis.password", "auth.jwt_secret"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected %s in %v", key, err)
+		}
+	}
+
+	t.Setenv("CASS_PASSWORD", "cassandra-production-password")
+	t.Setenv("REDIS_PASSWORD", "redis-production-password")
+	t.Setenv("JWT_SECRET", "short")
+	if _, err := config.Load(""); err == nil || !strings.Contains(err.Error(), "at least") {
+		t.Errorf("Expected a short JWT secret to be rejected, got %v", err)
+	}
+
+	t.Setenv("JWT_SECRET", strings.Repeat("x", 32))
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Expected production secrets to be accepted: %v", err)
+	}
+	if cfg.Environment != config.Production {
+		t.Fatalf("Expected the production environment, got %q", cfg.Environment)
+	}
+}
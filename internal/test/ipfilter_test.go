@@ -0,0 +1,86 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/ipfilter"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPLists(t *testing.T) {
+	lists, err := ipfilter.ParseLists([]byte(`{"allow": ["198.51.100.7", "10.0.0.0/8"], "deny": ["198.51.100.0/24", "2001:db8::/32"]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse lists: %v", err)
+	}
+
+	tests := map[string]ipfilter.Verdict{
+		"198.51.100.7":        ipfilter.Allowed,
+		"198.51.100.8":        ipfilter.Denied,
+		"::ffff:198.51.100.8": ipfilter.Denied,
+		"2001:db8::1":         ipfilter.Denied,
+		"10.1.2.3":            ipfilter.Allowed,
+		"203.0.113.9":         ipfilter.Unlisted,
+		"2001:db9::1":         ipfilter.Unlisted,
+	}
+	for addr, want := range tests {
+		if got := lists.Check(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: expected verdict %d, got %d", addr, want, got)
+		}
+	}
+
+	if got := lists.Check(netip.Addr{}); got != ipfilter.Unlisted {
+		t.Errorf("Expected an unknown address to be unlisted, got %d", got)
+	}
+
+	for _, data := range []string{`{"deny": ["not-an-ip"]}`, `{"allow": ["10.0.0.0/40"]}`, `[]`} {
+		if _, err := ipfilter.ParseLists([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestIPFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip-lists.json")
+	addr := netip.MustParseAddr("203.0.113.9")
+
+	filter, err := ipfilter.NewFilter(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a missing file to be reported, got %v", err)
+	}
+	if filter.Check(addr) != ipfilter.Unlisted {
+		t.Fatal("Expected empty lists without a file")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"deny": ["203.0.113.0/24"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Reload(); err != nil || filter.Check(addr) != ipfilter.Denied {
+		t.Fatalf("Expected the denylist to be loaded: %v", err)
+	}
+
+	// Broken content keeps the previous lists
+	os.WriteFile(path, []byte(`{"deny": [`), 0o600)
+	if err := filter.Reload(); err == nil || filter.Check(addr) != ipfilter.Denied {
+		t.Fatalf("Expected the previous lists to be kept: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go filter.Watch(ctx, 10*time.Millisecond, func(error) {})
+
+	os.WriteFile(path, []byte(`{"allow": ["203.0.113.9"]}`), 0o600)
+	// Make the change visible even on filesystems with coarse timestamps
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	deadline := time.Now().Add(time.Second)
+	for filter.Check(addr) != ipfilter.Allowed {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the watcher to reload the changed file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
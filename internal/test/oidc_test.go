@@ -0,0 +1,487 @@
+package test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"internal/db"
+	"internal/oidc"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var oidcTestKey = []byte("oidc-test-signing-key")
+
+// oidcTestBackend signs everything with HS256. Login sessions are
+// represented by "Bearer session:<username>".
+type oidcTestBackend struct{}
+
+type oidcAccessClaims struct {
+	Scope string `json:"scope"`
+	Actor string `json:"actor,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (oidcTestBackend) SessionUser(r *http.Request) (string, error) {
+	username, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer session:")
+	if !ok {
+		return "", errors.New("no session")
+	}
+	return username, nil
+}
+
+func (oidcTestBackend) TokenUser(r *http.Request) (string, []string, error) {
+	tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", nil, errors.New("no token")
+	}
+
+	claims := &oidcAccessClaims{}
+	if _, err := jwt.ParseWithClaims(tokenStr, claims, func(*jwt.Token) (any, error) {
+		return oidcTestKey, nil
+	}); err != nil {
+		return "", nil, err
+	}
+	return claims.Subject, strings.Fields(claims.Scope), nil
+}
+
+func (oidcTestBackend) Identity(ctx context.Context, username string) (*oidc.Identity, error) {
+	return &oidc.Identity{Username: username, Email: username + "@example.com", EmailVerified: true}, nil
+}
+
+func (oidcTestBackend) IssueAccessToken(ctx context.Context, username, clientID string, scopes []string) (string, time.Duration, error) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &oidcAccessClaims{
+		Scope: strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}).SignedString(oidcTestKey)
+	return token, time.Minute, err
+}
+
+func (oidcTestBackend) SignIDToken(claims *oidc.IDTokenClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(oidcTestKey)
+}
+
+func (b oidcTestBackend) IntrospectToken(ctx context.Context, token string) (*oidc.TokenInfo, error) {
+	claims := &oidcAccessClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return oidcTestKey, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &oidc.TokenInfo{
+		Username:  claims.Subject,
+		ClientID:  claims.Audience[0],
+		Scopes:    strings.Fields(claims.Scope),
+		TokenType: "access_token",
+		Actor:     claims.Actor,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+func newOIDCTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	_, client := newMiniRedisClient(t)
+
+	secret := sha256.Sum256([]byte("partner-secret"))
+	clients := oidc.NewStaticClientRegistry(
+		&oidc.Client{
+			ID:           "dashboard",
+			Name:         "Dashboard",
+			RedirectURIs: []string{"https://app.example.com/callback"},
+			FirstParty:   true,
+		},
+		&oidc.Client{
+			ID:           "partner",
+			Name:         "Partner",
+			SecretHash:   hex.EncodeToString(secret[:]),
+			RedirectURIs: []string{"https://partner.example.com/cb"},
+		},
+	)
+
+	config := oidc.NewConfig("https://issuer.example.com", "https://app.example.com/login", "HS256")
+	provider := oidc.NewProvider(config, clients,
+		db.NewRedisOneTimeStore(client, "auth:oauth:code:", config.CodeDuration), oidcTestBackend{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.HandleDiscovery)
+	mux.HandleFunc("/oauth/authorize", provider.HandleAuthorize)
+	mux.HandleFunc("/oauth/token", provider.HandleToken)
+	mux.HandleFunc("/userinfo", provider.HandleUserInfo)
+	mux.HandleFunc("/v1/introspect", provider.HandleIntrospect)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// oidcTestClient plays the relying party: the browser and the login page
+// are simulated by calling the endpoints directly
+type oidcTestClient struct {
+	t        *testing.T
+	server   *httptest.Server
+	clientID string
+	redirect string
+	verifier string
+}
+
+func (c *oidcTestClient) authorizeRequest(extra map[string]any) map[string]any {
+	sum := sha256.Sum256([]byte(c.verifier))
+	req := map[string]any{
+		"response_type":         "code",
+		"client_id":             c.clientID,
+		"redirect_uri":          c.redirect,
+		"scope":                 "openid email profile",
+		"state":                 "xyz",
+		"nonce":                 "n-0S6_WzA2Mj",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(sum[:]),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range extra {
+		req[k] = v
+	}
+	return req
+}
+
+// authorize posts the authorization request as the logged in user and
+// returns the decoded JSON answer
+func (c *oidcTestClient) authorize(username string, extra map[string]any) (int, map[string]any) {
+	c.t.Helper()
+
+	body, _ := json.Marshal(c.authorizeRequest(extra))
+	req, _ := http.NewRequest(http.MethodPost, c.server.URL+"/oauth/authorize", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		req.Header.Set("Authorization", "Bearer session:"+username)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Authorize request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+// code authorizes and extracts the code from the redirect
+func (c *oidcTestClient) code(username string) string {
+	c.t.Helper()
+
+	status, result := c.authorize(username, nil)
+	if status != http.StatusOK {
+		c.t.Fatalf("Expected status 200 from authorize, got %d: %v", status, result)
+	}
+
+	redirect, err := url.Parse(result["redirect_to"].(string))
+	if err != nil {
+		c.t.Fatalf("Invalid redirect: %v", err)
+	}
+	if got := redirect.Scheme + "://" + redirect.Host + redirect.Path; got != c.redirect {
+		c.t.Fatalf("Redirected to %s, expected %s", got, c.redirect)
+	}
+	if redirect.Query().Get("state") != "xyz" {
+		c.t.Fatalf("State was not passed back: %s", redirect)
+	}
+	return redirect.Query().Get("code")
+}
+
+func (c *oidcTestClient) exchange(form url.Values, basicSecret string) (int, map[string]any) {
+	c.t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, c.server.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicSecret != "" {
+		req.SetBasicAuth(c.clientID, basicSecret)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func (c *oidcTestClient) tokenForm(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirect},
+		"client_id":     {c.clientID},
+		"code_verifier": {c.verifier},
+	}
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	server := newOIDCTestServer(t)
+	client := &oidcTestClient{
+		t:        t,
+		server:   server,
+		clientID: "dashboard",
+		redirect: "https://app.example.com/callback",
+		verifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+	}
+
+	// Discovery
+	resp, err := http.Get(server.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	var discovery map[string]any
+	json.NewDecoder(resp.Body).Decode(&discovery)
+	resp.Body.Close()
+	if discovery["issuer"] != "https://issuer.example.com" ||
+		discovery["token_endpoint"] != "https://issuer.example.com/oauth/token" {
+		t.Errorf("Unexpected discovery document: %v", discovery)
+	}
+
+	// Browsers are sent to the login page with the original query
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	query := url.Values{}
+	for k, v := range client.authorizeRequest(nil) {
+		query.Set(k, v.(string))
+	}
+	resp, err = noRedirect.Get(server.URL + "/oauth/authorize?" + query.Encode())
+	if err != nil {
+		t.Fatalf("Authorize redirect failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound ||
+		!strings.HasPrefix(resp.Header.Get("Location"), "https://app.example.com/login?") {
+		t.Fatalf("Expected a redirect to the login page, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// Posting without a session is refused
+	if status, _ := client.authorize("", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a session, got %d", status)
+	}
+
+	// First-party clients get a code without consent
+	code := client.code("alice")
+
+	status, tokens := client.exchange(client.tokenForm(code), "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200 from token, got %d: %v", status, tokens)
+	}
+
+	idClaims := &oidc.IDTokenClaims{}
+	if _, err := jwt.ParseWithClaims(tokens["id_token"].(string), idClaims, func(*jwt.Token) (any, error) {
+		return oidcTestKey, nil
+	}, jwt.WithIssuer("https://issuer.example.com"), jwt.WithAudience("dashboard")); err != nil {
+		t.Fatalf("Invalid ID token: %v", err)
+	}
+	if idClaims.Subject != "alice" || idClaims.Nonce != "n-0S6_WzA2Mj" || idClaims.Email != "alice@example.com" {
+		t.Errorf("Unexpected ID token claims: %+v", idClaims)
+	}
+
+	// A code is only good once
+	if status, result := client.exchange(client.tokenForm(code), ""); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant for a reused code, got %d %v", status, result)
+	}
+
+	// userinfo with the access token
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["access_token"].(string))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Userinfo failed: %v", err)
+	}
+	var userinfo map[string]any
+	json.NewDecoder(resp.Body).Decode(&userinfo)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || userinfo["sub"] != "alice" || userinfo["email_verified"] != true {
+		t.Errorf("Unexpected userinfo %d: %v", resp.StatusCode, userinfo)
+	}
+}
+
+func TestOIDCRejectsBadRequests(t *testing.T) {
+	server := newOIDCTestServer(t)
+	client := &oidcTestClient{
+		t:        t,
+		server:   server,
+		clientID: "dashboard",
+		redirect: "https://app.example.com/callback",
+		verifier: "M25iVXpKU3puUjFaYWg3T1NDTDQtcW1ROUY5YXlwalNoc0hhakxifmZHag",
+	}
+
+	// Wrong PKCE verifier
+	form := client.tokenForm(client.code("alice"))
+	form.Set("code_verifier", strings.Repeat("a", 43))
+	if status, result := client.exchange(form, ""); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant for a wrong verifier, got %d %v", status, result)
+	}
+
+	// A redirect_uri sent to /authorize has to be repeated
+	form = client.tokenForm(client.code("alice"))
+	form.Del("redirect_uri")
+	if status, result := client.exchange(form, ""); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant for a missing redirect_uri, got %d %v", status, result)
+	}
+
+	form = client.tokenForm(client.code("alice"))
+	form.Set("redirect_uri", "https://app.example.com/other")
+	if status, result := client.exchange(form, ""); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant for another redirect_uri, got %d %v", status, result)
+	}
+
+	// Without one the token request may leave it out too
+	_, result := client.authorize("alice", map[string]any{"redirect_uri": ""})
+	redirect, _ := url.Parse(result["redirect_to"].(string))
+	form = client.tokenForm(redirect.Query().Get("code"))
+	form.Del("redirect_uri")
+	if status, result := client.exchange(form, ""); status != http.StatusOK {
+		t.Errorf("Expected tokens for the default redirect_uri, got %d %v", status, result)
+	}
+
+	// Unregistered redirect URIs are never redirected to
+	if status, result := client.authorize("alice", map[string]any{"redirect_uri": "https://evil.example.com/cb"}); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown redirect_uri, got %d %v", status, result)
+	}
+
+	// Plain PKCE is not supported; the error goes back to the client
+	_, result = client.authorize("alice", map[string]any{"code_challenge_method": "plain"})
+	if redirect, _ := result["redirect_to"].(string); !strings.Contains(redirect, "error=invalid_request") {
+		t.Errorf("Expected an invalid_request redirect, got %v", result)
+	}
+
+	// openid is required
+	_, result = client.authorize("alice", map[string]any{"scope": "email"})
+	if redirect, _ := result["redirect_to"].(string); !strings.Contains(redirect, "error=invalid_scope") {
+		t.Errorf("Expected an invalid_scope redirect, got %v", result)
+	}
+}
+
+func TestOIDCConfidentialClient(t *testing.T) {
+	server := newOIDCTestServer(t)
+	client := &oidcTestClient{
+		t:        t,
+		server:   server,
+		clientID: "partner",
+		redirect: "https://partner.example.com/cb",
+		verifier: "c2VjcmV0LXZlcmlmaWVyLWZvci10aGUtcGFydG5lci1jbGllbnQtdGVzdA",
+	}
+
+	// Third-party clients need the user's consent
+	_, result := client.authorize("bob", nil)
+	if result["consent_required"] != true || result["client_name"] != "Partner" {
+		t.Fatalf("Expected consent to be required, got %v", result)
+	}
+
+	_, result = client.authorize("bob", map[string]any{"consent": false})
+	if redirect, _ := result["redirect_to"].(string); !strings.Contains(redirect, "error=access_denied") {
+		t.Errorf("Expected an access_denied redirect, got %v", result)
+	}
+
+	status, result := client.authorize("bob", map[string]any{"consent": true})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200 after consent, got %d", status)
+	}
+	redirect, _ := url.Parse(result["redirect_to"].(string))
+	code := redirect.Query().Get("code")
+
+	// The secret is required
+	form := client.tokenForm(code)
+	form.Del("client_id")
+	if status, _ := client.exchange(form, "wrong-secret"); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a wrong secret, got %d", status)
+	}
+
+	// A failed client authentication does not burn the code
+	if status, tokens := client.exchange(form, "partner-secret"); status != http.StatusOK || tokens["id_token"] == nil {
+		t.Errorf("Expected tokens with client_secret_basic, got %d %v", status, tokens)
+	}
+}
+
+func TestOIDCIntrospection(t *testing.T) {
+	server := newOIDCTestServer(t)
+
+	introspect := func(form url.Values, clientID, secret string) (int, map[string]any) {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if clientID != "" {
+			req.SetBasicAuth(clientID, secret)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Introspection request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var result map[string]any
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	token, _, _ := oidcTestBackend{}.IssueAccessToken(context.Background(), "carol", "dashboard", []string{"openid", "ads:read"})
+	form := url.Values{"token": {token}}
+
+	// Only confidential clients may introspect
+	if status, _ := introspect(form, "", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without client authentication, got %d", status)
+	}
+	if status, _ := introspect(form, "partner", "wrong-secret"); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a wrong secret, got %d", status)
+	}
+	if status, _ := introspect(url.Values{"token": {token}, "client_id": {"dashboard"}}, "", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a public client, got %d", status)
+	}
+
+	status, result := introspect(form, "partner", "partner-secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %v", status, result)
+	}
+	if result["active"] != true || result["sub"] != "carol" || result["scope"] != "openid ads:read" ||
+		result["client_id"] != "dashboard" || result["exp"] == nil {
+		t.Errorf("Unexpected introspection response: %v", result)
+	}
+
+	if _, ok := result["act"]; ok {
+		t.Errorf("Unexpected actor for a token of the user: %v", result["act"])
+	}
+
+	// Tokens minted by staff name the actor
+	impersonation, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &oidcAccessClaims{
+		Scope: "ads:read",
+		Actor: "admin",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "carol",
+			Audience:  jwt.ClaimStrings{"dashboard"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}).SignedString(oidcTestKey)
+	_, result = introspect(url.Values{"token": {impersonation}}, "partner", "partner-secret")
+	if act, _ := result["act"].(map[string]any); act["sub"] != "admin" || result["sub"] != "carol" {
+		t.Errorf("Expected carol acted on by admin, got %v", result)
+	}
+
+	// Invalid tokens are inactive and nothing else is disclosed
+	status, result = introspect(url.Values{"token": {token + "x"}}, "partner", "partner-secret")
+	if status != http.StatusOK || result["active"] != false || len(result) != 1 {
+		t.Errorf("Expected an inactive token, got %d %v", status, result)
+	}
+}
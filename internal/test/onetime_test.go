@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"internal/mailer"
+	"testing"
+	"time"
+)
+
+func TestOneTimeTokenStore(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisOneTimeStore(client, "test:reset:", 30*time.Minute)
+	ctx := context.Background()
+
+	token, err := store.Create(ctx, "testuser")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Only the hash may be stored
+	for _, key := range mr.Keys() {
+		if key == "test:reset:"+token {
+			t.Fatal("Token stored in plain text")
+		}
+	}
+
+	// Peeking leaves the token valid
+	for i := 0; i < 2; i++ {
+		if username, err := store.Peek(ctx, token); err != nil || username != "testuser" {
+			t.Fatalf("Peek failed: %q %v", username, err)
+		}
+	}
+
+	username, err := store.Consume(ctx, token)
+	if err != nil || username != "testuser" {
+		t.Fatalf("Consume failed: %q %v", username, err)
+	}
+
+	if _, err := store.Consume(ctx, token); !errors.Is(err, db.ErrOneTimeTokenInvalid) {
+		t.Fatalf("Token should be single-use, got %v", err)
+	}
+	if _, err := store.Peek(ctx, token); !errors.Is(err, db.ErrOneTimeTokenInvalid) {
+		t.Fatalf("Redeemed token should not be found, got %v", err)
+	}
+
+	expiring, _ := store.Create(ctx, "testuser")
+	mr.FastForward(31 * time.Minute)
+	if _, err := store.Consume(ctx, expiring); !errors.Is(err, db.ErrOneTimeTokenInvalid) {
+		t.Fatalf("Token should expire, got %v", err)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := mailer.NewMemoryMailer()
+	ctx := context.Background()
+
+	if _, ok := m.Last("test@example.com"); ok {
+		t.Fatal("No message expected yet")
+	}
+
+	m.Send(ctx, &mailer.Message{To: "test@example.com", Subject: "first"})
+	m.Send(ctx, &mailer.Message{To: "other@example.com", Subject: "other"})
+	m.Send(ctx, &mailer.Message{To: "test@example.com", Subject: "second"})
+
+	msg, ok := m.Last("test@example.com")
+	if !ok || msg.Subject != "second" {
+		t.Fatalf("Expected last message to be 'second', got %+v", msg)
+	}
+	if len(m.Messages()) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(m.Messages()))
+	}
+}
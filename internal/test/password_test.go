@@ -0,0 +1,76 @@
+package test
+
+import (
+	"internal/db"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	// Cheap parameters keep the test fast
+	argonConfig := db.NewPasswordHasherConfig()
+	argonConfig.Argon2.Memory = 1024
+	argonConfig.Argon2.Iterations = 1
+	argon, err := db.NewPasswordHasher(argonConfig)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher failed: %v", err)
+	}
+
+	bcryptConfig := db.NewPasswordHasherConfig()
+	bcryptConfig.Algorithm = db.AlgorithmBcrypt
+	bcryptConfig.BcryptCost = 4
+	bcrypter, err := db.NewPasswordHasher(bcryptConfig)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher failed: %v", err)
+	}
+
+	encoded, err := argon.Hash("password123")
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=2$") {
+		t.Fatalf("Unexpected PHC string: %s", encoded)
+	}
+
+	if ok, err := argon.Verify("password123", encoded); err != nil || !ok {
+		t.Errorf("Expected password to match: %v", err)
+	}
+	if ok, _ := argon.Verify("wrongpassword", encoded); ok {
+		t.Error("Wrong password should not match")
+	}
+	if argon.NeedsRehash(encoded) {
+		t.Error("Hash with current parameters should not need a rehash")
+	}
+
+	// Old bcrypt hashes still verify, but are flagged for migration
+	legacy, _ := bcrypter.Hash("password123")
+	if ok, err := argon.Verify("password123", legacy); err != nil || !ok {
+		t.Errorf("Expected bcrypt hash to verify: %v", err)
+	}
+	if !argon.NeedsRehash(legacy) {
+		t.Error("bcrypt hash should need a rehash when argon2id is configured")
+	}
+
+	// Stronger parameters make older argon2id hashes outdated too
+	stronger := db.NewPasswordHasherConfig()
+	stronger.Argon2.Memory = 2048
+	stronger.Argon2.Iterations = 1
+	strongerHasher, _ := db.NewPasswordHasher(stronger)
+	if !strongerHasher.NeedsRehash(encoded) {
+		t.Error("Hash with weaker parameters should need a rehash")
+	}
+
+	bcryptConfig.BcryptCost = 5
+	costlier, _ := db.NewPasswordHasher(bcryptConfig)
+	if !costlier.NeedsRehash(legacy) {
+		t.Error("bcrypt hash with lower cost should need a rehash")
+	}
+
+	if _, err := argon.Verify("password123", "plaintext"); err == nil {
+		t.Error("Unknown hash formats should be rejected")
+	}
+
+	if _, err := db.NewPasswordHasher(&db.PasswordHasherConfig{Algorithm: "md5"}); err == nil {
+		t.Error("Unknown algorithms should be rejected")
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"errors"
+	"internal/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordScore(t *testing.T) {
+	weak := []string{"password", "testpassword", "qwerty123", "aaaaaaaa", "abcdefgh", "P@ssw0rd1"}
+	for _, password := range weak {
+		if score := db.PasswordScore(password); score > 1 {
+			t.Errorf("%q scored %d, expected at most 1", password, score)
+		}
+	}
+
+	strong := []string{"Tangerine-Orbit-42", "Velvet-Harbor-77", "x7#Qm!v9Lp2$"}
+	for _, password := range strong {
+		if score := db.PasswordScore(password); score < 3 {
+			t.Errorf("%q scored %d, expected at least 3", password, score)
+		}
+	}
+
+	// User inputs are the first words an attacker tries
+	if db.PasswordScore("zorbalinux", "zorbalinux") >= db.PasswordScore("zorbalinux") {
+		t.Error("Password equal to a user input should score lower")
+	}
+
+	// Long inputs are cut before the quadratic search
+	start := time.Now()
+	if score := db.PasswordScore(strings.Repeat("Velvet-Harbor-77", 1000)); score != 4 {
+		t.Errorf("Long password scored %d, expected 4", score)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Scoring a long password took %s", elapsed)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	// SHA-1 of "password123"
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	corpus := "# test corpus\n" +
+		"CBFDAC6008F9CAB4083784CBD1874F76618D2A97:251682\n" +
+		"\n"
+	if err := os.WriteFile(path, []byte(corpus), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	breached, err := db.LoadBreachCorpus(path)
+	if err != nil {
+		t.Fatalf("LoadBreachCorpus failed: %v", err)
+	}
+
+	if count, err := db.BreachCount(breached, "password123"); err != nil || count != 251682 {
+		t.Errorf("Expected breach count 251682, got %d (%v)", count, err)
+	}
+	if count, _ := db.BreachCount(breached, "Tangerine-Orbit-42"); count != 0 {
+		t.Errorf("Expected no breach, got %d", count)
+	}
+
+	policy := &db.PasswordPolicy{MinScore: 2, Breached: breached}
+
+	if err := policy.Check("Tangerine-Orbit-42", "testuser", "test@example.com"); err != nil {
+		t.Errorf("Strong password rejected: %v", err)
+	}
+
+	tests := []struct {
+		password string
+		code     string
+	}{
+		{"password123", "breached"},
+		{"Testuser-Orbit-42", "contains_username"},
+		{"Orbit-jdoe.mail-42", "contains_email"},
+		{"monkey12", "too_weak"},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.password, "testuser", "jdoe.mail@example.com")
+
+		var policyErr *db.PasswordPolicyError
+		if !errors.As(err, &policyErr) {
+			t.Errorf("%q: expected PasswordPolicyError, got %v", tt.password, err)
+			continue
+		}
+
+		found := false
+		for _, v := range policyErr.Violations {
+			found = found || v.Code == tt.code
+		}
+		if !found {
+			t.Errorf("%q: expected violation %s, got %v", tt.password, tt.code, policyErr.Violations)
+		}
+	}
+
+	if _, err := db.LoadBreachCorpus(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for a missing corpus, got %v", err)
+	}
+}
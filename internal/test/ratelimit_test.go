@@ -0,0 +1,283 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"internal/ratelimit"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testLimiter checks the behaviour every Limiter shares, with a limit of 3
+// per minute
+func testLimiter(t *testing.T, limiter ratelimit.Limiter) {
+	t.Helper()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		decision, err := limiter.Allow(ctx, "203.0.113.1")
+		if err != nil || !decision.Allowed {
+			t.Fatalf("Expected request %d to be allowed: %+v %v", i+1, decision, err)
+		}
+		if decision.Limit != 3 || decision.Remaining != 2-i || decision.RetryAfter != 0 {
+			t.Fatalf("Unexpected decision for request %d: %+v", i+1, decision)
+		}
+		if decision.Reset <= 0 || decision.Reset > time.Minute {
+			t.Fatalf("Expected the budget to reset within the window: %v", decision.Reset)
+		}
+	}
+
+	decision, err := limiter.Allow(ctx, "203.0.113.1")
+	if err != nil || decision.Allowed {
+		t.Fatalf("Expected the fourth request to be rejected: %+v %v", decision, err)
+	}
+	if decision.Remaining != 0 || decision.RetryAfter <= 0 || decision.RetryAfter > decision.Reset {
+		t.Fatalf("Expected a rejection to say when to retry: %+v", decision)
+	}
+
+	// Keys have separate budgets
+	decision, err = limiter.Allow(ctx, "203.0.113.2")
+	if err != nil || !decision.Allowed || decision.Remaining != 2 {
+		t.Fatalf("Expected another key to be allowed: %+v %v", decision, err)
+	}
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	testLimiter(t, ratelimit.NewSlidingWindowLimiter(3, time.Minute))
+}
+
+func TestGCRALimiter(t *testing.T) {
+	testLimiter(t, ratelimit.NewGCRALimiter(3, time.Minute, 1000))
+}
+
+func TestGCRALimiterRefill(t *testing.T) {
+	ctx := context.Background()
+	// One request every 25ms, with a burst of 4
+	limiter := ratelimit.NewGCRALimiter(4, 100*time.Millisecond, 1000)
+
+	for i := 0; i < 4; i++ {
+		if decision, _ := limiter.Allow(ctx, "203.0.113.1"); !decision.Allowed {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	if decision, _ := limiter.Allow(ctx, "203.0.113.1"); decision.Allowed {
+		t.Fatal("Expected the burst to be used up")
+	}
+
+	// The budget refills one request at a time rather than all at once
+	time.Sleep(30 * time.Millisecond)
+	if decision, _ := limiter.Allow(ctx, "203.0.113.1"); !decision.Allowed {
+		t.Fatal("Expected one request to be allowed after an interval")
+	}
+	if decision, _ := limiter.Allow(ctx, "203.0.113.1"); decision.Allowed {
+		t.Fatal("Expected only one request to be refilled")
+	}
+}
+
+func TestGCRALimiterBoundsKeys(t *testing.T) {
+	ctx := context.Background()
+	limiter := ratelimit.NewGCRALimiter(1, time.Hour, 1000)
+
+	for i := 0; i < 100000; i++ {
+		limiter.Allow(ctx, fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff))
+	}
+	if n := limiter.Len(); n > 1000 {
+		t.Fatalf("Expected at most 1000 tracked keys, got %d", n)
+	}
+
+	// Recently seen keys survive a flood of new ones
+	limiter = ratelimit.NewGCRALimiter(1, time.Hour, 1)
+	limiter.Allow(ctx, "203.0.113.1")
+	if decision, _ := limiter.Allow(ctx, "203.0.113.1"); decision.Allowed {
+		t.Fatal("Expected the second request to be rejected")
+	}
+	limiter.Allow(ctx, "198.51.100.1")
+	if decision, _ := limiter.Allow(ctx, "203.0.113.1"); !decision.Allowed {
+		t.Fatal("Expected an evicted key to start with a full burst")
+	}
+}
+
+func TestRedisLimiter(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	mr.SetTime(time.Now())
+
+	testLimiter(t, ratelimit.NewRedisLimiter(client, 3, time.Minute))
+}
+
+func TestRedisLimiterSlidingWindow(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	ctx := context.Background()
+	start := time.Now()
+	mr.SetTime(start)
+
+	// Two instances on the same Redis share the budget
+	first := ratelimit.NewRedisLimiter(client, 2, time.Minute)
+	second := ratelimit.NewRedisLimiter(client, 2, time.Minute)
+
+	first.Allow(ctx, "198.51.100.7")
+	mr.SetTime(start.Add(30 * time.Second))
+	second.Allow(ctx, "198.51.100.7")
+
+	decision, _ := first.Allow(ctx, "198.51.100.7")
+	if decision.Allowed {
+		t.Fatal("Expected the budget to be shared between instances")
+	}
+	// The first request leaves the window in 30s, the second in 60s
+	if decision.RetryAfter != 30*time.Second || decision.Reset != time.Minute {
+		t.Errorf("Expected to retry in 30s and reset in 60s, got %v and %v", decision.RetryAfter, decision.Reset)
+	}
+
+	// Rejected requests do not count, and the first request leaves the window
+	mr.SetTime(start.Add(61 * time.Second))
+	if decision, _ := second.Allow(ctx, "198.51.100.7"); !decision.Allowed {
+		t.Fatal("Expected the first request to have left the window")
+	}
+	if decision, _ := second.Allow(ctx, "198.51.100.7"); decision.Allowed {
+		t.Fatal("Expected the request from 30s to still count")
+	}
+
+	if ttl := mr.TTL("auth:ratelimit:198.51.100.7"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected the log to expire with the window, got %v", ttl)
+	}
+}
+
+func TestRedisLimiterUnavailable(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	limiter := ratelimit.NewRedisLimiter(client, 3, time.Minute)
+	mr.Close()
+
+	if _, err := limiter.Allow(context.Background(), "203.0.113.1"); err == nil {
+		t.Fatal("Expected an error without Redis")
+	}
+}
+
+// benchmarkLimiter spreads requests from parallel goroutines over 4096 keys
+func benchmarkLimiter(b *testing.B, limiter ratelimit.Limiter) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.%d.%d", i>>8, i&0xff)
+	}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			limiter.Allow(ctx, keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func BenchmarkSlidingWindowLimiter(b *testing.B) {
+	benchmarkLimiter(b, ratelimit.NewSlidingWindowLimiter(100, time.Minute))
+}
+
+func BenchmarkGCRALimiter(b *testing.B) {
+	benchmarkLimiter(b, ratelimit.NewGCRALimiter(100, time.Minute, 100000))
+}
+
+func TestLoadRateLimitPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	os.WriteFile(path, []byte(`[
+		{"name": "default", "route": "*", "by": ["user", "ip"], "limit": 100, "window": "1m"},
+		{"name": "register", "route": "/v1/register", "method": "POST", "by": "ip", "limit": 5, "window": "1h"}
+	]`), 0o600)
+
+	policies, err := ratelimit.LoadPolicies(path)
+	if err != nil {
+		t.Fatalf("LoadPolicies failed: %v", err)
+	}
+	if len(policies) != 2 || len(policies[0].By) != 2 || policies[1].By[0] != ratelimit.ByIP ||
+		time.Duration(policies[1].Window) != time.Hour {
+		t.Errorf("Unexpected policies: %+v %+v", policies[0], policies[1])
+	}
+
+	for _, invalid := range []string{
+		`[{"name": "a", "route": "*", "by": "cookie", "limit": 1, "window": "1m"}]`,
+		`[{"name": "a", "route": "*", "by": "ip", "limit": 0, "window": "1m"}]`,
+		`[{"name": "a", "route": "*", "by": "ip", "limit": 1, "window": "soon"}]`,
+		`[{"name": "a", "route": "*", "by": ["api_key", "ip"], "limit": 1, "window": "1m"}]`,
+		`[{"name": "a", "route": "*", "by": "ip", "limit": 1, "window": "1m"},
+		  {"name": "a", "route": "/v1/login", "by": "ip", "limit": 1, "window": "1m"}]`,
+	} {
+		os.WriteFile(path, []byte(invalid), 0o600)
+		if _, err := ratelimit.LoadPolicies(path); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimitPolicyMatches(t *testing.T) {
+	tests := []struct {
+		policy        ratelimit.Policy
+		route, method string
+		want          bool
+	}{
+		{ratelimit.Policy{Route: "*"}, "/v1/login", "POST", true},
+		{ratelimit.Policy{Route: "/v1/login"}, "/v1/login", "GET", true},
+		{ratelimit.Policy{Route: "/v1/login"}, "/v1/login/2fa", "POST", false},
+		{ratelimit.Policy{Route: "/v1/login", Method: "POST"}, "/v1/login", "GET", false},
+		{ratelimit.Policy{Route: "/v1/admin/*"}, "/v1/admin/users/{username}", "GET", true},
+		{ratelimit.Policy{Route: "/v1/admin/*"}, "/v1/get_ads", "GET", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.Matches(tt.route, tt.method); got != tt.want {
+			t.Errorf("%q %q on %s %s = %t, want %t", tt.policy.Route, tt.policy.Method, tt.method, tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitPolicySet(t *testing.T) {
+	ctx := context.Background()
+	policies := []*ratelimit.Policy{
+		{Name: "default", Route: "*", By: ratelimit.Dimensions{ratelimit.ByUser, ratelimit.ByIP}, Limit: 3, Window: ratelimit.Duration(time.Minute)},
+		{Name: "register", Route: "/v1/register", Method: "POST", By: ratelimit.Dimensions{ratelimit.ByIP}, Limit: 1, Window: ratelimit.Duration(time.Hour)},
+	}
+	set := ratelimit.NewPolicySet(policies, func(p *ratelimit.Policy) ratelimit.Limiter {
+		return ratelimit.NewGCRALimiter(p.Limit, time.Duration(p.Window), 1000)
+	})
+
+	identity := func(ip, user string) func(string) string {
+		return func(by string) string {
+			return map[string]string{ratelimit.ByIP: ip, ratelimit.ByUser: user}[by]
+		}
+	}
+
+	// Stricter route policies apply on top of the default, and the one
+	// closest to rejecting is reported
+	result, _ := set.Allow(ctx, "/v1/register", "POST", identity("203.0.113.1", ""))
+	if result == nil || !result.Allowed || result.Policy.Name != "register" || result.Remaining != 0 {
+		t.Fatalf("Expected the first registration to be allowed by the register policy, got %+v", result)
+	}
+	result, _ = set.Allow(ctx, "/v1/register", "POST", identity("203.0.113.1", ""))
+	if result == nil || result.Allowed || result.Policy.Name != "register" || result.RetryAfter <= 0 {
+		t.Fatalf("Expected the register policy to reject, got %+v", result)
+	}
+
+	// Signed-in users behind the same NAT have their own budgets
+	for i := 0; i < 3; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			result, _ := set.Allow(ctx, "/v1/get_ads", "GET", identity("198.51.100.1", user))
+			if result == nil || !result.Allowed || result.Remaining != 2-i {
+				t.Fatalf("Expected request %d of %s to be allowed, got %+v", i+1, user, result)
+			}
+		}
+	}
+	result, _ = set.Allow(ctx, "/v1/get_ads", "GET", identity("198.51.100.1", "alice"))
+	if result == nil || result.Allowed || result.Policy.Name != "default" {
+		t.Fatalf("Expected alice's budget to be used up, got %+v", result)
+	}
+	if result, _ := set.Allow(ctx, "/v1/get_ads", "GET", identity("198.51.100.1", "")); result == nil || !result.Allowed {
+		t.Fatal("Expected anonymous requests to be counted by IP")
+	}
+
+	// Requests no policy can identify are not counted
+	if result, _ := set.Allow(ctx, "/v1/get_ads", "GET", identity("", "")); result != nil {
+		t.Fatalf("Expected no result without an identity, got %+v", result)
+	}
+}
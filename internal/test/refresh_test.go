@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newMiniRedisClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client, err := db.NewRedisClient(&db.RedisConfig{
+		Addr:        mr.Addr(),
+		DialTimeout: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return mr, client
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	_, client := newMiniRedisClient(t)
+	store := db.NewRedisRefreshStore(client, time.Hour)
+	ctx := context.Background()
+
+	first, err := store.Issue(ctx, "testuser", "family-1")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	username, family, second, err := store.Rotate(ctx, first)
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if username != "testuser" || family != "family-1" {
+		t.Errorf("Expected testuser in family-1, got %q in %q", username, family)
+	}
+	if second == first {
+		t.Error("Rotation should return a new token")
+	}
+
+	// Replaying the rotated token must revoke the whole family
+	if _, family, _, err := store.Rotate(ctx, first); !errors.Is(err, db.ErrRefreshTokenReused) || family != "family-1" {
+		t.Fatalf("Expected reuse error for family-1, got %v in %q", err, family)
+	}
+	if _, _, _, err := store.Rotate(ctx, second); !errors.Is(err, db.ErrRefreshTokenInvalid) {
+		t.Fatalf("Expected family to be revoked, got %v", err)
+	}
+
+	if _, _, _, err := store.Rotate(ctx, "not-a-token"); !errors.Is(err, db.ErrRefreshTokenInvalid) {
+		t.Fatalf("Expected invalid token error, got %v", err)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisRefreshStore(client, time.Minute)
+	ctx := context.Background()
+
+	token, err := store.Issue(ctx, "testuser", "family-1")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	mr.FastForward(2 * time.Minute)
+
+	if _, _, _, err := store.Rotate(ctx, token); !errors.Is(err, db.ErrRefreshTokenInvalid) {
+		t.Fatalf("Expected expired token to be rejected, got %v", err)
+	}
+}
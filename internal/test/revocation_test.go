@@ -0,0 +1,46 @@
+package test
+
+import (
+	"context"
+	"internal/db"
+	"testing"
+	"time"
+)
+
+func TestRevocationStore(t *testing.T) {
+	_, client := newMiniRedisClient(t)
+	store := db.NewRedisRevocationStore(client, 15*time.Minute)
+	ctx := context.Background()
+
+	issuedAt := time.Now().Add(-time.Minute)
+
+	revoked, err := store.IsRevoked(ctx, "jti-1", "testuser", issuedAt)
+	if err != nil || revoked {
+		t.Fatalf("Fresh token should not be revoked: %v %v", revoked, err)
+	}
+
+	// Revoke a single token
+	if err := store.Revoke(ctx, "jti-1", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-1", "testuser", issuedAt); !revoked {
+		t.Error("Token should be revoked by id")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-2", "testuser", issuedAt); revoked {
+		t.Error("Other tokens should not be affected")
+	}
+
+	// Revoke everything issued before now for the user
+	if err := store.RevokeUser(ctx, "testuser"); err != nil {
+		t.Fatalf("RevokeUser failed: %v", err)
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-2", "testuser", issuedAt); !revoked {
+		t.Error("Older tokens should be revoked for the user")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-3", "testuser", time.Now().Add(time.Second)); revoked {
+		t.Error("Tokens issued after the cutoff should stay valid")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-2", "otheruser", issuedAt); revoked {
+		t.Error("Other users should not be affected")
+	}
+}
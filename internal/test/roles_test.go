@@ -0,0 +1,36 @@
+package test
+
+import (
+	"internal/db"
+	"testing"
+)
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role, required string
+		want           bool
+	}{
+		{db.RoleUser, db.RoleUser, true},
+		{db.RoleUser, db.RoleSupport, false},
+		{db.RoleSupport, db.RoleUser, true},
+		{db.RoleSupport, db.RoleAdmin, false},
+		{db.RoleAdmin, db.RoleSupport, true},
+		{db.RoleAdmin, db.RoleAdmin, true},
+		// Tokens without a role, or with an unknown one, grant nothing
+		{"", db.RoleUser, false},
+		{"root", db.RoleUser, false},
+	}
+
+	for _, tt := range tests {
+		if got := db.HasRole(tt.role, tt.required); got != tt.want {
+			t.Errorf("HasRole(%q, %q) = %t, want %t", tt.role, tt.required, got, tt.want)
+		}
+	}
+
+	if db.ValidRole("root") || !db.ValidRole(db.RoleSupport) {
+		t.Error("ValidRole accepted an unknown role or rejected a known one")
+	}
+	if db.ValidCategory(-1) || !db.ValidCategory(db.YoungCategory) || db.ValidCategory(db.YoungCategory+1) {
+		t.Error("ValidCategory does not match the category constants")
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"internal/webauthn"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -15,8 +17,9 @@ import (
 const (
 	baseURL      = "https://localhost:8443/v1"
 	testUsername = "testuser"
-	testPassword = "testpassword"
+	testPassword = "Tangerine-Orbit-42"
 	testEmail    = "test@example.com"
+	newPassword  = "Velvet-Harbor-77"
 )
 
 var (
@@ -44,6 +47,11 @@ func TestUserLifecycle(t *testing.T) {
 	t.Run("Register new user", testRegister)
 	t.Run("Login with created user", testLogin)
 	t.Run("Get ads category", testGetAdsCategory)
+	t.Run("Get own profile", testMe)
+	t.Run("List and revoke sessions", testSessions)
+	t.Run("Register and log in with a passkey", testPasskey)
+	t.Run("Admin endpoints need a role", testAdminForbidden)
+	t.Run("Use a scoped API key", testAPIKey)
 	t.Run("Update user information", testUpdateUser)
 	t.Run("Delete user", testDeleteUser)
 }
@@ -68,6 +76,14 @@ func testRegister(t *testing.T) {
 }
 
 func testLogin(t *testing.T) {
+	// Save token for later tests
+	token = login(t)
+}
+
+// login signs the test user in and returns a new access token
+func login(t *testing.T) string {
+	t.Helper()
+
 	payload := map[string]interface{}{
 		"username": testUsername,
 		"password": testPassword,
@@ -84,17 +100,17 @@ func testLogin(t *testing.T) {
 		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
 	}
 
-	var result map[string]string
+	var result map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
-	if result["token"] == "" {
+	accessToken, _ := result["token"].(string)
+	if accessToken == "" {
 		t.Fatal("No token received in login response")
 	}
 
-	// Save token for later tests
-	token = result["token"]
+	return accessToken
 }
 
 func testGetAdsCategory(t *testing.T) {
@@ -123,6 +139,152 @@ func testGetAdsCategory(t *testing.T) {
 	}
 }
 
+func testMe(t *testing.T) {
+	if token == "" {
+		t.Fatal("No auth token available")
+	}
+
+	resp, err := makeRequest("GET", "/me", nil, token)
+	if err != nil {
+		t.Fatalf("Failed to get profile: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var profile map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if profile["username"] != testUsername || profile["email"] != testEmail || profile["role"] != "user" {
+		t.Fatalf("Unexpected profile: %v", profile)
+	}
+}
+
+func testSessions(t *testing.T) {
+	if token == "" {
+		t.Fatal("No auth token available")
+	}
+
+	// A second device
+	other := login(t)
+
+	resp, err := makeRequest("GET", "/sessions", nil, other)
+	if err != nil {
+		t.Fatalf("Failed to list sessions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			IP      string `json:"ip"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	current := ""
+	for _, session := range result.Sessions {
+		if session.Current {
+			current = session.ID
+		}
+	}
+	if len(result.Sessions) < 2 || current == "" {
+		t.Fatalf("Expected both sessions with the current one marked, got %+v", result.Sessions)
+	}
+
+	// Revoking the second device's session from the first one locks it out
+	resp, err = makeRequest("DELETE", "/sessions/"+current, nil, token)
+	if err != nil {
+		t.Fatalf("Failed to revoke session: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = makeRequest("GET", "/me", nil, other)
+	if err != nil {
+		t.Fatalf("Failed to get profile: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 after revocation, got %d", resp.StatusCode)
+	}
+}
+
+// testPasskey runs both ceremonies with a software authenticator; the
+// server is expected to run with the default WebAuthn settings
+func testPasskey(t *testing.T) {
+	if token == "" {
+		t.Fatal("No auth token available")
+	}
+
+	authenticator := newSoftAuthenticator(t, "localhost", "http://localhost:5173", webauthn.AlgES256)
+
+	var creation struct {
+		PublicKey webauthn.CreationOptions `json:"publicKey"`
+	}
+	postJSON(t, "/webauthn/register/options", nil, token, http.StatusOK, &creation)
+
+	payload := map[string]interface{}{
+		"name":       "Test laptop",
+		"credential": authenticator.create(creation.PublicKey.Challenge),
+	}
+	postJSON(t, "/webauthn/register", payload, token, http.StatusCreated, nil)
+
+	var request struct {
+		PublicKey webauthn.RequestOptions `json:"publicKey"`
+	}
+	postJSON(t, "/webauthn/login/options", map[string]interface{}{"username": testUsername}, "", http.StatusOK, &request)
+	if len(request.PublicKey.AllowCredentials) != 1 {
+		t.Fatalf("Expected the new passkey to be allowed, got %+v", request.PublicKey.AllowCredentials)
+	}
+
+	assertion := authenticator.get(t, request.PublicKey.Challenge, creation.PublicKey.User.ID)
+	var tokens map[string]interface{}
+	postJSON(t, "/webauthn/login", map[string]interface{}{"credential": assertion}, "", http.StatusOK, &tokens)
+	if tokens["token"] == nil || tokens["refresh_token"] == nil {
+		t.Fatalf("Expected tokens from a passkey login, got %v", tokens)
+	}
+
+	// The challenge was used up
+	postJSON(t, "/webauthn/login", map[string]interface{}{"credential": assertion}, "", http.StatusUnauthorized, nil)
+}
+
+// postJSON posts payload, checks the status and decodes the answer into out
+func postJSON(t *testing.T, endpoint string, payload interface{}, authToken string, status int, out interface{}) {
+	t.Helper()
+
+	resp, err := makeRequest("POST", endpoint, payload, authToken)
+	if err != nil {
+		t.Fatalf("Request to %s failed: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status %d from %s, got %d: %s", status, endpoint, resp.StatusCode, body)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+}
+
 func testUpdateUser(t *testing.T) {
 	if token == "" {
 		t.Fatal("No auth token available")
@@ -133,7 +295,7 @@ func testUpdateUser(t *testing.T) {
 		"password":     testPassword,
 		"email":        "updated@example.com",
 		"category":     2,
-		"new_password": "newpassword",
+		"new_password": newPassword,
 	}
 
 	resp, err := makeRequest("POST", "/update", payload, token)
@@ -150,7 +312,7 @@ func testUpdateUser(t *testing.T) {
 	// Login with new password to verify update
 	loginPayload := map[string]interface{}{
 		"username": testUsername,
-		"password": "newpassword",
+		"password": newPassword,
 	}
 
 	loginResp, err := makeRequest("POST", "/login", loginPayload, "")
@@ -187,6 +349,90 @@ func testUpdateUser(t *testing.T) {
 	}
 }
 
+func testAdminForbidden(t *testing.T) {
+	if token == "" {
+		t.Fatal("No auth token available")
+	}
+
+	for _, path := range []string{"/admin/users", "/stats"} {
+		resp, err := makeRequest("GET", path, nil, token)
+		if err != nil {
+			t.Fatalf("Failed to request %s: %v", path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403 for %s as a user, got %d", path, resp.StatusCode)
+		}
+	}
+
+	// Only admins may act as another user
+	postJSON(t, "/admin/users/"+testUsername+"/impersonate", map[string]string{"reason": "test"}, token, http.StatusForbidden, nil)
+}
+
+func testAPIKey(t *testing.T) {
+	if token == "" {
+		t.Fatal("No auth token available")
+	}
+
+	payload := map[string]interface{}{
+		"name":   "batch job",
+		"scopes": []string{"ads:read"},
+	}
+	resp, err := makeRequest("POST", "/api_keys", payload, token)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for api key creation, got %d", resp.StatusCode)
+	}
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	apiKey := "ApiKey " + created["key"].(string)
+
+	adsResp, err := makeRequest("GET", "/get_ads", nil, apiKey)
+	if err != nil {
+		t.Fatalf("Failed to get ads with api key: %v", err)
+	}
+	adsResp.Body.Close()
+	if adsResp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for get_ads with api key, got %d", adsResp.StatusCode)
+	}
+
+	// Account management needs a login session
+	deleteResp, err := makeRequest("DELETE", "/delete", nil, apiKey)
+	if err != nil {
+		t.Fatalf("Failed to request delete with api key: %v", err)
+	}
+	deleteResp.Body.Close()
+	if deleteResp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for delete with api key, got %d", deleteResp.StatusCode)
+	}
+
+	revokeResp, err := makeRequest("DELETE", "/api_keys/"+created["prefix"].(string), nil, token)
+	if err != nil {
+		t.Fatalf("Failed to revoke api key: %v", err)
+	}
+	revokeResp.Body.Close()
+	if revokeResp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for revocation, got %d", revokeResp.StatusCode)
+	}
+
+	adsResp, err = makeRequest("GET", "/get_ads", nil, apiKey)
+	if err != nil {
+		t.Fatalf("Failed to get ads with api key: %v", err)
+	}
+	adsResp.Body.Close()
+	if adsResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a revoked api key, got %d", adsResp.StatusCode)
+	}
+}
+
 func testDeleteUser(t *testing.T) {
 	if token == "" {
 		t.Fatal("No auth token available")
@@ -206,7 +452,7 @@ func testDeleteUser(t *testing.T) {
 	// Verify user is deleted by trying to login
 	payload := map[string]interface{}{
 		"username": testUsername,
-		"password": "newpassword", // Using the updated password
+		"password": newPassword, // Using the updated password
 	}
 
 	loginResp, err := makeRequest("POST", "/login", payload, "")
@@ -225,13 +471,14 @@ func TestInvalidRequests(t *testing.T) {
 	t.Run("Register with existing username", testRegisterDuplicate)
 	t.Run("Login with invalid credentials", testInvalidLogin)
 	t.Run("Access protected endpoint without token", testUnauthorizedAccess)
+	t.Run("Use a login link that was never sent", testInvalidMagicLink)
 }
 
 func testRegisterDuplicate(t *testing.T) {
 	// First, register a user
 	payload := map[string]interface{}{
 		"username": "dupluser",
-		"password": "testpassword",
+		"password": testPassword,
 		"email":    "dupl@example.com",
 		"category": 1,
 	}
@@ -298,12 +545,42 @@ func testUnauthorizedAccess(t *testing.T) {
 	}
 }
 
+func testInvalidMagicLink(t *testing.T) {
+	// Unknown users get the same answer as known ones
+	resp, err := makeRequest("POST", "/login/magic", map[string]string{"username": "nonexistentuser"}, "")
+	if err != nil {
+		t.Fatalf("Failed to request login link: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202 for login link, got %d", resp.StatusCode)
+	}
+
+	postJSON(t, "/login/magic/redeem", map[string]string{"token": "not-a-link"}, "", http.StatusUnauthorized, nil)
+}
+
 func TestServerStats(t *testing.T) {
-	// No authentication needed for stats endpoint in this implementation
+	// Stats are only available to admins
 	resp, err := makeRequest("GET", "/stats", nil, "")
 	if err != nil {
 		t.Fatalf("Failed to get server stats: %v", err)
 	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 for anonymous stats, got %d", resp.StatusCode)
+	}
+
+	// Admins are promoted in Cassandra, so the token has to come from outside
+	adminToken := os.Getenv("TEST_ADMIN_TOKEN")
+	if adminToken == "" {
+		t.Skip("Skipping admin stats: TEST_ADMIN_TOKEN not set")
+	}
+
+	resp, err = makeRequest("GET", "/stats", nil, adminToken)
+	if err != nil {
+		t.Fatalf("Failed to get server stats: %v", err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
@@ -347,7 +624,9 @@ func makeRequest(method, endpoint string, payload interface{}, authToken string)
 		return nil, err
 	}
 
-	if authToken != "" {
+	if strings.HasPrefix(authToken, "ApiKey ") {
+		req.Header.Set("Authorization", authToken)
+	} else if authToken != "" {
 		req.Header.Set("Authorization", "Bearer "+authToken)
 	}
 
@@ -382,7 +661,7 @@ func cleanupTestUser() {
 
 	// Try with new password if the user was updated
 	if result["token"] == "" {
-		payload["password"] = "newpassword"
+		payload["password"] = newPassword
 		resp, err = makeRequest("POST", "/login", payload, "")
 		if err != nil || resp.StatusCode != http.StatusOK {
 			if resp != nil {
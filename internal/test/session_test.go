@@ -0,0 +1,163 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"internal/db"
+	"testing"
+	"time"
+)
+
+func newTestSession(id string, ttl time.Duration) *db.Session {
+	now := time.Now().Truncate(time.Millisecond)
+	return &db.Session{
+		ID:        id,
+		Username:  "testuser",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64)",
+		IP:        "203.0.113.7",
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// testSessionStore runs the checks every SessionStore must pass
+func testSessionStore(t *testing.T, store db.SessionStore) {
+	ctx := context.Background()
+	_ = store.DeleteUserSessions(ctx, "testuser")
+
+	laptop := newTestSession("session-laptop", time.Hour)
+	phone := newTestSession("session-phone", time.Hour)
+	for _, session := range []*db.Session{laptop, phone} {
+		if err := store.AddSession(ctx, session); err != nil {
+			t.Fatalf("AddSession failed: %v", err)
+		}
+	}
+
+	stored, err := store.GetSession(ctx, laptop.ID)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if stored.Username != "testuser" || stored.IP != laptop.IP || stored.UserAgent != laptop.UserAgent ||
+		!stored.CreatedAt.Equal(laptop.CreatedAt) {
+		t.Errorf("Unexpected session: %+v", stored)
+	}
+
+	lastSeen := laptop.LastSeen.Add(5 * time.Minute)
+	if err := store.TouchSession(ctx, stored, lastSeen); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	if stored, err = store.GetSession(ctx, laptop.ID); err != nil || !stored.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected last seen %v, got %+v (%v)", lastSeen, stored, err)
+	}
+
+	sessions, err := store.ListSessions(ctx, "testuser")
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+
+	if err := store.DeleteSession(ctx, phone); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if _, err := store.GetSession(ctx, phone.ID); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Errorf("Expected deleted session to be gone, got %v", err)
+	}
+
+	if err := store.DeleteUserSessions(ctx, "testuser"); err != nil {
+		t.Fatalf("DeleteUserSessions failed: %v", err)
+	}
+	if sessions, err := store.ListSessions(ctx, "testuser"); err != nil || len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got %d (%v)", len(sessions), err)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	_, client := newMiniRedisClient(t)
+	testSessionStore(t, db.NewRedisSessionStore(client))
+}
+
+func TestRedisSessionExpiry(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisSessionStore(client)
+	ctx := context.Background()
+
+	session := newTestSession("session-short", time.Minute)
+	if err := store.AddSession(ctx, session); err != nil {
+		t.Fatalf("AddSession failed: %v", err)
+	}
+
+	// Touching must not extend the session
+	mr.FastForward(30 * time.Second)
+	if err := store.TouchSession(ctx, session, time.Now()); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	mr.FastForward(45 * time.Second)
+
+	if _, err := store.GetSession(ctx, session.ID); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Errorf("Expected expired session to be gone, got %v", err)
+	}
+
+	// Touching a deleted session must not bring it back
+	if err := store.TouchSession(ctx, session, time.Now()); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	if _, err := store.GetSession(ctx, session.ID); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Errorf("Expected touched session to stay gone, got %v", err)
+	}
+}
+
+func TestRedisSessionTombstone(t *testing.T) {
+	mr, client := newMiniRedisClient(t)
+	store := db.NewRedisSessionStore(client)
+	ctx := context.Background()
+
+	session := newTestSession("session-deleted", time.Hour)
+	if err := store.AddSession(ctx, session); err != nil {
+		t.Fatalf("AddSession failed: %v", err)
+	}
+	if err := store.DeleteSession(ctx, session); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+
+	// A refill that read the session before it was deleted must not bring it back
+	if err := store.AddSession(ctx, session); err != nil {
+		t.Fatalf("AddSession failed: %v", err)
+	}
+	if _, err := store.GetSession(ctx, session.ID); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Errorf("Expected deleted session to stay gone, got %v", err)
+	}
+	if sessions, _ := store.ListSessions(ctx, "testuser"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got %d", len(sessions))
+	}
+
+	// The same holds after signing out everywhere
+	other := newTestSession("session-other", time.Hour)
+	store.AddSession(ctx, other)
+	if err := store.DeleteUserSessions(ctx, "testuser"); err != nil {
+		t.Fatalf("DeleteUserSessions failed: %v", err)
+	}
+	store.AddSession(ctx, other)
+	if _, err := store.GetSession(ctx, other.ID); !errors.Is(err, db.ErrSessionNotFound) {
+		t.Errorf("Expected session to stay gone after DeleteUserSessions, got %v", err)
+	}
+
+	// Tombstones do not outlive the race they guard against
+	mr.FastForward(2 * time.Minute)
+	if len(mr.Keys()) != 0 {
+		t.Errorf("Expected tombstones to expire, got %v", mr.Keys())
+	}
+}
+
+func TestCassandraSessions(t *testing.T) {
+	repo, err := db.NewCassandraRepo(db.NewCassandraConfig("backend", "BPass0319", "cass_keyspace"))
+	if err != nil {
+		t.Skipf("Skipping test: failed to connect to Cassandra: %v", err)
+		return
+	}
+	defer repo.Close()
+
+	testSessionStore(t, repo)
+}
@@ -0,0 +1,302 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"internal/webauthn"
+	"testing"
+)
+
+// cborPair keeps map entries in the order the authenticator writes them
+type cborPair struct {
+	key, value any
+}
+
+// cborEncode encodes the subset of CBOR a software authenticator needs
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := head(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, cborEncode(pair.key)...)
+			out = append(out, cborEncode(pair.value)...)
+		}
+		return out
+	}
+	panic("cborEncode: unsupported type")
+}
+
+// softAuthenticator is a platform authenticator in memory
+type softAuthenticator struct {
+	rpID         string
+	origin       string
+	credentialID []byte
+	signer       crypto.Signer
+	signCount    uint32
+	// counting authenticators increment signCount on every assertion
+	counting bool
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string, alg int64) *softAuthenticator {
+	t.Helper()
+
+	a := &softAuthenticator{rpID: rpID, origin: origin, credentialID: make([]byte, 32)}
+	rand.Read(a.credentialID)
+
+	var err error
+	switch alg {
+	case webauthn.AlgES256:
+		a.signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		a.counting = true
+	case webauthn.AlgEdDSA:
+		_, a.signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch key := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return cborEncode([]cborPair{
+			{1, 2}, {3, int(webauthn.AlgES256)}, {-1, 1},
+			{-2, key.X.FillBytes(make([]byte, 32))},
+			{-3, key.Y.FillBytes(make([]byte, 32))},
+		})
+	case ed25519.PublicKey:
+		return cborEncode([]cborPair{
+			{1, 1}, {3, int(webauthn.AlgEdDSA)}, {-1, 6}, {-2, []byte(key)},
+		})
+	}
+	panic("unsupported key")
+}
+
+// authData builds authenticator data with user presence and verification
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+// create answers navigator.credentials.create
+func (a *softAuthenticator) create(challenge string) *webauthn.RegistrationResponse {
+	response := &webauthn.RegistrationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = a.clientData("webauthn.create", challenge)
+	response.Response.AttestationObject = cborEncode([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(true)},
+	})
+	response.Response.Transports = []string{"internal"}
+	return response
+}
+
+// get answers navigator.credentials.get
+func (a *softAuthenticator) get(t *testing.T, challenge string, userHandle []byte) *webauthn.AssertionResponse {
+	t.Helper()
+
+	if a.counting {
+		a.signCount++
+	}
+
+	response := &webauthn.AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = a.clientData("webauthn.get", challenge)
+	response.Response.AuthenticatorData = a.authData(false)
+	response.Response.UserHandle = userHandle
+
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(append([]byte{}, response.Response.AuthenticatorData...), clientDataHash[:]...)
+
+	var err error
+	if _, ok := a.signer.(ed25519.PrivateKey); ok {
+		response.Response.Signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		response.Response.Signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign assertion: %v", err)
+	}
+	return response
+}
+
+// roundTrip sends v through JSON as a browser would
+func roundTrip[T any](t *testing.T, v *T) *T {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	out := new(T)
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	return out
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	config := webauthn.NewConfig("example.com", "BCR", "https://example.com")
+	authenticator := newSoftAuthenticator(t, "example.com", "https://example.com", webauthn.AlgES256)
+
+	options := config.NewCreationOptions("cmVnaXN0ZXItY2hhbGxlbmdl", webauthn.User{ID: []byte{1}, Name: "alice"}, nil)
+	if options.RP.ID != "example.com" || options.AuthenticatorSelection.UserVerification != "required" ||
+		len(options.PubKeyCredParams) != len(webauthn.SupportedAlgorithms) {
+		t.Errorf("Unexpected creation options: %+v", options)
+	}
+
+	registration := roundTrip(t, authenticator.create(options.Challenge))
+	credential, err := config.VerifyRegistration(registration, options.Challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+	if credential.Algorithm != webauthn.AlgES256 || len(credential.AAGUID) != 16 || credential.Transports[0] != "internal" {
+		t.Errorf("Unexpected credential: %+v", credential)
+	}
+
+	if _, err := config.VerifyRegistration(registration, "b3RoZXItY2hhbGxlbmdl"); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("Expected a challenge mismatch, got %v", err)
+	}
+
+	challenge := "bG9naW4tY2hhbGxlbmdl"
+	assertion := roundTrip(t, authenticator.get(t, challenge, nil))
+	signCount, err := config.VerifyAssertion(assertion, challenge, credential.PublicKey, credential.SignCount)
+	if err != nil {
+		t.Fatalf("VerifyAssertion failed: %v", err)
+	}
+	if signCount != 1 {
+		t.Errorf("Expected sign count 1, got %d", signCount)
+	}
+
+	// A replayed or cloned authenticator does not move the counter forward
+	if _, err := config.VerifyAssertion(assertion, challenge, credential.PublicKey, signCount); !errors.Is(err, webauthn.ErrCredentialCloned) {
+		t.Errorf("Expected a cloned credential, got %v", err)
+	}
+
+	tampered := authenticator.get(t, challenge, nil)
+	tampered.Response.Signature[len(tampered.Response.Signature)-1] ^= 1
+	if _, err := config.VerifyAssertion(tampered, challenge, credential.PublicKey, signCount); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("Expected a bad signature, got %v", err)
+	}
+}
+
+func TestWebAuthnRejectsOtherSites(t *testing.T) {
+	config := webauthn.NewConfig("example.com", "BCR", "https://example.com")
+	challenge := "Y2hhbGxlbmdlLWNoYWxsZW5nZQ"
+
+	phishing := newSoftAuthenticator(t, "example.com", "https://examp1e.com", webauthn.AlgES256)
+	if _, err := config.VerifyRegistration(phishing.create(challenge), challenge); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("Expected the origin to be rejected, got %v", err)
+	}
+
+	otherRP := newSoftAuthenticator(t, "evil.com", "https://example.com", webauthn.AlgES256)
+	if _, err := config.VerifyRegistration(otherRP.create(challenge), challenge); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("Expected the RP ID to be rejected, got %v", err)
+	}
+}
+
+func TestWebAuthnEd25519WithoutCounter(t *testing.T) {
+	config := webauthn.NewConfig("example.com", "BCR", "https://example.com")
+	authenticator := newSoftAuthenticator(t, "example.com", "https://example.com", webauthn.AlgEdDSA)
+
+	challenge := "ZWQyNTUxOS1yZWdpc3Rlcg"
+	credential, err := config.VerifyRegistration(authenticator.create(challenge), challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+
+	// Authenticators without a counter always report 0
+	for i := 0; i < 2; i++ {
+		signCount, err := config.VerifyAssertion(authenticator.get(t, challenge, nil), challenge, credential.PublicKey, credential.SignCount)
+		if err != nil || signCount != 0 {
+			t.Fatalf("VerifyAssertion failed: %d %v", signCount, err)
+		}
+	}
+}
+
+func TestWebAuthnMalformedKeys(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, "example.com", "https://example.com", webauthn.AlgES256)
+	key := authenticator.coseKey()
+
+	if _, err := webauthn.ParsePublicKey(key); err != nil {
+		t.Fatalf("ParsePublicKey failed: %v", err)
+	}
+
+	// Truncations must fail cleanly rather than panic
+	for i := 0; i < len(key); i++ {
+		if _, err := webauthn.ParsePublicKey(key[:i]); err == nil {
+			t.Fatalf("Expected truncated key of %d bytes to be rejected", i)
+		}
+	}
+
+	// A point that is not on the curve
+	bad := cborEncode([]cborPair{
+		{1, 2}, {3, int(webauthn.AlgES256)}, {-1, 1},
+		{-2, make([]byte, 32)}, {-3, make([]byte, 32)},
+	})
+	if _, err := webauthn.ParsePublicKey(bad); !errors.Is(err, webauthn.ErrUnsupportedKey) {
+		t.Errorf("Expected an invalid point to be rejected, got %v", err)
+	}
+}
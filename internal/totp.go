@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters; these are the defaults every authenticator app supports
+const (
+	totpIssuer        = "BCR"
+	totpDigits        = 6
+	totpPeriod        = 30 * time.Second
+	totpSkew          = 1 // accepted steps before and after the current one
+	totpSecretBytes   = 20
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random base32 encoded secret
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI builds the otpauth:// provisioning URI shown as a QR code
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the code for the given time step (RFC 4226 HOTP)
+func totpCode(secret string, step uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// totpWindow is how long a code stays valid, from the moment it is shown
+// until its step leaves the accepted skew
+const totpWindow = (2*totpSkew + 1) * totpPeriod
+
+// verifyTOTP checks code against the current step and its neighbours and
+// returns the step it matched
+func verifyTOTP(secret, code string, now time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := uint64(now.Unix()) / uint64(totpPeriod.Seconds())
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := totpCode(secret, step+uint64(i))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step + uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = raw[:5] + "-" + raw[5:10]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes recovery codes case and dash insensitive
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"internal/db"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of RFC 6238 Appendix B, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B lists 8 digits; 6 digit codes are their last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step := uint64(tt.unix) / 30
+		code, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatalf("totpCode failed: %v", err)
+		}
+		if code != tt.code {
+			t.Errorf("At %d expected %s, got %s", tt.unix, tt.code, code)
+		}
+
+		matched, ok := verifyTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok || matched != step {
+			t.Errorf("At %d expected step %d to verify, got %d %v", tt.unix, step, matched, ok)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	// The code of step 1000 is accepted from the start of step 999 until the
+	// end of step 1001
+	const step = 1000
+	code, _ := totpCode(rfc6238Secret, step)
+	start := time.Unix(step*30, 0)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		ok   bool
+	}{
+		{"two steps early", start.Add(-31 * time.Second), false},
+		{"one step early", start.Add(-30 * time.Second), true},
+		{"on time", start, true},
+		{"end of step", start.Add(29 * time.Second), true},
+		{"one step late", start.Add(59 * time.Second), true},
+		{"two steps late", start.Add(60 * time.Second), false},
+	}
+
+	for _, tt := range tests {
+		matched, ok := verifyTOTP(rfc6238Secret, code, tt.now)
+		if ok != tt.ok {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.ok, ok)
+		}
+		if ok && matched != step {
+			t.Errorf("%s: expected step %d, got %d", tt.name, step, matched)
+		}
+	}
+
+	if _, ok := verifyTOTP(rfc6238Secret, "12345", start); ok {
+		t.Error("Expected a short code to be rejected")
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, testUsername, testEmail, true)
+	ts.repo.SaveTOTP(context.Background(), &db.TOTPSecret{Username: testUsername, Secret: rfc6238Secret, Enabled: true})
+
+	step := uint64(time.Now().Unix()) / 30
+	current, _ := totpCode(rfc6238Secret, step)
+	previous, _ := totpCode(rfc6238Secret, step-1)
+	next, _ := totpCode(rfc6238Secret, step+1)
+
+	loginWith := func(code string) int {
+		w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": testPassword}, "")
+		var challenge TokenResponse
+		json.NewDecoder(w.Body).Decode(&challenge)
+		if !challenge.MFARequired {
+			t.Fatalf("Expected a second factor to be required: %d", w.Code)
+		}
+
+		w = call(ts.handleLoginTOTP, http.MethodPost, "/v1/login/2fa", map[string]string{"challenge_token": challenge.ChallengeToken, "code": code}, "")
+		return w.Code
+	}
+
+	if code := loginWith(current); code != http.StatusOK {
+		t.Fatalf("Expected the current code to work, got %d", code)
+	}
+	if code := loginWith(current); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a replayed code to be rejected, got %d", code)
+	}
+	if code := loginWith(previous); code != http.StatusUnauthorized {
+		t.Fatalf("Expected an older code to be rejected, got %d", code)
+	}
+	if code := loginWith(next); code != http.StatusOK {
+		t.Fatalf("Expected the next code to work, got %d", code)
+	}
+}
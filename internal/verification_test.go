@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	w := call(ts.handleRegister, http.MethodPost, "/v1/register",
+		map[string]string{"username": testUsername, "password": testPassword, "email": testEmail}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Register failed: %d %s", w.Code, w.Body)
+	}
+	if user, _ := ts.userRepo.GetUser(ctx, testUsername); user.Verified {
+		t.Fatal("New accounts must start unverified")
+	}
+
+	token := ts.mailedToken(t, testEmail, "/verify-email")
+
+	if w := call(ts.handleVerifyEmail, http.MethodGet, "/v1/verify_email", nil, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without a token, got %d", w.Code)
+	}
+	if w := call(ts.handleVerifyEmail, http.MethodPost, "/v1/verify_email", map[string]string{"token": "bogus"}, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unknown token, got %d", w.Code)
+	}
+
+	if w := call(ts.handleVerifyEmail, http.MethodGet, "/v1/verify_email?token="+token, nil, ""); w.Code != http.StatusOK {
+		t.Fatalf("Verification failed: %d %s", w.Code, w.Body)
+	}
+	if user, _ := ts.userRepo.GetUser(ctx, testUsername); !user.Verified {
+		t.Fatal("Expected the account to be verified")
+	}
+
+	// Links work once
+	if w := call(ts.handleVerifyEmail, http.MethodGet, "/v1/verify_email?token="+token, nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a used token to be rejected, got %d", w.Code)
+	}
+
+	// Verified accounts need no new link
+	if w := call(ts.handleResendVerification, http.MethodPost, "/v1/verify_email/resend", nil, ts.login(t, testUsername)); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 when resending to a verified account, got %d", w.Code)
+	}
+}
+
+func TestUnverifiedPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		login  int
+		ads    int
+	}{
+		{UnverifiedAllow, http.StatusOK, http.StatusOK},
+		{UnverifiedBlockAds, http.StatusOK, http.StatusForbidden},
+		{UnverifiedBlockLogin, http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.unverifiedPolicy = tt.policy
+			ts.addUser(t, testUsername, testEmail, false)
+			ts.addUser(t, "verified", "verified@example.com", true)
+
+			// Verified accounts are never restricted
+			token := ts.login(t, "verified")
+			if w := call(ts.handleGetAdsCategory, http.MethodGet, "/v1/get_ads", nil, token); w.Code != http.StatusOK {
+				t.Fatalf("Expected verified account to get ads, got %d", w.Code)
+			}
+
+			w := call(ts.handleLogin, http.MethodPost, "/v1/login", map[string]string{"username": testUsername, "password": testPassword}, "")
+			if w.Code != tt.login {
+				t.Fatalf("Expected login to answer %d, got %d %s", tt.login, w.Code, w.Body)
+			}
+			if tt.login != http.StatusOK {
+				return
+			}
+
+			if w := call(ts.handleGetAdsCategory, http.MethodGet, "/v1/get_ads", nil, ts.login(t, testUsername)); w.Code != tt.ads {
+				t.Fatalf("Expected get_ads to answer %d, got %d %s", tt.ads, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestEmailChangeResetsVerified(t *testing.T) {
+	ts := newTestServer(t)
+	ts.unverifiedPolicy = UnverifiedBlockAds
+	ts.addUser(t, testUsername, testEmail, true)
+	ctx := context.Background()
+
+	// A link for the old address is still around when the address changes
+	user, _ := ts.userRepo.GetUser(ctx, testUsername)
+	ts.sendVerification(ctx, user)
+	oldToken := ts.mailedToken(t, testEmail, "/verify-email")
+
+	const newEmail = "new@example.com"
+	w := call(ts.handleUpdateUser, http.MethodPost, "/v1/update",
+		map[string]string{"password": testPassword, "email": newEmail}, ts.login(t, testUsername))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", w.Code, w.Body)
+	}
+
+	user, _ = ts.userRepo.GetUser(ctx, testUsername)
+	if user.Email != newEmail || user.Verified {
+		t.Fatalf("Expected the new address to be unverified, got %+v", user)
+	}
+	if w := call(ts.handleGetAdsCategory, http.MethodGet, "/v1/get_ads", nil, ts.login(t, testUsername)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected the unverified policy to apply again, got %d", w.Code)
+	}
+
+	// The old link must not verify the new address
+	if w := call(ts.handleVerifyEmail, http.MethodGet, "/v1/verify_email?token="+oldToken, nil, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the old link to be rejected, got %d %s", w.Code, w.Body)
+	}
+
+	newToken := ts.mailedToken(t, newEmail, "/verify-email")
+	if w := call(ts.handleVerifyEmail, http.MethodGet, "/v1/verify_email?token="+newToken, nil, ""); w.Code != http.StatusOK {
+		t.Fatalf("Verification of the new address failed: %d %s", w.Code, w.Body)
+	}
+	if user, _ := ts.userRepo.GetUser(ctx, testUsername); !user.Verified {
+		t.Fatal("Expected the new address to be verified")
+	}
+}
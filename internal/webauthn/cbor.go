@@ -0,0 +1,179 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// errCBOR is returned for anything the decoder cannot read
+var errCBOR = errors.New("invalid cbor")
+
+// cborMaxDepth bounds nesting so that hostile input cannot exhaust the stack
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first data item of data and returns it with the
+// remaining bytes. Only what authenticators emit is supported: definite
+// lengths, integers, byte and text strings, arrays, maps, tags (skipped),
+// simple values and floats. Integers decode to int64, maps to map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", errCBOR)
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	arg, rest, err := cborArgument(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), rest, nil
+
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), rest, nil
+
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: string longer than data", errCBOR)
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+
+	case 4:
+		// Every item takes at least one byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: array longer than data", errCBOR)
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+
+	case 5:
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, fmt.Errorf("%w: map longer than data", errCBOR)
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errCBOR, key)
+			}
+			if _, dup := m[key]; dup {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", errCBOR, key)
+			}
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+
+	case 6:
+		return decodeCBORItem(rest, depth+1)
+
+	default:
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		case 25:
+			return halfToFloat(uint16(arg)), rest, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), rest, nil
+		case 27:
+			return math.Float64frombits(arg), rest, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+}
+
+// cborArgument reads the argument that follows an initial byte
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: indefinite or reserved length", errCBOR)
+	}
+
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("%w: unexpected end of data", errCBOR)
+	}
+
+	switch size {
+	case 1:
+		return uint64(data[0]), data[1:], nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	default:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+}
+
+// halfToFloat converts an IEEE 754 half precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,135 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms accepted for credentials, in order of preference
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// SupportedAlgorithms are offered to authenticators at registration
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters (RFC 9053)
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+
+	// RSA keys reuse the first two labels for the modulus and exponent
+	coseN = -1
+	coseE = -2
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+var ErrUnsupportedKey = errors.New("unsupported credential public key")
+
+// PublicKey is a credential public key decoded from its COSE form
+type PublicKey struct {
+	Algorithm int64
+	key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	decoded, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrUnsupportedKey)
+	}
+	return publicKeyFromMap(decoded)
+}
+
+func publicKeyFromMap(decoded any) (*PublicKey, error) {
+	m, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a map", ErrUnsupportedKey)
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid P-256 key", ErrUnsupportedKey)
+		}
+
+		// ecdh rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+		}
+		return &PublicKey{Algorithm: alg, key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid Ed25519 key", ErrUnsupportedKey)
+		}
+		return &PublicKey{Algorithm: alg, key: ed25519.PublicKey(x)}, nil
+
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: invalid RSA key", ErrUnsupportedKey)
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		if exponent < 3 || exponent%2 == 0 {
+			return nil, fmt.Errorf("%w: invalid RSA exponent", ErrUnsupportedKey)
+		}
+		return &PublicKey{Algorithm: alg, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: exponent,
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("%w: key type %d with algorithm %d", ErrUnsupportedKey, kty, alg)
+}
+
+// Verify checks a signature over data
+func (k *PublicKey) Verify(data, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+// Package webauthn verifies WebAuthn registration and authentication
+// ceremonies for passkeys. Only "none" attestation is requested, so
+// authenticators are trusted on first use rather than by make and model.
+// Challenges and credential storage are left to the caller.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidResponse = errors.New("unauthorized: invalid webauthn response")
+	// ErrCredentialCloned means the signature counter went backwards, so
+	// the credential's private key likely exists twice
+	ErrCredentialCloned = errors.New("unauthorized: credential counter went backwards")
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+	flagExtensions   = 0x80
+)
+
+// Config describes the relying party
+type Config struct {
+	// RPID is the domain credentials are scoped to, such as "example.com"
+	RPID   string
+	RPName string
+	// Origins are the exact origins ceremonies may run on
+	Origins []string
+	// Timeout is how long the user has to complete a ceremony
+	Timeout time.Duration
+}
+
+// NewConfig returns a configuration with a five minute ceremony timeout
+func NewConfig(rpID, rpName string, origins ...string) *Config {
+	return &Config{
+		RPID:    rpID,
+		RPName:  rpName,
+		Origins: origins,
+		Timeout: 5 * time.Minute,
+	}
+}
+
+// Bytes is binary data sent to and from browsers as unpadded base64url
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// CredentialDescriptor names a credential in ceremony options
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// User is the account a credential is created for
+type User struct {
+	// ID is the opaque user handle stored on the authenticator
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions for
+// navigator.credentials.create
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User             User `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions for
+// navigator.credentials.get
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// NewCreationOptions asks for a discoverable, user-verified credential.
+// challenge must be unpadded base64url of at least 16 random bytes;
+// existing credentials of the user are excluded so they are not registered twice.
+func (c *Config) NewCreationOptions(challenge string, user User, exclude []CredentialDescriptor) *CreationOptions {
+	options := &CreationOptions{
+		Challenge:          challenge,
+		User:               user,
+		Timeout:            c.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		Attestation:        "none",
+	}
+	options.RP.ID = c.RPID
+	options.RP.Name = c.RPName
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "required"
+
+	for _, alg := range SupportedAlgorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int64  `json:"alg"`
+		}{"public-key", alg})
+	}
+	if options.ExcludeCredentials == nil {
+		options.ExcludeCredentials = []CredentialDescriptor{}
+	}
+
+	return options
+}
+
+// NewRequestOptions asks for a user-verified assertion. An empty allow
+// list lets the user pick any discoverable credential for the RP.
+func (c *Config) NewRequestOptions(challenge string, allow []CredentialDescriptor) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             c.RPID,
+		Timeout:          c.Timeout.Milliseconds(),
+		AllowCredentials: allow,
+		UserVerification: "required",
+	}
+}
+
+// RegistrationResponse is the PublicKeyCredential returned by
+// navigator.credentials.create, serialized as by toJSON()
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by
+// navigator.credentials.get, serialized as by toJSON()
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+// ClientData is the part of CollectedClientData the server checks
+type ClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ParseClientData decodes clientDataJSON. The challenge is returned as
+// sent, so callers can look it up before verifying the rest.
+func ParseClientData(clientDataJSON []byte) (*ClientData, error) {
+	clientData := &ClientData{}
+	if err := json.Unmarshal(clientDataJSON, clientData); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+	return clientData, nil
+}
+
+func (c *Config) checkClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	clientData, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidResponse, clientData.Type)
+	}
+	if clientData.Challenge != challenge {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	if !slices.Contains(c.Origins, clientData.Origin) {
+		return fmt.Errorf("%w: origin %q not allowed", ErrInvalidResponse, clientData.Origin)
+	}
+	return nil
+}
+
+// authenticatorData is the parsed authData of a ceremony
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// Attested credential data, only present at registration
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		authData.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: invalid credential id", ErrInvalidResponse)
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+		}
+		authData.publicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if authData.flags&flagExtensions != 0 {
+		var err error
+		if _, rest, err = decodeCBOR(rest); err != nil {
+			return nil, fmt.Errorf("%w: extensions: %v", ErrInvalidResponse, err)
+		}
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+
+	return authData, nil
+}
+
+func (c *Config) checkAuthenticatorData(authData *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: credential is for another relying party", ErrInvalidResponse)
+	}
+	if authData.flags&flagUserPresent == 0 || authData.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user was not verified", ErrInvalidResponse)
+	}
+	return nil
+}
+
+// Credential is a verified new credential to store
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE_Key as sent by the authenticator
+	PublicKey  []byte
+	Algorithm  int64
+	SignCount  uint32
+	AAGUID     []byte
+	Transports []string
+}
+
+// VerifyRegistration checks the response to NewCreationOptions issued
+// with challenge and returns the credential
+func (c *Config) VerifyRegistration(response *RegistrationResponse, challenge string) (*Credential, error) {
+	if response.Type != "public-key" {
+		return nil, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, response.Type)
+	}
+	if err := c.checkClientData(response.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, rest, err := decodeCBOR(response.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	attestation, _ := decoded.(map[any]any)
+	format, _ := attestation["fmt"].(string)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if format != "none" {
+		return nil, fmt.Errorf("%w: attestation format %q", ErrInvalidResponse, format)
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if !bytes.Equal(authData.credentialID, response.RawID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+
+	publicKey, err := ParsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:         authData.credentialID,
+		PublicKey:  authData.publicKey,
+		Algorithm:  publicKey.Algorithm,
+		SignCount:  authData.signCount,
+		AAGUID:     authData.aaguid,
+		Transports: response.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion checks the response to NewRequestOptions issued with
+// challenge against the stored public key and sign count, and returns
+// the new sign count to store
+func (c *Config) VerifyAssertion(response *AssertionResponse, challenge string, publicKey []byte, signCount uint32) (uint32, error) {
+	if response.Type != "public-key" {
+		return 0, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, response.Type)
+	}
+	if err := c.checkClientData(response.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := parseAuthenticatorData(response.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.checkAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(slices.Clip(response.Response.AuthenticatorData), clientDataHash[:]...)
+	if !key.Verify(signed, response.Response.Signature) {
+		return 0, fmt.Errorf("%w: bad signature", ErrInvalidResponse)
+	}
+
+	// Authenticators without a counter always send 0
+	if (authData.signCount != 0 || signCount != 0) && authData.signCount <= signCount {
+		return 0, ErrCredentialCloned
+	}
+
+	return authData.signCount, nil
+}